@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/bobbyunknown/Oh-my-builder/pkg/builder"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 )
@@ -25,6 +29,11 @@ var (
 	sizeFlag    int
 	outputFlag  string
 	patchFlag   string
+	formatFlag  string
+	workdirFlag string
+	keepFlag    bool
+	jobsFlag    int
+	noCacheFlag bool
 )
 
 func init() {
@@ -37,47 +46,124 @@ func init() {
 	buildCmd.Flags().IntVarP(&sizeFlag, "size", "s", 1024, "Image size in MB")
 	buildCmd.Flags().StringVarP(&outputFlag, "output", "o", "", "Output file path")
 	buildCmd.Flags().StringVar(&patchFlag, "patch", "", "Patch archive name")
+	buildCmd.Flags().StringVar(&workdirFlag, "workdir", "", "Directory for build workspaces (default $TMPDIR)")
+	buildCmd.Flags().BoolVar(&keepFlag, "keep-workdir", false, "Keep the build workspace if the build fails")
+	buildCmd.Flags().BoolVar(&noCacheFlag, "no-cache", false, "Extract kernel and rootfs afresh instead of reusing cached trees")
+	buildCmd.Flags().IntVarP(&jobsFlag, "jobs", "j", 1, "Number of matrix targets to build at once")
+	buildCmd.Flags().StringVar(&formatFlag, "output-format", "text", "Progress output format (text, json)")
 }
 
 func runBuild(cmd *cobra.Command, args []string) {
-	var config builder.BuildConfig
+	var targets []builder.BuildConfig
+
+	if formatFlag != "text" && formatFlag != "json" {
+		log.Fatalf("Unknown output format %q (use text or json)", formatFlag)
+	}
 
 	if profileFile != "" {
-		if err := loadProfile(profileFile, &config); err != nil {
+		var err error
+		if targets, err = loadProfile(profileFile); err != nil {
 			log.Fatalf("Failed to load profile: %v", err)
 		}
 	} else if deviceFlag != "" && kernelFlag != "" && rootfsFlag != "" {
-		config = builder.BuildConfig{
+		targets = []builder.BuildConfig{{
 			Device: deviceFlag,
 			Kernel: kernelFlag,
 			Rootfs: rootfsFlag,
 			Size:   sizeFlag,
 			Output: outputFlag,
-		}
+			Patch:  builder.PatchOption(patchFlag),
+		}}
 	} else {
 		log.Fatal("Either --profile or --device/--kernel/--rootfs flags are required")
 	}
 
-	if config.Output == "" {
-		config.Output = fmt.Sprintf("out/%s.img", config.Device)
+	for i := range targets {
+		config := &targets[i]
+		if cmd.Flags().Changed("patch") {
+			config.Patch = builder.PatchOption(patchFlag)
+		}
+		config.WorkRoot = workdirFlag
+		config.KeepWorkspace = keepFlag
+		config.NoCache = noCacheFlag
+		if config.Output == "" {
+			config.Output = fmt.Sprintf("out/%s.img", config.Device)
+		}
 	}
 
-	b, err := builder.NewBuilder(config, ".cache")
+	dm, err := newManager()
+	if err != nil {
+		log.Fatalf("Failed to create download manager: %v", err)
+	}
+	if formatFlag == "json" {
+		dm.Reporter = report.NewJSON(os.Stdout)
+		checkIndexes(dm, os.Stderr)
+	} else {
+		checkIndexes(dm, os.Stdout)
+	}
+
+	if len(targets) > 1 {
+		runMatrix(cmd, targets, dm)
+		return
+	}
+
+	b, err := builder.NewBuilder(targets[0], dm)
 	if err != nil {
 		log.Fatalf("Failed to create builder: %v", err)
 	}
-	defer b.Cleanup()
 
-	if err := b.Build(); err != nil {
+	err = b.Build(cmd.Context())
+	b.Cleanup()
+	if err != nil {
 		log.Fatalf("Build failed: %v", err)
 	}
 }
 
-func loadProfile(path string, config *builder.BuildConfig) error {
+func runMatrix(cmd *cobra.Command, targets []builder.BuildConfig, dm *download.Manager) {
+	results, err := builder.BuildMatrix(cmd.Context(), targets, dm, jobsFlag)
+	if err != nil {
+		log.Fatalf("Build failed: %v", err)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+
+	if formatFlag == "text" {
+		printSummary(results)
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d builds failed", failed, len(results))
+	}
+}
+
+func printSummary(results []builder.Result) {
+	fmt.Println("\n📋 Build summary:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "   TARGET\tSTATUS\tTIME\tOUTPUT")
+	for _, r := range results {
+		status, detail := "ok", r.Config.Output
+		if r.Err != nil {
+			status, detail = "FAILED", r.Err.Error()
+		}
+		fmt.Fprintf(w, "   %s\t%s\t%s\t%s\n", r.Target, status, r.Duration.Round(time.Second), detail)
+	}
+	w.Flush()
+}
+
+// loadProfile reads a profile and expands it into one config per target.
+func loadProfile(path string) ([]builder.BuildConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return yaml.Unmarshal(data, config)
+	var profile builder.Profile
+	if err := yaml.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	return profile.Targets()
 }
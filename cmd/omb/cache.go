@@ -0,0 +1,90 @@
+package omb
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/builder"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the local cache",
+	Long:  "Inspect and reclaim the space taken by downloads and staged kernel and rootfs trees",
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove staged trees and downloads",
+	Long:  "Remove the staged kernel and rootfs trees kept between builds, or only those not used for --older-than; with --downloads, remove the downloaded files too",
+	Run:   runCacheClean,
+}
+
+var cacheVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check cached downloads against the indexes",
+	Long:  "Check every cached kernel, rootfs, patch, loader and firmware file against the checksums in the local indexes and remove the ones that do not match",
+	Run:   runCacheVerify,
+}
+
+var (
+	olderThanFlag time.Duration
+	downloadsFlag bool
+)
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheCleanCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+
+	cacheCleanCmd.Flags().DurationVar(&olderThanFlag, "older-than", 0, "Only remove staged trees not used for this long (e.g. 168h)")
+	cacheCleanCmd.Flags().BoolVar(&downloadsFlag, "downloads", false, "Also remove everything downloaded to the cache")
+	cacheVerifyCmd.Flags().StringVar(&formatFlag, "output-format", "text", "Output format (text, json)")
+}
+
+func runCacheVerify(cmd *cobra.Command, args []string) {
+	if formatFlag != "text" && formatFlag != "json" {
+		log.Fatalf("Unknown output format %q (use text or json)", formatFlag)
+	}
+	dm, err := newManager()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if formatFlag == "json" {
+		dm.Reporter = report.NewJSON(os.Stdout)
+	}
+
+	if err := dm.ValidateCache(cmd.Context()); err != nil {
+		log.Fatalf("Cache validation failed: %v", err)
+	}
+}
+
+func runCacheClean(cmd *cobra.Command, args []string) {
+	dm, err := newManager()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	staging := builder.NewStaging(dm.Config.StagingDir(), 0)
+	olderThan := olderThanFlag
+	if olderThan <= 0 {
+		// Everything that is not in use by a running build.
+		olderThan = time.Nanosecond
+	}
+	removed, freed, err := staging.Prune(0, olderThan)
+	if err != nil {
+		log.Fatalf("Failed to clean staged trees: %v", err)
+	}
+	fmt.Printf("🧹 Removed %d staged trees (%s) from %s\n", removed, formatSize(freed), dm.Config.StagingDir())
+
+	if downloadsFlag {
+		if err := dm.ClearCache(cmd.Context()); err != nil {
+			log.Fatalf("Failed to clean downloads: %v", err)
+		}
+		fmt.Printf("🧹 Removed downloads from %s\n", dm.Config.CacheDir())
+	}
+}
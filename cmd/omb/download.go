@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
 	"github.com/spf13/cobra"
 )
 
@@ -28,21 +27,31 @@ var downloadRootfsCmd = &cobra.Command{
 	Run:   runDownloadRootfs,
 }
 
+var downloadPatchCmd = &cobra.Command{
+	Use:   "patch [name]",
+	Short: "Download patch archive",
+	Args:  cobra.ExactArgs(1),
+	Run:   runDownloadPatch,
+}
+
 func init() {
 	rootCmd.AddCommand(downloadCmd)
 	downloadCmd.AddCommand(downloadKernelCmd)
 	downloadCmd.AddCommand(downloadRootfsCmd)
+	downloadCmd.AddCommand(downloadPatchCmd)
+
+	downloadKernelCmd.Flags().StringVar(&vendorFilter, "vendor", "", "Fail unless the device trees for this vendor (amlogic, rockchip, allwinner) are downloaded")
 }
 
 func runDownloadKernel(cmd *cobra.Command, args []string) {
 	version := args[0]
 
-	dm, err := download.NewManager()
+	dm, err := newManager()
 	if err != nil {
 		log.Fatalf("Failed to create download manager: %v", err)
 	}
 
-	if err := dm.DownloadKernel(version); err != nil {
+	if err := dm.DownloadKernel(cmd.Context(), version, vendorFilter); err != nil {
 		log.Fatalf("Failed to download kernel: %v", err)
 	}
 
@@ -52,14 +61,29 @@ func runDownloadKernel(cmd *cobra.Command, args []string) {
 func runDownloadRootfs(cmd *cobra.Command, args []string) {
 	name := args[0]
 
-	dm, err := download.NewManager()
+	dm, err := newManager()
 	if err != nil {
 		log.Fatalf("Failed to create download manager: %v", err)
 	}
 
-	if err := dm.DownloadRootfs(name); err != nil {
+	if err := dm.DownloadRootfs(cmd.Context(), name); err != nil {
 		log.Fatalf("Failed to download rootfs: %v", err)
 	}
 
 	fmt.Printf("\n✓ Rootfs %s downloaded to %s\n", name, dm.GetRootfsPath(name))
 }
+
+func runDownloadPatch(cmd *cobra.Command, args []string) {
+	name := args[0]
+
+	dm, err := newManager()
+	if err != nil {
+		log.Fatalf("Failed to create download manager: %v", err)
+	}
+
+	if err := dm.DownloadPatch(cmd.Context(), name); err != nil {
+		log.Fatalf("Failed to download patch: %v", err)
+	}
+
+	fmt.Printf("\n✓ Patch %s downloaded to %s\n", name, dm.GetPatchPath(name))
+}
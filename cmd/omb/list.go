@@ -1,49 +1,257 @@
 package omb
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"slices"
+	"strings"
 
+	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
 	"github.com/bobbyunknown/Oh-my-builder/pkg/index"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 	"github.com/spf13/cobra"
 )
 
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List available components",
-	Long:  "List available kernels, rootfs, or devices from cached indexes",
+	Long:  "List available kernels, rootfs, patches or devices from cached indexes",
 }
 
 var listKernelsCmd = &cobra.Command{
 	Use:   "kernels",
 	Short: "List available kernels",
+	Long:  "List the kernels in configs/kernels.yaml, newest first, with the vendors they have device trees for",
 	Run:   runListKernels,
 }
 
+var listRootfsCmd = &cobra.Command{
+	Use:   "rootfs",
+	Short: "List available rootfs images",
+	Long:  "List the rootfs images in configs/rootfs.yaml, newest first",
+	Run:   runListRootfs,
+}
+
+var listPatchesCmd = &cobra.Command{
+	Use:   "patches",
+	Short: "List available patches",
+	Long:  "List the patch archives in configs/patch.yaml, newest first",
+	Run:   runListPatches,
+}
+
 var listDevicesCmd = &cobra.Command{
 	Use:   "devices",
 	Short: "List available devices",
 	Run:   runListDevices,
 }
 
-var vendorFilter string
+var (
+	vendorFilter string
+	cachedFilter bool
+	latestFilter bool
+	jsonFlag     bool
+)
 
 func init() {
 	rootCmd.AddCommand(listCmd)
 	listCmd.AddCommand(listKernelsCmd)
+	listCmd.AddCommand(listRootfsCmd)
+	listCmd.AddCommand(listPatchesCmd)
 	listCmd.AddCommand(listDevicesCmd)
 
 	listDevicesCmd.Flags().StringVar(&vendorFilter, "vendor", "", "Filter devices by vendor (amlogic, rockchip, allwinner)")
+	listKernelsCmd.Flags().StringVar(&vendorFilter, "vendor", "", "Only kernels with device trees for this vendor (amlogic, rockchip, allwinner)")
+
+	for _, cmd := range []*cobra.Command{listKernelsCmd, listRootfsCmd, listPatchesCmd} {
+		cmd.Flags().BoolVar(&cachedFilter, "cached", false, "Only entries downloaded to .cache/data")
+		cmd.Flags().BoolVar(&jsonFlag, "json", false, "Print the entries as JSON")
+	}
+	listKernelsCmd.Flags().BoolVar(&latestFilter, "latest", false, "Only the newest kernel of each series (6.1, 6.6, ...)")
+	listRootfsCmd.Flags().BoolVar(&latestFilter, "latest", false, "Only the newest version of each rootfs")
+	listPatchesCmd.Flags().BoolVar(&latestFilter, "latest", false, "Only the newest version of each patch")
+}
+
+// listEntry is one kernel, rootfs or patch in a listing, and one object
+// of its --json output.
+type listEntry struct {
+	Version string   `json:"version,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Release string   `json:"release,omitempty"`
+	Vendors []string `json:"vendors,omitempty"`
+	Size    int64    `json:"size"`
+	Cache   string   `json:"cache"`
+	Repo    string   `json:"repo,omitempty"`
+
+	// group is what --latest keeps one entry of: the kernel series or
+	// the name without its versions.
+	group string
+}
+
+func (e listEntry) key() string {
+	if e.Version != "" {
+		return e.Version
+	}
+	return e.Name
 }
 
 func runListKernels(cmd *cobra.Command, args []string) {
-	// TODO: Implement kernel listing
-	fmt.Println("Kernel listing not yet implemented")
-	fmt.Println("Run './omb repo update' first to fetch kernel list")
+	dm := listManager()
+
+	kernels, err := config.LoadKernels()
+	if err != nil {
+		log.Fatalf("Failed to load kernels: %v\nRun './omb repo update' to fetch kernel list", err)
+	}
+
+	var entries []listEntry
+	for _, k := range kernels.Kernels {
+		vendors := k.Vendors
+		if len(vendors) == 0 && k.Vendor != "" && k.Vendor != "unknown" {
+			vendors = []string{k.Vendor}
+		}
+		if vendorFilter != "" && !slices.Contains(vendors, vendorFilter) {
+			continue
+		}
+
+		var size int64
+		for _, f := range k.Files {
+			size += f.Size
+		}
+		entries = append(entries, listEntry{
+			Version: k.Version,
+			Release: k.Release,
+			Vendors: vendors,
+			Size:    size,
+			Cache:   dm.CacheState(download.Artifact{Kind: download.KindKernel, Name: k.Version, Vendor: vendorFilter}),
+			Repo:    k.Repo,
+			group:   index.Series(k.Version),
+		})
+	}
+
+	title := "Available Kernels"
+	if vendorFilter != "" {
+		title += " (" + vendorFilter + ")"
+	}
+	printEntries(title, "kernels", entries)
+}
+
+func runListRootfs(cmd *cobra.Command, args []string) {
+	dm := listManager()
+
+	rootfs, err := config.LoadRootfs()
+	if err != nil {
+		log.Fatalf("Failed to load rootfs: %v\nRun './omb repo update' to fetch rootfs list", err)
+	}
+
+	var entries []listEntry
+	for _, r := range rootfs.Rootfs {
+		entries = append(entries, listEntry{
+			Name:  r.Name,
+			Size:  r.Size,
+			Cache: dm.CacheState(download.Artifact{Kind: download.KindRootfs, Name: r.Name}),
+			Repo:  r.Repo,
+			group: index.Family(r.Name),
+		})
+	}
+	printEntries("Available Rootfs", "rootfs", entries)
+}
+
+func runListPatches(cmd *cobra.Command, args []string) {
+	dm := listManager()
+
+	patches, err := config.LoadPatches()
+	if err != nil {
+		log.Fatalf("Failed to load patches: %v\nRun './omb repo update' to fetch patch list", err)
+	}
+
+	var entries []listEntry
+	for _, p := range patches.Patches {
+		entries = append(entries, listEntry{
+			Name:  p.Name,
+			Size:  p.Size,
+			Cache: dm.CacheState(download.Artifact{Kind: download.KindPatch, Name: p.Name}),
+			Repo:  p.Repo,
+			group: index.Family(p.Name),
+		})
+	}
+	printEntries("Available Patches", "patches", entries)
+}
+
+// printEntries sorts entries newest first, rootfs and patches by name
+// first, applies --cached and --latest and prints them as a table, or as
+// JSON with --json.
+func printEntries(title, noun string, entries []listEntry) {
+	slices.SortStableFunc(entries, func(a, b listEntry) int {
+		if a.Version == "" {
+			if c := strings.Compare(a.group, b.group); c != 0 {
+				return c
+			}
+		}
+		return index.CompareVersions(b.key(), a.key())
+	})
+
+	var shown []listEntry
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if cachedFilter && e.Cache != download.CacheCached {
+			continue
+		}
+		if latestFilter {
+			if seen[e.group] {
+				continue
+			}
+			seen[e.group] = true
+		}
+		shown = append(shown, e)
+	}
+
+	if jsonFlag {
+		if shown == nil {
+			shown = []listEntry{}
+		}
+		data, err := json.MarshalIndent(shown, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode %s: %v", noun, err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Printf("%s:\n", title)
+	if len(shown) == 0 {
+		fmt.Printf("No %s found\n", noun)
+		return
+	}
+	for _, e := range shown {
+		name := e.key()
+		if len(e.Vendors) > 0 {
+			name = fmt.Sprintf("%-14s %s", name, strings.Join(e.Vendors, ", "))
+		}
+		fmt.Printf("  %-50s %10s  %s\n", name, formatSize(e.Size), e.Cache)
+	}
+
+	fmt.Printf("\nTotal: %d %s\n", len(shown), noun)
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
 func runListDevices(cmd *cobra.Command, args []string) {
-	registry, err := index.LoadDevices("configs/devices.yaml")
+	dm := listManager()
+
+	registry, err := index.LoadDevices(dm.Config.IndexPath("devices.yaml"))
 	if err != nil {
 		log.Fatalf("Failed to load devices: %v\nRun './omb repo update' to fetch device list", err)
 	}
@@ -68,3 +276,20 @@ func runListDevices(cmd *cobra.Command, args []string) {
 
 	fmt.Printf("\nTotal: %d devices\n", len(devices))
 }
+
+// listManager returns the download manager a listing checks the cache
+// with, after checking the age of the indexes. With --json, warnings and
+// update output go to stderr so stdout stays valid JSON.
+func listManager() *download.Manager {
+	dm, err := newManager()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if jsonFlag {
+		dm.Reporter = report.NewText(os.Stderr)
+		checkIndexes(dm, os.Stderr)
+	} else {
+		checkIndexes(dm, os.Stdout)
+	}
+	return dm
+}
@@ -1,11 +1,18 @@
 package omb
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
 	"github.com/bobbyunknown/Oh-my-builder/pkg/repo"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 	"github.com/spf13/cobra"
 )
 
@@ -22,103 +29,210 @@ var updateCmd = &cobra.Command{
 	Run:   runUpdate,
 }
 
+var indexCmd = &cobra.Command{
+	Use:   "index <dir>",
+	Short: "Write the file index of a mirror",
+	Long:  "Hash every file below a copy of the data branch and write the index.yaml an http repository serves",
+	Args:  cobra.ExactArgs(1),
+	Run:   runIndex,
+}
+
+var forceFlag bool
+
 func init() {
 	rootCmd.AddCommand(repoCmd)
 	repoCmd.AddCommand(updateCmd)
-}
+	repoCmd.AddCommand(indexCmd)
 
-func runUpdate(cmd *cobra.Command, args []string) {
-	fmt.Println("🔄 Updating repository indexes...")
-	fmt.Println()
+	updateCmd.Flags().BoolVar(&forceFlag, "force", false, "Fetch every index even if the repositories have not changed")
+}
 
-	repoCfg, err := repo.LoadDataRepo("configs/config.yaml")
+func runIndex(cmd *cobra.Command, args []string) {
+	dir := args[0]
+	index, err := repo.BuildMirrorIndex(dir)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-	owner, name, err := repo.ParseRepoURL(repoCfg.URL)
-	if err != nil {
-		log.Fatalf("Failed to parse repo url: %v", err)
+		log.Fatalf("Failed to index %s: %v", dir, err)
 	}
-	indexer := repo.NewIndexer(owner, name, repoCfg.Branch, repoCfg.Components)
 
-	fmt.Print("   Fetching kernels...     ")
-	kernels, err := indexer.FetchKernelIndex()
-	if err != nil {
-		fmt.Printf("❌ Error: %v\n", err)
-	} else {
-		fmt.Printf("✓ Found %d kernels\n", len(kernels.Kernels))
+	indexPath := filepath.Join(dir, repo.MirrorIndexFile)
+	if err := repo.SaveIndex(indexPath, index); err != nil {
+		log.Fatalf("Failed to save %s: %v", indexPath, err)
 	}
+	fmt.Printf("✓ Indexed %d files into %s\n", len(index.Files), indexPath)
+}
 
-	fmt.Print("   Fetching rootfs...      ")
-	rootfs, err := indexer.FetchRootfsIndex()
+func runUpdate(cmd *cobra.Command, args []string) {
+	dm, err := newManager()
 	if err != nil {
-		fmt.Printf("❌ Error: %v\n", err)
-	} else {
-		fmt.Printf("✓ Found %d rootfs\n", len(rootfs.Rootfs))
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if dm.Offline {
+		log.Fatalf("Cannot update indexes in offline mode: drop --offline or set offline: false in %s", dm.Config.IndexPath("config.yaml"))
 	}
 
-	fmt.Print("   Fetching devices...     ")
-	devices, err := indexer.FetchDeviceIndex()
-	if err != nil {
-		fmt.Printf("❌ Error: %v\n", err)
-	} else {
-		fmt.Printf("✓ Found %d devices\n", len(devices.Devices))
+	if err := updateIndexes(os.Stdout, dm.Config, forceFlag); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	fmt.Print("   Fetching patch...       ")
-	patches, err := indexer.FetchPatchIndex()
-	if err != nil {
-		fmt.Printf("❌ Error: %v\n", err)
-	} else {
-		fmt.Printf("✓ Found %d patches\n", len(patches.Patches))
+	if err := dm.ValidateCache(cmd.Context()); err != nil {
+		dm.Reporter.Report(report.Event{Kind: report.Warning, Message: fmt.Sprintf("cache validation failed: %v", err)})
 	}
+}
 
-	fmt.Println()
-	fmt.Println("📝 Saving indexes...")
+// indexUpdate is one run of 'omb repo update'.
+type indexUpdate struct {
+	w        io.Writer
+	cfg      *config.Config
+	indexers []*repo.Indexer
+	force    bool
 
-	if kernels != nil {
-		fmt.Print("   kernels.yaml            ")
-		if err := repo.SaveIndex("configs/kernels.yaml", kernels); err != nil {
-			fmt.Printf("❌ Error: %v\n", err)
-		} else {
-			fmt.Println("✓ Saved")
-		}
-	}
+	// revisions are what every repository serves now, nil when one of
+	// them cannot tell.
+	revisions map[string]string
 
-	if rootfs != nil {
-		fmt.Print("   rootfs.yaml             ")
-		if err := repo.SaveIndex("configs/rootfs.yaml", rootfs); err != nil {
-			fmt.Printf("❌ Error: %v\n", err)
-		} else {
-			fmt.Println("✓ Saved")
+	// results are the indexes to save, by file name.
+	results map[string]repo.Index
+}
+
+// updateIndexes fetches the indexes of every repository in cfg, merges
+// them and saves them next to the config. An index built from the
+// revisions the repositories still serve is kept, unless force is set.
+func updateIndexes(w io.Writer, cfg *config.Config, force bool) error {
+	fmt.Fprintln(w, "🔄 Updating repository indexes...")
+	fmt.Fprintln(w)
+
+	repos, err := repo.LoadRepositories(cfg.IndexPath("config.yaml"))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	u := &indexUpdate{w: w, cfg: cfg, force: force, revisions: map[string]string{}, results: map[string]repo.Index{}}
+	known := repo.KnownFiles(filepath.Dir(cfg.IndexPath("config.yaml")))
+	for _, r := range repos {
+		dir := r.Path
+		if r.Type == "local" {
+			dir = cfg.LocalDir(config.Repository(r.RepositoryConfig))
+		}
+		src, err := repo.NewSource(r.Type, r.URL, r.Branch, dir, r.Token)
+		if err != nil {
+			return fmt.Errorf("invalid repository %s: %w", r.Name, err)
+		}
+		if gh, ok := src.(*repo.GitHubClient); ok {
+			gh.OnRateLimit = func(wait time.Duration) {
+				fmt.Fprintf(w, "⏳ rate limited, waiting %s... ", wait.Round(time.Second))
+			}
+		}
+		indexer := repo.NewSourceIndexer(src, r.Components)
+		indexer.Repo = r.Name
+		indexer.Known = known
+		u.indexers = append(u.indexers, indexer)
+
+		rev, err := indexer.Revision()
+		var limited *repo.RateLimitError
+		if errors.As(err, &limited) {
+			return fmt.Errorf("failed to update indexes: %w", err)
+		}
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "   Source: %s - %s (revision unknown: %v)\n", r.Name, src, err)
+		case rev != "":
+			fmt.Fprintf(w, "   Source: %s - %s @ %s\n", r.Name, src, shortRevision(rev))
+		default:
+			fmt.Fprintf(w, "   Source: %s - %s\n", r.Name, src)
+		}
+		if rev == "" {
+			u.revisions = nil
+		} else if u.revisions != nil {
+			u.revisions[r.Name] = rev
 		}
 	}
-
-	if devices != nil {
-		fmt.Print("   devices.yaml            ")
-		if err := repo.SaveIndex("configs/devices.yaml", devices); err != nil {
-			fmt.Printf("❌ Error: %v\n", err)
+	fmt.Fprintln(w)
+
+	updateComponent(u, "kernels", "kernels", "kernels.yaml", (*repo.Indexer).FetchKernelIndex, repo.MergeKernels)
+	updateComponent(u, "rootfs", "rootfs", "rootfs.yaml", (*repo.Indexer).FetchRootfsIndex, repo.MergeRootfs)
+	updateComponent(u, "devices", "devices", "devices.yaml", (*repo.Indexer).FetchDeviceIndex, repo.MergeDevices)
+	updateComponent(u, "patch", "patches", "patch.yaml", (*repo.Indexer).FetchPatchIndex, repo.MergePatches)
+	updateComponent(u, "loader", "loaders", "loader.yaml", (*repo.Indexer).FetchLoaderIndex, repo.MergeLoaders)
+	updateComponent(u, "firmware", "firmware files", "firmware.yaml", (*repo.Indexer).FetchFirmwareIndex, repo.MergeFirmware)
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "📝 Saving indexes...")
+
+	for _, file := range config.IndexFiles {
+		index, ok := u.results[file]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "   %-24s", file)
+		if err := repo.SaveIndex(cfg.IndexPath(file), index); err != nil {
+			fmt.Fprintf(w, "❌ Error: %v\n", err)
 		} else {
-			fmt.Println("✓ Saved")
+			fmt.Fprintln(w, "✓ Saved")
 		}
 	}
 
-	if patches != nil {
-		fmt.Print("   patch.yaml              ")
-		if err := repo.SaveIndex("configs/patch.yaml", patches); err != nil {
-			fmt.Printf("❌ Error: %v\n", err)
-		} else {
-			fmt.Println("✓ Saved")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "✨ Repository indexes updated successfully!")
+	return nil
+}
+
+// updateComponent fetches one index from every repository and merges
+// them into u.results. When the saved index was built from the current
+// revisions it is kept instead, with its check time renewed.
+func updateComponent[T any, P interface {
+	*T
+	repo.Index
+}](u *indexUpdate, label, noun, file string, fetch func(*repo.Indexer) (P, error), merge func([]P) P) {
+	fmt.Fprintf(u.w, "   Fetching %-15s", label+"...")
+
+	now := time.Now().Format(time.RFC3339)
+	if !u.force && u.revisions != nil {
+		saved := P(new(T))
+		err := repo.LoadIndex(u.cfg.IndexPath(file), saved)
+		if err == nil && maps.Equal(saved.Meta().Revisions, u.revisions) {
+			saved.Meta().Checked = now
+			fmt.Fprintf(u.w, "✓ Unchanged, %d %s\n", saved.Len(), noun)
+			u.results[file] = saved
+			return
 		}
 	}
 
-	fmt.Println()
-	fmt.Println("✨ Repository indexes updated successfully!")
+	all, err := fetchAll(u.indexers, fetch)
+	if err != nil {
+		fmt.Fprintf(u.w, "❌ Error: %v\n", err)
+		return
+	}
+	index := merge(all)
+	index.Meta().Revisions = u.revisions
+	fmt.Fprintf(u.w, "✓ Found %d %s\n", index.Len(), noun)
+	u.results[file] = index
+}
 
-	dm, err := download.NewManager()
-	if err == nil {
-		if err := dm.ValidateCache(); err != nil {
-			fmt.Printf("Warning: cache validation failed: %v\n", err)
+// fetchAll runs fetch against every repository, highest priority first.
+// A repository without the component is skipped; any other failure fails
+// the component, so a partial index never replaces a complete one.
+func fetchAll[P any](indexers []*repo.Indexer, fetch func(*repo.Indexer) (P, error)) ([]P, error) {
+	var all []P
+	var notFound error
+	for _, indexer := range indexers {
+		index, err := fetch(indexer)
+		if errors.Is(err, repo.ErrNotFound) {
+			notFound = err
+			continue
 		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", indexer.Repo, err)
+		}
+		all = append(all, index)
+	}
+	if len(all) == 0 {
+		return nil, notFound
+	}
+	return all, nil
+}
+
+func shortRevision(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
 	}
+	return rev
 }
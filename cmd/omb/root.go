@@ -1,6 +1,16 @@
 package omb
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 	cc "github.com/ivanpirog/coloredcobra"
 	"github.com/spf13/cobra"
 )
@@ -11,6 +21,69 @@ var rootCmd = &cobra.Command{
 	Long:  "Centralized firmware builder for ARM devices with automated data synchronization",
 }
 
+var offlineFlag bool
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(&offlineFlag, "offline", false, "Use only the download cache and local indexes, never the network")
+}
+
+// newManager returns a download manager for configs/config.yaml, offline
+// when the config or --offline asks for it.
+func newManager() (*download.Manager, error) {
+	dm, err := download.NewManager()
+	if err != nil {
+		return nil, err
+	}
+	if offlineFlag {
+		dm.Offline = true
+	}
+	return dm, nil
+}
+
+// checkIndexes updates the indexes when they are older than the
+// cache_ttl of the repositories and auto_update is set, and warns through
+// the manager's reporter otherwise. The update output goes to w.
+func checkIndexes(dm *download.Manager, w io.Writer) {
+	ttl := dm.Config.CacheTTL()
+	if ttl == 0 {
+		return
+	}
+	age, err := dm.Config.IndexAge()
+	if err != nil || age <= ttl {
+		return
+	}
+
+	warn := func(format string, args ...any) {
+		dm.Reporter.Report(report.Event{Kind: report.Warning, Message: fmt.Sprintf(format, args...)})
+	}
+	switch {
+	case dm.Offline:
+		warn("Indexes are %s old (cache_ttl %s); run 'omb repo update' when back online", formatAge(age), formatAge(ttl))
+	case dm.Config.AutoUpdate:
+		fmt.Fprintf(w, "⏰ Indexes are %s old (cache_ttl %s)\n", formatAge(age), formatAge(ttl))
+		if err := updateIndexes(w, dm.Config, false); err != nil {
+			warn("Failed to update indexes: %v", err)
+		}
+		fmt.Fprintln(w)
+	default:
+		warn("Indexes are %s old (cache_ttl %s); run 'omb repo update' or set auto_update: true in configs/config.yaml", formatAge(age), formatAge(ttl))
+	}
+}
+
+func formatAge(d time.Duration) string {
+	d = d.Round(time.Minute)
+	hours, minutes := int(d/time.Hour), int(d%time.Hour/time.Minute)
+	switch {
+	case hours >= 48:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours == 0:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes == 0:
+		return fmt.Sprintf("%dh", hours)
+	}
+	return fmt.Sprintf("%dh%dm", hours, minutes)
+}
+
 func Execute() error {
 	cc.Init(&cc.Config{
 		RootCmd:  rootCmd,
@@ -21,5 +94,9 @@ func Execute() error {
 		Flags:    cc.Bold,
 	})
 
-	return rootCmd.Execute()
+	// Ctrl-C cancels the running command, which then cleans up after itself.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return rootCmd.ExecuteContext(ctx)
 }
@@ -3,17 +3,10 @@ package builder
 import (
 	"fmt"
 	"os"
-
-	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
 )
 
 func (b *Builder) writeAmlogicBootloader() error {
-	dm, err := download.NewManager()
-	if err != nil {
-		return err
-	}
-
-	loaderDir := dm.GetLoaderPath("amlogic", b.Config.Device)
+	loaderDir := b.Manager.GetLoaderPath("amlogic", b.Config.Device)
 	loaderPath := fmt.Sprintf("%s/%s.bin", loaderDir, b.Config.Device)
 
 	if _, err := os.Stat(loaderPath); os.IsNotExist(err) {
@@ -35,7 +28,8 @@ func (b *Builder) writeAmlogicBootloader() error {
 		return fmt.Errorf("loader file too small: %d bytes", len(loader))
 	}
 
-	if _, err := img.WriteAt(loader[:444], 0); err != nil {
+	// Stop short of the disk signature at 440 so PARTUUIDs stay valid.
+	if _, err := img.WriteAt(loader[:mbrDiskSignatureOffset], 0); err != nil {
 		return fmt.Errorf("failed to write first block: %w", err)
 	}
 
@@ -43,17 +37,12 @@ func (b *Builder) writeAmlogicBootloader() error {
 		return fmt.Errorf("failed to write second block: %w", err)
 	}
 
-	fmt.Printf("   ✓ Wrote Amlogic bootloader: %s.bin\n", b.Config.Device)
+	b.step("Wrote Amlogic bootloader: %s.bin", b.Config.Device)
 	return nil
 }
 
 func (b *Builder) writeAllwinnerBootloader() error {
-	dm, err := download.NewManager()
-	if err != nil {
-		return err
-	}
-
-	loaderDir := dm.GetLoaderPath("allwinner", b.Config.Device)
+	loaderDir := b.Manager.GetLoaderPath("allwinner", b.Config.Device)
 	loaderPath := fmt.Sprintf("%s/u-boot-sunxi-with-spl-%s.bin", loaderDir, b.Config.Device)
 
 	if _, err := os.Stat(loaderPath); os.IsNotExist(err) {
@@ -75,26 +64,21 @@ func (b *Builder) writeAllwinnerBootloader() error {
 		return fmt.Errorf("failed to write bootloader: %w", err)
 	}
 
-	fmt.Printf("   ✓ Wrote Allwinner bootloader: u-boot-sunxi-with-spl-%s.bin\n", b.Config.Device)
+	b.step("Wrote Allwinner bootloader: u-boot-sunxi-with-spl-%s.bin", b.Config.Device)
 
 	mainlinePath := fmt.Sprintf("%s/u-boot-mainline-%s.bin", loaderDir, b.Config.Device)
 	if mainline, err := os.ReadFile(mainlinePath); err == nil {
 		if _, err := img.WriteAt(mainline, 40960); err != nil {
 			return fmt.Errorf("failed to write mainline u-boot: %w", err)
 		}
-		fmt.Printf("   ✓ Wrote mainline u-boot: u-boot-mainline-%s.bin\n", b.Config.Device)
+		b.step("Wrote mainline u-boot: u-boot-mainline-%s.bin", b.Config.Device)
 	}
 
 	return nil
 }
 
 func (b *Builder) writeRockchipBootloader() error {
-	dm, err := download.NewManager()
-	if err != nil {
-		return err
-	}
-
-	loaderDir := dm.GetLoaderPath("rockchip", b.Config.Device)
+	loaderDir := b.Manager.GetLoaderPath("rockchip", b.Config.Device)
 
 	img, err := os.OpenFile(b.Config.Output, os.O_RDWR, 0644)
 	if err != nil {
@@ -107,7 +91,7 @@ func (b *Builder) writeRockchipBootloader() error {
 		if _, err := img.WriteAt(idb, 64*512); err != nil {
 			return fmt.Errorf("failed to write idbloader: %w", err)
 		}
-		fmt.Printf("   ✓ Wrote idbloader: idbloader-%s.img\n", b.Config.Device)
+		b.step("Wrote idbloader: idbloader-%s.img", b.Config.Device)
 	} else {
 		return fmt.Errorf("idbloader not found: %s", idbPath)
 	}
@@ -117,7 +101,7 @@ func (b *Builder) writeRockchipBootloader() error {
 		if _, err := img.WriteAt(uboot, 16384*512); err != nil {
 			return fmt.Errorf("failed to write u-boot: %w", err)
 		}
-		fmt.Printf("   ✓ Wrote u-boot: u-boot-%s.itb\n", b.Config.Device)
+		b.step("Wrote u-boot: u-boot-%s.itb", b.Config.Device)
 	} else {
 		return fmt.Errorf("u-boot not found: %s", ubootPath)
 	}
@@ -127,7 +111,7 @@ func (b *Builder) writeRockchipBootloader() error {
 		if _, err := img.WriteAt(trust, 24576*512); err != nil {
 			return fmt.Errorf("failed to write trust: %w", err)
 		}
-		fmt.Printf("   ✓ Wrote trust: trust-%s.bin\n", b.Config.Device)
+		b.step("Wrote trust: trust-%s.bin", b.Config.Device)
 	}
 
 	return nil
@@ -1,128 +1,264 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
 	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
-	"github.com/diskfs/go-diskfs/partition/mbr"
 )
 
 type BuildConfig struct {
-	Device string
-	Kernel string
-	Rootfs string
-	Size   int
-	Output string
+	Device     string
+	Kernel     string
+	Rootfs     string
+	Size       int
+	Output     string
+	Patch      PatchOption
+	Table      string
+	Partitions []PartitionSpec
+
+	// WorkRoot is the directory the build workspace is created in. Empty
+	// means the system temp directory ($TMPDIR).
+	WorkRoot string `yaml:"-"`
+	// KeepWorkspace leaves the workspace in place when the build fails,
+	// for debugging.
+	KeepWorkspace bool `yaml:"-"`
+	// NoCache extracts the kernel and rootfs afresh instead of reusing
+	// trees from the staging directory of the config.
+	NoCache bool `yaml:"-"`
 }
 
 type Builder struct {
 	Config   BuildConfig
-	CacheDir string
+	Manager  *download.Manager
+	Reporter report.Reporter
 	TempDir  string
 	WorkDir  string
+
+	// Target names this build in reported events when several run at
+	// once; BuildMatrix sets it.
+	Target string
+	// Shared holds the staged kernel and rootfs trees this build reuses,
+	// nil to extract them into the workspace every time.
+	Shared *Staging
+
+	// PartUUIDs maps partition names to their PARTUUID once CreateImage
+	// has written the partition table.
+	PartUUIDs map[string]string
+
+	rootfsMeta    metaTable
+	outputCreated bool
+	failed        bool
+	stage         string
+	stageStart    time.Time
 }
 
-func NewBuilder(config BuildConfig, cacheDir string) (*Builder, error) {
-	tempDir := filepath.Join("tmp", "build")
-	workDir := filepath.Join(tempDir, "work")
+// NewBuilder prepares a build of config in a workspace of its own, so
+// several builds can run side by side. Downloads, cache paths and device
+// lookups go through dm, and progress goes to dm's reporter; a nil dm loads
+// configs/config.yaml from the working directory.
+func NewBuilder(config BuildConfig, dm *download.Manager) (*Builder, error) {
+	if dm == nil {
+		var err error
+		if dm, err = download.NewManager(); err != nil {
+			return nil, fmt.Errorf("failed to create download manager: %w", err)
+		}
+	}
 
-	if _, err := os.Stat(tempDir); err == nil {
-		fmt.Println("Cleaning up previous build directory...")
-		if err := os.RemoveAll(tempDir); err != nil {
-			return nil, fmt.Errorf("cleanup previous build: %w", err)
+	if config.WorkRoot != "" {
+		if err := os.MkdirAll(config.WorkRoot, 0755); err != nil {
+			return nil, fmt.Errorf("create work root: %w", err)
 		}
 	}
+	tempDir, err := os.MkdirTemp(config.WorkRoot, "omb-build-")
+	if err != nil {
+		return nil, fmt.Errorf("create build directory: %w", err)
+	}
+	workDir := filepath.Join(tempDir, "work")
 
 	if err := os.MkdirAll(workDir, 0755); err != nil {
+		os.RemoveAll(tempDir)
 		return nil, fmt.Errorf("create work directory: %w", err)
 	}
 
-	return &Builder{
+	b := &Builder{
 		Config:   config,
-		CacheDir: cacheDir,
+		Manager:  dm,
+		Reporter: dm.Reporter,
 		TempDir:  tempDir,
 		WorkDir:  workDir,
-	}, nil
+	}
+	if !config.NoCache {
+		b.Shared = NewStaging(dm.Config.StagingDir(), dm.Config.StagingLimit())
+	}
+	return b, nil
 }
 
-func (b *Builder) Build() error {
-	fmt.Println("🔨 Building firmware image...")
-	fmt.Printf("   Device: %s\n", b.Config.Device)
-	fmt.Printf("   Kernel: %s\n", b.Config.Kernel)
-	fmt.Printf("   Rootfs: %s\n", b.Config.Rootfs)
-	fmt.Printf("   Size: %d MB\n", b.Config.Size)
-	fmt.Printf("   Output: %s\n\n", b.Config.Output)
-
-	if err := b.Validate(); err != nil {
-		return fmt.Errorf("validation failed: %w", err)
+// Build runs every stage in order. It returns soon after ctx is cancelled,
+// wrapping ctx.Err(), and removes the partially written image on failure.
+func (b *Builder) Build(ctx context.Context) error {
+	if err := b.build(ctx); err != nil {
+		b.failed = true
+		if b.outputCreated {
+			os.Remove(b.Config.Output)
+		}
+		if ctx.Err() != nil {
+			err = fmt.Errorf("build cancelled: %w", ctx.Err())
+		}
+		b.report(report.Event{Kind: report.BuildFailed, File: b.Config.Output, Error: err.Error()})
+		return err
 	}
 
-	if err := b.CreateImage(); err != nil {
-		return fmt.Errorf("create image failed: %w", err)
-	}
+	b.report(report.Event{Kind: report.BuildFinished, Message: "Firmware image built successfully!", File: b.Config.Output})
+	return nil
+}
 
-	if err := b.InstallKernel(); err != nil {
-		return fmt.Errorf("install kernel failed: %w", err)
+func (b *Builder) build(ctx context.Context) error {
+	b.report(report.Event{Kind: report.BuildStarted, Message: "Building firmware image...", File: b.Config.Output})
+	b.info("Device: %s", b.Config.Device)
+	b.info("Kernel: %s", b.Config.Kernel)
+	b.info("Rootfs: %s", b.Config.Rootfs)
+	b.info("Size: %d MB", b.Config.Size)
+	if b.Config.Patch.Enabled() {
+		b.info("Patch: %s", b.Config.Patch)
 	}
-
-	if err := b.InstallRootfs(); err != nil {
-		return fmt.Errorf("install rootfs failed: %w", err)
+	b.info("Output: %s", b.Config.Output)
+	b.info("Workspace: %s", b.TempDir)
+
+	stages := []struct {
+		run  func(context.Context) error
+		fail string
+	}{
+		{b.Validate, "validation failed"},
+		{b.CreateImage, "create image failed"},
+		{b.InstallKernel, "install kernel failed"},
+		{b.InstallRootfs, "install rootfs failed"},
+		{b.WriteBootloader, "write bootloader failed"},
 	}
-
-	if err := b.WriteBootloader(); err != nil {
-		return fmt.Errorf("write bootloader failed: %w", err)
+	for _, stage := range stages {
+		if err := stage.run(ctx); err != nil {
+			return fmt.Errorf("%s: %w", stage.fail, err)
+		}
+		b.finishStage()
 	}
 
-	fmt.Println("\n✅ Firmware image built successfully!")
-	fmt.Printf("   Output: %s\n", b.Config.Output)
-
 	return nil
 }
 
-func (b *Builder) Validate() error {
-	fmt.Println("Checking resources...")
+// vendor looks up the SoC vendor of the device being built.
+func (b *Builder) vendor() (string, error) {
+	return b.Manager.Config.DeviceVendor(b.Config.Device)
+}
 
-	dm, err := download.NewManager()
-	if err != nil {
-		return fmt.Errorf("failed to create download manager: %w", err)
+func (b *Builder) Validate(ctx context.Context) error {
+	b.startStage(report.StageValidate, "Checking resources...")
+
+	if err := b.checkKernelVendor(); err != nil {
+		return err
 	}
 
-	kernelPath := dm.GetKernelPath(b.Config.Kernel)
-	if _, err := os.Stat(kernelPath); os.IsNotExist(err) {
-		fmt.Printf("   Kernel %s not found locally. Auto-downloading...\n", b.Config.Kernel)
-		if err := dm.DownloadKernel(b.Config.Kernel); err != nil {
+	dm := b.Manager
+	if dm.Offline {
+		if err := b.checkOffline(ctx); err != nil {
+			return err
+		}
+	}
+
+	vendor, err := b.vendor()
+	if err != nil {
+		return fmt.Errorf("failed to detect vendor: %w", err)
+	}
+	kernel := download.Artifact{Kind: download.KindKernel, Name: b.Config.Kernel, Vendor: vendor}
+	if dm.CacheState(kernel) != download.CacheCached {
+		b.info("Kernel %s not found locally. Auto-downloading...", b.Config.Kernel)
+		if err := dm.DownloadKernel(ctx, b.Config.Kernel, vendor); err != nil {
 			return fmt.Errorf("failed to auto-download kernel: %w", err)
 		}
 	} else {
-		fmt.Printf("   Kernel %s available\n", b.Config.Kernel)
+		b.info("Kernel %s available", b.Config.Kernel)
 	}
 
 	rootfsPath := dm.GetRootfsPath(b.Config.Rootfs)
 	if _, err := os.Stat(rootfsPath); os.IsNotExist(err) {
-		fmt.Printf("   Rootfs %s not found locally. Auto-downloading...\n", b.Config.Rootfs)
-		if err := dm.DownloadRootfs(b.Config.Rootfs); err != nil {
+		b.info("Rootfs %s not found locally. Auto-downloading...", b.Config.Rootfs)
+		if err := dm.DownloadRootfs(ctx, b.Config.Rootfs); err != nil {
 			return fmt.Errorf("failed to auto-download rootfs: %w", err)
 		}
 	} else {
-		fmt.Printf("   Rootfs %s available\n", b.Config.Rootfs)
+		b.info("Rootfs %s available", b.Config.Rootfs)
+	}
+
+	if err := b.preparePatch(ctx); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func (b *Builder) CreateImage() error {
-	fmt.Println("💾 Creating disk image...")
+// checkKernelVendor fails before anything is downloaded when the kernel
+// index shows that the kernel has no device trees for the device's vendor.
+func (b *Builder) checkKernelVendor() error {
+	kernel, err := b.Manager.Config.FindKernel(b.Config.Kernel)
+	if err != nil || kernel == nil || len(kernel.Vendors) == 0 {
+		return nil
+	}
+	vendor, err := b.vendor()
+	if err != nil {
+		return fmt.Errorf("failed to detect vendor: %w", err)
+	}
+
+	if !slices.Contains(kernel.Vendors, vendor) {
+		return fmt.Errorf("kernel %s has no device trees for %s devices (only %s)",
+			b.Config.Kernel, vendor, strings.Join(kernel.Vendors, ", "))
+	}
+	if dtbs := kernel.DTBs(vendor); len(dtbs) > 0 {
+		b.info("Kernel %s has %d %s device trees", b.Config.Kernel, len(dtbs), vendor)
+	}
+	return nil
+}
+
+// checkOffline lists every artifact the build needs that is not in the
+// cache, so an offline build fails before it starts rather than at the
+// first missing one.
+func (b *Builder) checkOffline(ctx context.Context) error {
+	vendor, err := b.vendor()
+	if err != nil {
+		return fmt.Errorf("failed to detect vendor: %w", err)
+	}
+
+	artifacts := []download.Artifact{
+		{Kind: download.KindKernel, Name: b.Config.Kernel, Vendor: vendor},
+		{Kind: download.KindRootfs, Name: b.Config.Rootfs},
+		{Kind: download.KindLoader, Name: vendor},
+		{Kind: download.KindFirmware},
+	}
+	if b.Config.Patch.Enabled() {
+		artifacts = append(artifacts, download.Artifact{Kind: download.KindPatch, Name: b.Config.Patch.String()})
+	}
+	return b.Manager.CheckCached(ctx, artifacts)
+}
+
+func (b *Builder) CreateImage(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.startStage(report.StageImage, "Creating disk image...")
+
+	plan, err := b.partitionPlan()
+	if err != nil {
+		return fmt.Errorf("invalid partition layout: %w", err)
+	}
 
 	imagePath := b.Config.Output
-	// Total image = 16MB (bootloader space) + 256MB (boot partition) + rootfs size
-	// This matches ulo script: fallocate -l $((16 + 256 + rootsize))M
-	imageSize := int64(16+256+b.Config.Size) * 1024 * 1024
 
 	if err := os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
@@ -130,62 +266,107 @@ func (b *Builder) CreateImage() error {
 
 	// Remove existing image if it exists, ignore error if it doesn't exist
 	os.Remove(imagePath)
+	b.outputCreated = true
 
-	mydisk, err := diskfs.Create(imagePath, imageSize, diskfs.SectorSizeDefault)
+	mydisk, err := diskfs.Create(imagePath, plan.ImageSize, diskfs.SectorSizeDefault)
 	if err != nil {
 		return fmt.Errorf("failed to create disk image: %w", err)
 	}
+	defer mydisk.Close()
 
-	table := &mbr.Table{
-		Partitions: []*mbr.Partition{
-			{
-				Bootable: true,
-				Type:     mbr.Fat32LBA,
-				Start:    2048,
-				Size:     uint32(256 * 1024 * 1024 / 512),
-			},
-			{
-				Bootable: false,
-				Type:     mbr.Linux,
-				Start:    2048 + uint32(256*1024*1024/512),
-				Size:     uint32((imageSize - 257*1024*1024) / 512),
-			},
-		},
-	}
-
-	if err := mydisk.Partition(table); err != nil {
+	if err := mydisk.Partition(plan.partitionTable()); err != nil {
 		return fmt.Errorf("failed to write partition table: %w", err)
 	}
 
-	fmt.Println("   Formatting boot partition (FAT32)...")
-	_, err = mydisk.CreateFilesystem(disk.FilesystemSpec{
-		Partition:   1,
-		FSType:      filesystem.TypeFat32,
-		VolumeLabel: "BOOT",
-	})
+	switch {
+	case plan.Table == TableMBR:
+		if err := writeMBRDiskSignature(imagePath); err != nil {
+			return err
+		}
+	case plan.EntriesLBA != gptHeaderLBA+1:
+		b.info("Moving GPT entries to sector %d (clear of the bootloader)", plan.EntriesLBA)
+		if err := relocateGPTEntries(imagePath, plan.EntriesLBA); err != nil {
+			return err
+		}
+	}
+
+	b.PartUUIDs, err = b.readPartUUIDs(plan)
 	if err != nil {
-		return fmt.Errorf("failed to create boot filesystem: %w", err)
+		return fmt.Errorf("failed to read partition UUIDs: %w", err)
+	}
+
+	for _, part := range plan.Partitions {
+		b.info("Partition %d: %-8s %-6s %6d MB at sector %d (PARTUUID=%s)",
+			part.Index, part.Name, part.FS, part.Size*sectorSize/mib, part.Start, b.PartUUIDs[part.Name])
+
+		switch part.FS {
+		case FSFat32:
+			b.info("Formatting %s partition (FAT32)...", part.Name)
+			_, err = mydisk.CreateFilesystem(disk.FilesystemSpec{
+				Partition:   part.Index,
+				FSType:      filesystem.TypeFat32,
+				VolumeLabel: part.Label,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create %s filesystem: %w", part.Name, err)
+			}
+		case FSSwap:
+			offset, size := int64(part.Start)*sectorSize, int64(part.Size)*sectorSize
+			if err := writeSwapHeader(imagePath, offset, size, part.Label); err != nil {
+				return fmt.Errorf("failed to format %s partition: %w", part.Name, err)
+			}
+		case FSExt4:
+			if part.Name == PartitionBoot || part.Name == PartitionRootfs {
+				continue
+			}
+			b.info("Formatting %s partition (ext4)...", part.Name)
+			if err := b.writeExt4Partition(ctx, part.Index, "", part.Label, nil); err != nil {
+				return fmt.Errorf("failed to format %s partition: %w", part.Name, err)
+			}
+		}
 	}
 
-	fmt.Println("   ✓ Disk image created with partitions")
-	fmt.Println("   Note: Rootfs partition will be formatted during installation")
+	b.step("Disk image created with partitions")
+	b.info("Note: ext4 boot and rootfs partitions will be formatted during installation")
 	return nil
 }
 
-func (b *Builder) WriteBootloader() error {
-	fmt.Println("🚀 Writing bootloader...")
+// partitionRegion reads the partition table written by CreateImage and
+// returns the byte offset and length of the given 1-based partition.
+func (b *Builder) partitionRegion(index int) (int64, int64, error) {
+	d, err := diskfs.Open(b.Config.Output, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open disk: %w", err)
+	}
+	defer d.Close()
 
-	vendor, err := config.GetDeviceVendor(b.Config.Device)
+	table, err := d.GetPartitionTable()
 	if err != nil {
-		return fmt.Errorf("failed to detect vendor: %w", err)
+		return 0, 0, fmt.Errorf("failed to read partition table: %w", err)
 	}
 
-	dm, err := download.NewManager()
+	partitions := table.GetPartitions()
+	if index < 1 || index > len(partitions) {
+		return 0, 0, fmt.Errorf("partition %d not found (table has %d)", index, len(partitions))
+	}
+
+	p := partitions[index-1]
+	if p.GetSize() <= 0 {
+		return 0, 0, fmt.Errorf("partition %d is empty", index)
+	}
+
+	return p.GetStart(), p.GetSize(), nil
+}
+
+func (b *Builder) WriteBootloader(ctx context.Context) error {
+	b.startStage(report.StageBootloader, "Writing bootloader...")
+
+	vendor, err := b.vendor()
 	if err != nil {
-		return fmt.Errorf("failed to create download manager: %w", err)
+		return fmt.Errorf("failed to detect vendor: %w", err)
 	}
 
-	if err := dm.DownloadLoader(vendor, b.Config.Device); err != nil {
+	if err := b.Manager.DownloadLoader(ctx, vendor, b.Config.Device); err != nil {
 		return fmt.Errorf("failed to download loader: %w", err)
 	}
 
@@ -201,6 +382,12 @@ func (b *Builder) WriteBootloader() error {
 	}
 }
 
+// Cleanup removes the build workspace, unless the build failed and
+// KeepWorkspace is set.
 func (b *Builder) Cleanup() error {
+	if b.failed && b.Config.KeepWorkspace {
+		b.info("Keeping build workspace for debugging: %s", b.TempDir)
+		return nil
+	}
 	return os.RemoveAll(b.TempDir)
 }
@@ -0,0 +1,35 @@
+package builder
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// ctxReader fails reads once ctx is done, so long copies stop promptly
+// when a build is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ctxFile is a file whose reads stop on cancellation. It keeps Seek, which
+// the ext4 writer uses to skip holes.
+type ctxFile struct {
+	ctx context.Context
+	*os.File
+}
+
+func (c ctxFile) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.File.Read(p)
+}
@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
+)
+
+func (b *Builder) report(e report.Event) {
+	if b.Reporter == nil {
+		return
+	}
+	if e.Stage == "" {
+		e.Stage = b.stage
+	}
+	e.Target = b.Target
+	b.Reporter.Report(e)
+}
+
+// startStage marks the beginning of a build stage; the stage of every
+// later event is set from it.
+func (b *Builder) startStage(stage, message string) {
+	b.stage = stage
+	b.stageStart = time.Now()
+	b.report(report.Event{Kind: report.StageStarted, Message: message})
+}
+
+func (b *Builder) finishStage() {
+	b.report(report.Event{Kind: report.StageFinished, DurationMS: time.Since(b.stageStart).Milliseconds()})
+}
+
+func (b *Builder) step(format string, args ...any) {
+	b.report(report.Event{Kind: report.Step, Message: fmt.Sprintf(format, args...)})
+}
+
+func (b *Builder) info(format string, args ...any) {
+	b.report(report.Event{Kind: report.Info, Message: fmt.Sprintf(format, args...)})
+}
+
+func (b *Builder) warn(format string, args ...any) {
+	b.report(report.Event{Kind: report.Warning, Message: fmt.Sprintf(format, args...)})
+}
@@ -1,17 +1,16 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
-	"path/filepath"
 
-	ext4 "github.com/masahiro331/go-ext4-filesystem/ext4"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/ext4"
 )
 
-func (b *Builder) extractExt4Image(imgPath, destDir string) error {
-	fmt.Println("   Extracting ext4 image contents...")
+func (b *Builder) extractExt4Image(ctx context.Context, imgPath, destDir string, meta metaTable) error {
+	b.info("Extracting ext4 image contents...")
 
 	f, err := os.Open(imgPath)
 	if err != nil {
@@ -19,63 +18,61 @@ func (b *Builder) extractExt4Image(imgPath, destDir string) error {
 	}
 	defer f.Close()
 
-	filesize, err := f.Seek(0, io.SeekEnd)
+	filesystem, err := ext4.Open(f)
 	if err != nil {
-		return fmt.Errorf("failed to get file size: %w", err)
+		return fmt.Errorf("failed to open ext4 filesystem: %w", err)
 	}
 
-	_, err = f.Seek(0, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("failed to seek start: %w", err)
-	}
-
-	filesystem, err := ext4.NewFS(*io.NewSectionReader(f, 0, filesize), nil)
-	if err != nil {
-		return fmt.Errorf("failed to create ext4 filesystem: %w", err)
-	}
-
-	err = fs.WalkDir(filesystem, "/", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
+	var symlinks, specials, hardlinks, withXattrs int
+	linked := map[uint32]string{}
+	err = filesystem.Walk(func(name string, inode *ext4.Inode) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-
-		destPath := filepath.Join(destDir, path)
-
-		if d.IsDir() {
-			return os.MkdirAll(destPath, 0755)
-		}
-
-		if d.Type()&os.ModeSymlink != 0 {
-			return nil
-		}
-
-		info, err := d.Info()
+		// A well-formed image has nothing below a symlink, but a
+		// corrupt one can repeat a name as both.
+		destPath, err := rootPath(destDir, name)
 		if err != nil {
 			return err
 		}
-
-		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-			return err
-		}
-
-		srcFile, err := filesystem.Open(path)
+		xattrs, err := filesystem.Xattrs(inode)
 		if err != nil {
-			return fmt.Errorf("failed to open %s: %w", path, err)
+			return fmt.Errorf("failed to read xattrs of %s: %w", name, err)
 		}
-		defer srcFile.Close()
-
-		dstFile, err := os.Create(destPath)
-		if err != nil {
-			return fmt.Errorf("failed to create %s: %w", destPath, err)
+		if len(xattrs) > 0 {
+			withXattrs++
 		}
-		defer dstFile.Close()
+		meta.recordInode(name, inode, xattrs)
 
-		if _, err := io.Copy(dstFile, srcFile); err != nil {
-			return fmt.Errorf("failed to copy %s: %w", path, err)
-		}
+		switch {
+		case inode.IsDir():
+			return os.MkdirAll(destPath, 0755)
+
+		case inode.IsSymlink():
+			target, err := filesystem.Readlink(inode)
+			if err != nil {
+				return fmt.Errorf("failed to read link %s: %w", name, err)
+			}
+			if err := os.Symlink(target, destPath); err != nil {
+				return fmt.Errorf("failed to create link %s: %w", destPath, err)
+			}
+			symlinks++
+			return nil
 
-		os.Chmod(destPath, info.Mode())
+		case inode.IsRegular():
+			if inode.Links > 1 {
+				if first, ok := linked[inode.Num]; ok {
+					hardlinks++
+					return os.Link(first, destPath)
+				}
+				linked[inode.Num] = destPath
+			}
+			return extractExt4File(ctx, filesystem, inode, name, destPath)
+		}
 
+		// Device nodes, FIFOs and sockets are only recorded in the
+		// metadata table and recreated when the rootfs is written.
+		specials++
 		return nil
 	})
 
@@ -83,6 +80,33 @@ func (b *Builder) extractExt4Image(imgPath, destDir string) error {
 		return fmt.Errorf("failed to walk ext4: %w", err)
 	}
 
-	fmt.Println("   ✓ Extracted ext4 image")
+	b.step("Extracted ext4 image (%d symlinks, %d hard links, %d special files, %d with xattrs)", symlinks, hardlinks, specials, withXattrs)
 	return nil
 }
+
+// extractExt4File copies the data ranges of a file and leaves its holes
+// as holes in the staged copy.
+func extractExt4File(ctx context.Context, filesystem *ext4.FS, inode *ext4.Inode, name, destPath string) error {
+	srcFile, err := filesystem.Open(inode)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+
+	dstFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", destPath, err)
+	}
+	defer dstFile.Close()
+
+	for _, r := range srcFile.Ranges() {
+		section := io.NewSectionReader(srcFile, r.Offset, r.Length)
+		if _, err := io.Copy(io.NewOffsetWriter(dstFile, r.Offset), ctxReader{ctx, section}); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+	}
+	if err := dstFile.Truncate(srcFile.Size()); err != nil {
+		return fmt.Errorf("failed to size %s: %w", destPath, err)
+	}
+
+	return os.Chmod(destPath, stagedPerm(inode.Perm()))
+}
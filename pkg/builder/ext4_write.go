@@ -1,92 +1,187 @@
 package builder
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 
-	ext4fs "github.com/pilat/go-ext4fs"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/ext4"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 )
 
-func (b *Builder) writeRootfsWithExt4fs(partition io.ReadWriteSeeker, size int64, rootfsDir string) error {
-	tmpImg := filepath.Join(b.TempDir, "rootfs_temp.img")
+// writeExt4Partition formats partition index of the output image as ext4
+// and fills it with the contents of srcDir, taking ownership and modes from
+// meta where recorded. An empty srcDir produces an empty filesystem.
+func (b *Builder) writeExt4Partition(ctx context.Context, index int, srcDir, label string, meta metaTable) error {
+	partitionOffset, partitionSize, err := b.partitionRegion(index)
+	if err != nil {
+		return fmt.Errorf("failed to locate partition %d: %w", index, err)
+	}
 
-	img, err := ext4fs.New(
-		ext4fs.WithImagePath(tmpImg),
-		ext4fs.WithSize(uint64(size)),
-	)
+	f, err := os.OpenFile(b.Config.Output, os.O_RDWR, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to create ext4 filesystem: %w", err)
+		return fmt.Errorf("failed to open image: %w", err)
 	}
-	defer img.Close()
-	defer os.Remove(tmpImg)
+	defer f.Close()
 
-	if err := b.copyDirToExt4fs(img, rootfsDir, ext4fs.RootInode); err != nil {
-		return fmt.Errorf("failed to copy files: %w", err)
+	partition := &partitionWindow{dst: f, offset: partitionOffset, size: partitionSize}
+	if err := b.writeRootfsWithExt4fs(ctx, partition, partitionSize, srcDir, label, meta); err != nil {
+		return err
 	}
 
-	if err := img.Save(); err != nil {
-		return fmt.Errorf("failed to save filesystem: %w", err)
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync image: %w", err)
 	}
-	img.Close()
+	return nil
+}
+
+// partitionWindow is the region of the output image that holds one
+// partition. Writes outside of it fail instead of clobbering a neighbour.
+type partitionWindow struct {
+	dst    io.WriterAt
+	offset int64
+	size   int64
+}
 
-	if err := SetExt4Label(tmpImg, "ROOTFS"); err != nil {
-		return fmt.Errorf("failed to set volume label: %w", err)
+func (p *partitionWindow) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.size {
+		return 0, fmt.Errorf("write at %d+%d outside %d byte partition", off, len(b), p.size)
 	}
+	return p.dst.WriteAt(b, p.offset+off)
+}
 
-	imgFile, err := os.Open(tmpImg)
+// writeRootfsWithExt4fs builds the filesystem straight into partition. File
+// data is streamed from the staging directory one file at a time.
+func (b *Builder) writeRootfsWithExt4fs(ctx context.Context, partition io.WriterAt, size int64, rootfsDir, label string, meta metaTable) error {
+	w, err := ext4.NewWriter(label)
 	if err != nil {
-		return fmt.Errorf("failed to open temp image: %w", err)
+		return fmt.Errorf("failed to create ext4 filesystem: %w", err)
 	}
-	defer imgFile.Close()
 
-	if _, err := io.Copy(partition, imgFile); err != nil {
-		return fmt.Errorf("failed to copy to partition: %w", err)
+	staged := 0
+	if rootfsDir != "" {
+		if staged, err = b.addStagedTree(ctx, w, rootfsDir, meta); err != nil {
+			return fmt.Errorf("failed to copy files: %w", err)
+		}
 	}
 
+	if err := w.Write(partition, size); err != nil {
+		var space *ext4.SpaceError
+		if errors.As(err, &space) {
+			return spaceError(space, size)
+		}
+		return fmt.Errorf("failed to write filesystem: %w", err)
+	}
+
+	if staged > 0 {
+		b.report(report.Event{Kind: report.FilesStaged, Message: fmt.Sprintf("Staged %d files into %s", staged, label), Count: staged})
+	}
 	return nil
 }
 
-func (b *Builder) copyDirToExt4fs(img *ext4fs.Image, srcDir string, parentInode uint32) error {
-	entries, err := os.ReadDir(srcDir)
-	if err != nil {
-		return err
+func spaceError(err *ext4.SpaceError, size int64) error {
+	if err.NeedBlocks > err.FreeBlocks {
+		return fmt.Errorf("staged rootfs needs %d MB but the %d MB rootfs partition holds %d MB; increase --size",
+			err.NeedBlocks*ext4.BlockSize>>20, size>>20, err.FreeBlocks*ext4.BlockSize>>20)
 	}
+	return fmt.Errorf("staged rootfs has %d entries but the rootfs partition only has %d inodes; increase --size",
+		err.NeedInodes, err.FreeInodes)
+}
 
-	for _, entry := range entries {
-		srcPath := filepath.Join(srcDir, entry.Name())
+// addStagedTree adds everything below srcDir to w, then the device nodes,
+// FIFOs and sockets that only exist in meta. Hard links in the staging
+// directory stay hard links and holes in sparse files stay holes. It
+// returns the number of entries added.
+func (b *Builder) addStagedTree(ctx context.Context, w *ext4.Writer, srcDir string, meta metaTable) (int, error) {
+	links := map[hostFileKey]string{}
+	count := 0
 
-		fileInfo, err := os.Lstat(srcPath)
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			continue
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
 		}
 
-		if fileInfo.IsDir() {
-			inode, err := img.CreateDirectory(parentInode, entry.Name(), 0755, 0, 0)
-			if err != nil {
-				fmt.Printf("   Warning: Could not create directory %s: %v\n", entry.Name(), err)
-				continue
-			}
-			if err := b.copyDirToExt4fs(img, srcPath, inode); err != nil {
-				return err
+		// The writer creates its own lost+found.
+		if rel == "lost+found" {
+			return filepath.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		md := meta.metadata(rel, info)
+
+		switch {
+		case info.IsDir():
+			err = w.Mkdir(rel, md)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, lerr := os.Readlink(path)
+			if lerr != nil {
+				return fmt.Errorf("read link %s: %w", path, lerr)
 			}
-		} else {
-			data, err := os.ReadFile(srcPath)
-			if err != nil {
-				continue
+			err = w.Symlink(rel, target, md)
+		case info.Mode().IsRegular():
+			if key, ok := hostLinkKey(info); ok {
+				if first, seen := links[key]; seen {
+					err = w.Link(rel, first)
+					break
+				}
+				links[key] = rel
 			}
 
-			mode := uint16(0644)
-			if fileInfo != nil {
-				mode = uint16(fileInfo.Mode() & 0777)
+			data, rerr := hostDataRanges(path, info)
+			if rerr != nil {
+				return fmt.Errorf("find holes in %s: %w", path, rerr)
 			}
+			err = w.CreateSparse(rel, md, info.Size(), data, func() (io.ReadCloser, error) {
+				f, err := os.Open(path)
+				if err != nil {
+					return nil, err
+				}
+				return ctxFile{ctx, f}, nil
+			})
+		default:
+			b.warn("skipping special file %s", rel)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("add %s: %w", rel, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
 
-			if _, err := img.CreateFile(parentInode, entry.Name(), data, mode, 0, 0); err != nil {
-				fmt.Printf("   Warning: Could not create file %s: %v\n", entry.Name(), err)
-			}
+	for _, rel := range meta.specials() {
+		hostPath := filepath.Join(srcDir, filepath.FromSlash(rel))
+		if _, err := os.Lstat(hostPath); err == nil {
+			continue
 		}
+		if info, err := os.Stat(filepath.Dir(hostPath)); err != nil || !info.IsDir() {
+			continue
+		}
+
+		m := meta[rel]
+		if err := w.Mknod(rel, m.Mode&ext4.ModeTypeMask, m.ext4Metadata(), m.Major, m.Minor); err != nil {
+			return 0, fmt.Errorf("add %s: %w", rel, err)
+		}
+		count++
 	}
 
-	return nil
+	return count, nil
 }
@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/ext4"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
+)
+
+// TestAddStagedTreeSpecialXattrs checks that device nodes, which only
+// exist in the metadata table, keep their security labels.
+func TestAddStagedTreeSpecialXattrs(t *testing.T) {
+	src := t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	label := []byte("system_u:object_r:console_device_t:s0\x00")
+	meta := metaTable{
+		"dev/console": {Mode: ext4.ModeChar | 0600, Major: 5, Minor: 1, Xattrs: map[string][]byte{"security.selinux": label}},
+	}
+
+	w, err := ext4.NewWriter("rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Builder{Reporter: report.Discard}
+	if _, err := b.addStagedTree(context.Background(), w, src, meta); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "rootfs.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := w.Write(f, 16<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := ext4.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	err = fs.Walk(func(name string, inode *ext4.Inode) error {
+		if name != "dev/console" {
+			return nil
+		}
+		found = true
+		if inode.Type() != ext4.ModeChar || inode.Major != 5 || inode.Minor != 1 {
+			t.Errorf("dev/console: mode %#o, device %d:%d; want a 5:1 character device", inode.Mode, inode.Major, inode.Minor)
+		}
+		xattrs, err := fs.Xattrs(inode)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(xattrs["security.selinux"], label) {
+			t.Errorf("dev/console: security.selinux %q, want %q", xattrs["security.selinux"], label)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("dev/console is missing")
+	}
+}
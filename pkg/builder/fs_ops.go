@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"context"
 	"io"
 	"os"
 	"path"
@@ -10,11 +11,14 @@ import (
 	"github.com/diskfs/go-diskfs/filesystem"
 )
 
-func copyDirToFS(fs filesystem.FileSystem, srcDir, destDir string) error {
+func copyDirToFS(ctx context.Context, fs filesystem.FileSystem, srcDir, destDir string) error {
 	return filepath.WalkDir(srcDir, func(localPath string, entry os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		rel, err := filepath.Rel(srcDir, localPath)
 		if err != nil {
 			return err
@@ -44,7 +48,7 @@ func copyDirToFS(fs filesystem.FileSystem, srcDir, destDir string) error {
 			return err
 		}
 
-		if _, err := io.Copy(dstFile, srcFile); err != nil {
+		if _, err := io.Copy(dstFile, ctxReader{ctx, srcFile}); err != nil {
 			_ = dstFile.Close()
 			return err
 		}
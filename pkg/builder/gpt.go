@@ -0,0 +1,193 @@
+package builder
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const (
+	gptHeaderLBA    = 1
+	gptEntryCount   = 128
+	gptEntrySectors = gptEntryCount * gpt.PartitionEntrySize / sectorSize
+
+	// Legacy BIOS bootable attribute, which U-Boot uses to pick the boot
+	// partition on GPT disks.
+	gptLegacyBootable = 1 << 2
+
+	mbrDiskSignatureOffset = 440
+)
+
+// bootloaderRegion is the byte range a vendor bootloader is written to,
+// counted from the start of the image. Partitions and partition tables must
+// stay out of it.
+type bootloaderRegion struct {
+	Start uint64
+	End   uint64
+}
+
+// vendorBootloaderRegion returns where WriteBootloader puts the loader for
+// a vendor:
+//
+//	amlogic:   sector 1 onwards (the first 440 bytes go into the MBR)
+//	allwinner: 8 KiB, with mainline u-boot at 40 KiB
+//	rockchip:  idbloader at sector 64, u-boot at 16384, trust at 24576
+func vendorBootloaderRegion(vendor string) bootloaderRegion {
+	switch vendor {
+	case "amlogic":
+		return bootloaderRegion{Start: 512, End: mib}
+	case "allwinner":
+		return bootloaderRegion{Start: 8 * 1024, End: mib}
+	case "rockchip":
+		return bootloaderRegion{Start: 64 * sectorSize, End: bootloaderReserveMB * mib}
+	default:
+		return bootloaderRegion{}
+	}
+}
+
+func (r bootloaderRegion) overlaps(start, end uint64) bool {
+	return r.End > r.Start && start < r.End && r.Start < end
+}
+
+// contains reports whether [offset, offset+length) lies inside the region.
+func (r bootloaderRegion) contains(offset, length uint64) bool {
+	return offset >= r.Start && offset+length <= r.End
+}
+
+// gptEntriesLBA picks the sector for the primary partition entry array.
+// The header at sector 1 cannot move, so a loader that starts there rules
+// GPT out. A loader that only collides with the entries (Allwinner's SPL at
+// 8 KiB) gets the entries moved behind it, like sgdisk --move-main-table.
+func gptEntriesLBA(loader bootloaderRegion) (uint64, error) {
+	if loader.overlaps(gptHeaderLBA*sectorSize, (gptHeaderLBA+1)*sectorSize) {
+		return 0, fmt.Errorf("the vendor bootloader overwrites the GPT header at sector %d; use table: mbr", gptHeaderLBA)
+	}
+
+	entries := uint64(gptHeaderLBA + 1)
+	if loader.overlaps(entries*sectorSize, (entries+gptEntrySectors)*sectorSize) {
+		entries = (loader.End + sectorSize - 1) / sectorSize
+	}
+	return entries, nil
+}
+
+// relocateGPTEntries moves the primary partition entry array written by
+// go-diskfs from sector 2 to lba and fixes both headers to match.
+func relocateGPTEntries(imagePath string, lba uint64) error {
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, sectorSize)
+	if _, err := f.ReadAt(header, gptHeaderLBA*sectorSize); err != nil {
+		return fmt.Errorf("failed to read GPT header: %w", err)
+	}
+
+	oldLBA := binary.LittleEndian.Uint64(header[72:80])
+	backupLBA := binary.LittleEndian.Uint64(header[32:40])
+	entries := make([]byte, gptEntrySectors*sectorSize)
+	if _, err := f.ReadAt(entries, int64(oldLBA)*sectorSize); err != nil {
+		return fmt.Errorf("failed to read GPT entries: %w", err)
+	}
+
+	if _, err := f.WriteAt(make([]byte, len(entries)), int64(oldLBA)*sectorSize); err != nil {
+		return fmt.Errorf("failed to clear old GPT entries: %w", err)
+	}
+	if _, err := f.WriteAt(entries, int64(lba)*sectorSize); err != nil {
+		return fmt.Errorf("failed to write GPT entries: %w", err)
+	}
+
+	firstUsable := lba + gptEntrySectors
+	binary.LittleEndian.PutUint64(header[72:80], lba)
+	if err := writeGPTHeader(f, header, gptHeaderLBA, firstUsable); err != nil {
+		return err
+	}
+
+	backup := make([]byte, sectorSize)
+	if _, err := f.ReadAt(backup, int64(backupLBA)*sectorSize); err != nil {
+		return fmt.Errorf("failed to read backup GPT header: %w", err)
+	}
+	return writeGPTHeader(f, backup, backupLBA, firstUsable)
+}
+
+func writeGPTHeader(f *os.File, header []byte, lba, firstUsable uint64) error {
+	binary.LittleEndian.PutUint64(header[40:48], firstUsable)
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+	size := binary.LittleEndian.Uint32(header[12:16])
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:size]))
+
+	if _, err := f.WriteAt(header, int64(lba)*sectorSize); err != nil {
+		return fmt.Errorf("failed to write GPT header at sector %d: %w", lba, err)
+	}
+	return nil
+}
+
+// writeMBRDiskSignature gives an MBR disk a random identifier, which the
+// kernel turns into PARTUUIDs of the form xxxxxxxx-01.
+func writeMBRDiskSignature(imagePath string) error {
+	signature := make([]byte, 4)
+	if _, err := rand.Read(signature); err != nil {
+		return fmt.Errorf("failed to generate disk signature: %w", err)
+	}
+
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(signature, mbrDiskSignatureOffset); err != nil {
+		return fmt.Errorf("failed to write disk signature: %w", err)
+	}
+	return nil
+}
+
+// readPartUUIDs returns the PARTUUID of every partition in the plan, in the
+// format the kernel accepts for root=PARTUUID=.
+func (b *Builder) readPartUUIDs(plan *partitionPlan) (map[string]string, error) {
+	uuids := make(map[string]string, len(plan.Partitions))
+
+	if plan.Table == TableMBR {
+		f, err := os.Open(b.Config.Output)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open image: %w", err)
+		}
+		defer f.Close()
+
+		signature := make([]byte, 4)
+		if _, err := f.ReadAt(signature, mbrDiskSignatureOffset); err != nil {
+			return nil, fmt.Errorf("failed to read disk signature: %w", err)
+		}
+		for _, part := range plan.Partitions {
+			uuids[part.Name] = fmt.Sprintf("%08x-%02x", binary.LittleEndian.Uint32(signature), part.Index)
+		}
+		return uuids, nil
+	}
+
+	d, err := diskfs.Open(b.Config.Output, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open disk: %w", err)
+	}
+	defer d.Close()
+
+	table, err := d.GetPartitionTable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %w", err)
+	}
+
+	partitions := table.GetPartitions()
+	for _, part := range plan.Partitions {
+		if part.Index > len(partitions) {
+			return nil, fmt.Errorf("partition %d missing from table", part.Index)
+		}
+		uuids[part.Name] = strings.ToLower(partitions[part.Index-1].UUID())
+	}
+	return uuids, nil
+}
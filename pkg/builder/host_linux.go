@@ -0,0 +1,60 @@
+package builder
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/ext4"
+	"golang.org/x/sys/unix"
+)
+
+// hostFileKey identifies an inode on the build host, to find hard links in
+// the staging directory.
+type hostFileKey struct {
+	dev uint64
+	ino uint64
+}
+
+// hostLinkKey returns the inode key of a file with more than one link.
+func hostLinkKey(info os.FileInfo) (hostFileKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return hostFileKey{}, false
+	}
+	return hostFileKey{dev: uint64(st.Dev), ino: st.Ino}, true
+}
+
+// hostDataRanges returns where a staged file holds data, or nil when it has
+// no holes.
+func hostDataRanges(path string, info os.FileInfo) ([]ext4.Range, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Blocks*512 >= info.Size() {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranges := []ext4.Range{}
+	for off := int64(0); off < info.Size(); {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		}
+		if err != nil {
+			// No SEEK_DATA support: treat the file as dense.
+			return nil, nil
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ext4.Range{Offset: data, Length: hole - data})
+		off = hole
+	}
+	return ranges, nil
+}
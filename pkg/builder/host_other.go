@@ -0,0 +1,15 @@
+//go:build !linux
+
+package builder
+
+import (
+	"os"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/ext4"
+)
+
+type hostFileKey struct{}
+
+func hostLinkKey(info os.FileInfo) (hostFileKey, bool) { return hostFileKey{}, false }
+
+func hostDataRanges(path string, info os.FileInfo) ([]ext4.Range, error) { return nil, nil }
@@ -2,26 +2,24 @@ package builder
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
-	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 	"github.com/diskfs/go-diskfs"
+	"github.com/ulikunitz/xz"
 )
 
-func (b *Builder) InstallKernel() error {
-	fmt.Println("🔧 Installing kernel...")
+func (b *Builder) InstallKernel(ctx context.Context) error {
+	b.startStage(report.StageKernel, "Installing kernel...")
 
-	dm, err := download.NewManager()
-	if err != nil {
-		return fmt.Errorf("failed to create download manager: %w", err)
-	}
-
-	kernelPath := dm.GetKernelPath(b.Config.Kernel)
+	kernelPath := b.Manager.GetKernelPath(b.Config.Kernel)
 	bootDir := filepath.Join(b.TempDir, "boot")
 	modulesDir := filepath.Join(b.TempDir, "modules")
 	rootDir := filepath.Join(b.TempDir, "device_root")
@@ -36,97 +34,163 @@ func (b *Builder) InstallKernel() error {
 		return err
 	}
 
-	vendor, err := config.GetDeviceVendor(b.Config.Device)
+	vendor, err := b.vendor()
+	if err != nil {
+		return err
+	}
+
+	// The boot files, DTBs and flattened modules only depend on the kernel
+	// bundle and the vendor, so they are extracted once and cached.
+	inputs := []string{
+		filepath.Join(kernelPath, fmt.Sprintf("boot-%s.tar.gz", b.Config.Kernel)),
+		filepath.Join(kernelPath, fmt.Sprintf("dtb-%s-%s.tar.gz", vendor, b.Config.Kernel)),
+		filepath.Join(kernelPath, fmt.Sprintf("modules-%s.tar.gz", b.Config.Kernel)),
+	}
+	err = b.stageCached(ctx, "kernel", []string{b.Config.Kernel, vendor}, inputs, b.TempDir, nil, func(dir string, _ metaTable) error {
+		return b.extractKernel(ctx, kernelPath, vendor, dir)
+	})
 	if err != nil {
 		return err
 	}
 
+	if err := b.extractDeviceFiles(ctx, bootDir); err != nil {
+		return fmt.Errorf("failed to extract device files: %w", err)
+	}
+
+	overwritten, count, err := b.applyPatch(ctx, true, bootDir)
+	if err != nil {
+		return fmt.Errorf("failed to apply patch to boot files: %w", err)
+	}
+	b.reportPatch("boot", overwritten, count)
+
+	plan, err := b.partitionPlan()
+	if err != nil {
+		return fmt.Errorf("invalid partition layout: %w", err)
+	}
+	part, ok := plan.find(PartitionBoot)
+	if !ok {
+		return fmt.Errorf("no %s partition in layout", PartitionBoot)
+	}
+
+	if part.FS == FSExt4 {
+		if err := b.writeExt4Partition(ctx, part.Index, bootDir, part.Label, nil); err != nil {
+			return fmt.Errorf("failed to write boot partition: %w", err)
+		}
+	} else {
+		disk, err := diskfs.Open(b.Config.Output)
+		if err != nil {
+			return fmt.Errorf("failed to open disk: %w", err)
+		}
+		defer disk.Close()
+
+		fs, err := disk.GetFilesystem(part.Index)
+		if err != nil {
+			return fmt.Errorf("failed to get boot filesystem: %w", err)
+		}
+
+		if err := copyDirToFS(ctx, fs, bootDir, "/"); err != nil {
+			return fmt.Errorf("failed to copy boot files: %w", err)
+		}
+	}
+	b.step("Copied boot files to partition")
+
+	return nil
+}
+
+// extractKernel unpacks the kernel bundle into boot/ and modules/ below
+// destDir.
+func (b *Builder) extractKernel(ctx context.Context, kernelPath, vendor, destDir string) error {
+	bootDir := filepath.Join(destDir, "boot")
+	modulesDir := filepath.Join(destDir, "modules")
+
 	bootTar := filepath.Join(kernelPath, fmt.Sprintf("boot-%s.tar.gz", b.Config.Kernel))
-	if err := extractTarGz(bootTar, bootDir); err != nil {
+	if err := extractTarGz(ctx, bootTar, bootDir, nil); err != nil {
 		return fmt.Errorf("failed to extract boot: %w", err)
 	}
-	fmt.Println("   ✓ Extracted boot files")
+	b.step("Extracted boot files")
 
 	dtbTar := filepath.Join(kernelPath, fmt.Sprintf("dtb-%s-%s.tar.gz", vendor, b.Config.Kernel))
-	dtbDir := filepath.Join(bootDir, "dtb", vendor)
+	dtbDir, err := rootTarget(bootDir, "dtb/"+vendor)
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(dtbDir, 0755); err != nil {
 		return err
 	}
-	if err := extractTarGz(dtbTar, dtbDir); err != nil {
+	if err := extractTarGz(ctx, dtbTar, dtbDir, nil); err != nil {
 		return fmt.Errorf("failed to extract dtb: %w", err)
 	}
-	fmt.Println("   ✓ Extracted DTB files")
+	b.step("Extracted DTB files")
 
 	modulesTar := filepath.Join(kernelPath, fmt.Sprintf("modules-%s.tar.gz", b.Config.Kernel))
-	if err := extractTarGz(modulesTar, modulesDir); err != nil {
+	if err := extractTarGz(ctx, modulesTar, modulesDir, nil); err != nil {
 		return fmt.Errorf("failed to extract modules: %w", err)
 	}
-	fmt.Println("   ✓ Extracted kernel modules")
+	b.step("Extracted kernel modules")
 
 	if err := b.copyModulesToRoot(modulesDir, b.Config.Kernel); err != nil {
 		return fmt.Errorf("failed to copy modules to root: %w", err)
 	}
-	fmt.Println("   ✓ Copied modules to root directory")
-	if err := b.extractDeviceFiles(bootDir); err != nil {
-		return fmt.Errorf("failed to extract device files: %w", err)
-	}
-
-	disk, err := diskfs.Open(b.Config.Output)
-	if err != nil {
-		return fmt.Errorf("failed to open disk: %w", err)
-	}
-
-	fs, err := disk.GetFilesystem(1)
-	if err != nil {
-		return fmt.Errorf("failed to get boot filesystem: %w", err)
-	}
-
-	if err := copyDirToFS(fs, bootDir, "/"); err != nil {
-		return fmt.Errorf("failed to copy boot files: %w", err)
-	}
-	fmt.Println("   ✓ Copied boot files to partition")
-
+	b.step("Copied modules to root directory")
 	return nil
 }
 
-func (b *Builder) extractDeviceFiles(bootDir string) error {
+func (b *Builder) extractDeviceFiles(ctx context.Context, bootDir string) error {
 	deviceBootTar := fmt.Sprintf("boot-%s.tar.gz", b.Config.Device)
+	dm := b.Manager
 
-	dm, err := download.NewManager()
-	if err != nil {
-		return fmt.Errorf("failed to create download manager: %w", err)
-	}
-
-	repo := dm.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
+	cacheDir := dm.Config.CacheDir()
 	deviceCacheDir := filepath.Join(cacheDir, "devices", b.Config.Device)
 	cachedFile := filepath.Join(deviceCacheDir, deviceBootTar)
 
 	if _, err := os.Stat(cachedFile); os.IsNotExist(err) {
-		fmt.Printf("   Downloading device boot files: devices/%s/%s\n", b.Config.Device, deviceBootTar)
+		b.info("Downloading device boot files: devices/%s/%s", b.Config.Device, deviceBootTar)
 
 		if err := os.MkdirAll(deviceCacheDir, 0755); err != nil {
 			return fmt.Errorf("failed to create cache dir: %w", err)
 		}
 
 		remotePath := fmt.Sprintf("devices/%s/%s", b.Config.Device, deviceBootTar)
-		if err := dm.DownloadFile(remotePath, cachedFile); err != nil {
-			fmt.Printf("   Warning: Could not download device boot files: %v\n", err)
+		if err := dm.DownloadFile(ctx, remotePath, cachedFile); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			b.warn("Could not download device boot files: %v", err)
 			return nil
 		}
 	} else {
-		fmt.Println("   Device boot files already cached")
+		b.info("Device boot files already cached")
 	}
 
-	if err := extractTarGz(cachedFile, bootDir); err != nil {
+	if err := extractTarGz(ctx, cachedFile, bootDir, nil); err != nil {
 		return fmt.Errorf("failed to extract device boot files: %w", err)
 	}
 
-	fmt.Println("   ✓ Extracted device boot files")
+	b.step("Extracted device boot files")
 	return nil
 }
 
-func extractTarGz(tarPath, destDir string) error {
+func extractArchive(ctx context.Context, archivePath, destDir string) error {
+	name := strings.ToLower(filepath.Base(archivePath))
+
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return extractTarGz(ctx, archivePath, destDir, nil)
+	case strings.HasSuffix(name, ".tar.xz"), strings.HasSuffix(name, ".txz"):
+		return extractTarXz(ctx, archivePath, destDir, nil)
+	case strings.HasSuffix(name, ".tar"):
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return extractTar(ctx, file, destDir, nil)
+	default:
+		return fmt.Errorf("unsupported archive format: %s", filepath.Base(archivePath))
+	}
+}
+
+func extractTarGz(ctx context.Context, tarPath, destDir string, meta metaTable) error {
 	file, err := os.Open(tarPath)
 	if err != nil {
 		return err
@@ -139,7 +203,29 @@ func extractTarGz(tarPath, destDir string) error {
 	}
 	defer gzr.Close()
 
-	tr := tar.NewReader(gzr)
+	return extractTar(ctx, gzr, destDir, meta)
+}
+
+func extractTarXz(ctx context.Context, tarPath, destDir string, meta metaTable) error {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	xzr, err := xz.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	return extractTar(ctx, xzr, destDir, meta)
+}
+
+// extractTar unpacks r into destDir. With a metaTable, ownership, modes,
+// mtimes and device nodes are recorded there instead of being applied to
+// the host.
+func extractTar(ctx context.Context, r io.Reader, destDir string, meta metaTable) error {
+	tr := tar.NewReader(ctxReader{ctx, r})
 
 	for {
 		header, err := tr.Next()
@@ -150,7 +236,26 @@ func extractTarGz(tarPath, destDir string) error {
 			return err
 		}
 
-		target := filepath.Join(destDir, header.Name)
+		if lexical := filepath.Join(destDir, header.Name); !strings.HasPrefix(lexical, filepath.Clean(destDir)+string(filepath.Separator)) && lexical != filepath.Clean(destDir) {
+			return fmt.Errorf("archive entry escapes destination: %s", header.Name)
+		}
+		// Entries below an extracted symlink resolve inside destDir, so
+		// an absolute link cannot redirect writes to the build host.
+		resolve := rootPath
+		if header.Typeflag == tar.TypeDir {
+			resolve = rootTarget
+		}
+		target, err := resolve(destDir, header.Name)
+		if err != nil {
+			return err
+		}
+		name, err := stagedName(destDir, target)
+		if err != nil {
+			return err
+		}
+		if name != "." {
+			meta.recordTar(name, header)
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -161,16 +266,56 @@ func extractTarGz(tarPath, destDir string) error {
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
+			// Replace rather than rewrite: the target may be hard-linked
+			// to a tree shared with other builds.
+			if err := removeFile(target); err != nil {
+				return err
+			}
 			outFile, err := os.Create(target)
 			if err != nil {
 				return err
 			}
-			if _, err := io.Copy(outFile, tr); err != nil {
+			if err := copySparse(outFile, tr); err != nil {
 				outFile.Close()
 				return err
 			}
 			outFile.Close()
-			if err := os.Chmod(target, os.FileMode(header.Mode)); err != nil {
+			mode := os.FileMode(header.Mode)
+			if meta != nil {
+				mode = stagedPerm(uint16(header.Mode))
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			if !strings.HasPrefix(filepath.Join(destDir, header.Linkname), filepath.Clean(destDir)+string(filepath.Separator)) {
+				return fmt.Errorf("archive link escapes destination: %s", header.Linkname)
+			}
+			source, err := rootPath(destDir, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			sourceName, err := stagedName(destDir, source)
+			if err != nil {
+				return err
+			}
+			if linkMeta, ok := meta[sourceName]; ok {
+				meta[name] = linkMeta
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
 				return err
 			}
 		}
@@ -178,3 +323,35 @@ func extractTarGz(tarPath, destDir string) error {
 
 	return nil
 }
+
+// copySparse copies src into dst but seeks over blocks of zeros instead of
+// writing them, so sparse archive entries stay sparse when staged.
+func copySparse(dst *os.File, src io.Reader) error {
+	const blockSize = 4096
+	buf := make([]byte, 64*blockSize)
+	zero := make([]byte, blockSize)
+
+	var size int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		for off := 0; off < n; off += blockSize {
+			block := buf[off:min(off+blockSize, n)]
+			if bytes.Equal(block, zero[:len(block)]) {
+				continue
+			}
+			if _, err := dst.WriteAt(block, size+int64(off)); err != nil {
+				return err
+			}
+		}
+		size += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return dst.Truncate(size)
+}
@@ -0,0 +1,115 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func tarArchive(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// TestExtractTarSymlinkedParents checks that entries below an extracted
+// symlink stay inside the destination, as they would resolve in the
+// image, instead of following the link on the build host.
+func TestExtractTarSymlinkedParents(t *testing.T) {
+	host := t.TempDir()
+	dest := t.TempDir()
+	archive := tarArchive(t, []tarEntry{
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: host},
+		{name: "lib/evil", typeflag: tar.TypeReg, body: "absolute"},
+		{name: "lib/sub/", typeflag: tar.TypeDir},
+		{name: "lib/sub/deeper", typeflag: tar.TypeReg, body: "dir"},
+		{name: "up", typeflag: tar.TypeSymlink, linkname: "../../../.."},
+		{name: "up/evil", typeflag: tar.TypeReg, body: "relative"},
+		{name: "stolen", typeflag: tar.TypeLink, linkname: "lib/evil"},
+	})
+
+	meta := metaTable{}
+	if err := extractTar(context.Background(), archive, dest, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := os.ReadDir(host); err != nil || len(entries) != 0 {
+		t.Fatalf("extraction wrote %d entries to the host directory the archive linked (%v)", len(entries), err)
+	}
+	inside := filepath.Join(dest, host)
+	for p, want := range map[string]string{
+		filepath.Join(inside, "evil"):          "absolute",
+		filepath.Join(inside, "sub", "deeper"): "dir",
+		filepath.Join(dest, "evil"):            "relative",
+		filepath.Join(dest, "stolen"):          "absolute",
+	} {
+		if got, err := os.ReadFile(p); err != nil || string(got) != want {
+			t.Errorf("%s: %q (%v), want %q", p, got, err, want)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "lib")); err != nil || target != host {
+		t.Errorf("lib links to %q (%v), want %q", target, err, host)
+	}
+	if _, ok := meta[strings.TrimPrefix(filepath.ToSlash(host), "/")+"/evil"]; !ok {
+		t.Error("metadata not recorded under the resolved name")
+	}
+}
+
+func TestExtractTarSymlinkLoop(t *testing.T) {
+	archive := tarArchive(t, []tarEntry{
+		{name: "a", typeflag: tar.TypeSymlink, linkname: "b"},
+		{name: "b", typeflag: tar.TypeSymlink, linkname: "a"},
+		{name: "a/file", typeflag: tar.TypeReg, body: "x"},
+	})
+	err := extractTar(context.Background(), archive, t.TempDir(), nil)
+	if err == nil || !strings.Contains(err.Error(), "too many levels of symbolic links") {
+		t.Errorf("got %v, want a symlink loop error", err)
+	}
+}
+
+// TestExtractTarHardLinkThroughSymlink checks that a hard link cannot
+// reach a host file through an extracted symlink.
+func TestExtractTarHardLinkThroughSymlink(t *testing.T) {
+	host := t.TempDir()
+	if err := os.WriteFile(filepath.Join(host, "secret"), []byte("host"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	archive := tarArchive(t, []tarEntry{
+		{name: "etc", typeflag: tar.TypeSymlink, linkname: host},
+		{name: "stolen", typeflag: tar.TypeLink, linkname: "etc/secret"},
+	})
+	if err := extractTar(context.Background(), archive, dest, nil); err == nil {
+		t.Error("hard link to a host file through a symlink was extracted")
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "stolen")); err == nil {
+		t.Error("stolen exists")
+	}
+}
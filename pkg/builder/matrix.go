@@ -0,0 +1,223 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
+)
+
+// Profile is a build profile file. Besides a single build it can describe
+// a matrix, either with a devices list or with a matrix block over device,
+// kernel and rootfs:
+//
+//	devices: [h616, h618]
+//	kernel: 6.1.123
+//	rootfs: openwrt-23.05.tar.gz
+//
+//	matrix:
+//	  device: [h616, h618]
+//	  kernel: [6.1.123, 6.6.60]
+//	rootfs: openwrt-23.05.tar.gz
+//
+// The output of a matrix build may use {device}, {kernel} and {rootfs}.
+type Profile struct {
+	BuildConfig `yaml:",inline"`
+
+	Devices []string   `yaml:"devices"`
+	Matrix  MatrixSpec `yaml:"matrix"`
+}
+
+type MatrixSpec struct {
+	Device []string `yaml:"device"`
+	Kernel []string `yaml:"kernel"`
+	Rootfs []string `yaml:"rootfs"`
+}
+
+// Targets expands the profile into one BuildConfig per build.
+func (p Profile) Targets() ([]BuildConfig, error) {
+	devices := p.Matrix.Device
+	if len(p.Devices) > 0 {
+		if len(devices) > 0 {
+			return nil, fmt.Errorf("use either devices or matrix.device, not both")
+		}
+		devices = p.Devices
+	}
+	devices, err := matrixAxis("device", p.Device, devices)
+	if err != nil {
+		return nil, err
+	}
+	kernels, err := matrixAxis("kernel", p.Kernel, p.Matrix.Kernel)
+	if err != nil {
+		return nil, err
+	}
+	rootfs, err := matrixAxis("rootfs", p.Rootfs, p.Matrix.Rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	output := p.Output
+	if output == "" {
+		output = "out/{device}"
+		if len(kernels) > 1 {
+			output += "-{kernel}"
+		}
+		if len(rootfs) > 1 {
+			output += "-{rootfs}"
+		}
+		output += ".img"
+	}
+
+	var targets []BuildConfig
+	outputs := map[string]string{}
+	for _, device := range devices {
+		for _, kernel := range kernels {
+			for _, rfs := range rootfs {
+				config := p.BuildConfig
+				config.Device, config.Kernel, config.Rootfs = device, kernel, rfs
+				config.Output = strings.NewReplacer(
+					"{device}", device,
+					"{kernel}", kernel,
+					"{rootfs}", rootfsStem(rfs),
+				).Replace(output)
+
+				name := TargetName(config, len(kernels) > 1, len(rootfs) > 1)
+				if other, ok := outputs[config.Output]; ok {
+					return nil, fmt.Errorf("targets %s and %s would both write %s; use {device}, {kernel} or {rootfs} in output",
+						other, name, config.Output)
+				}
+				outputs[config.Output] = name
+				targets = append(targets, config)
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+func matrixAxis(name, single string, list []string) ([]string, error) {
+	if single != "" && len(list) > 0 {
+		return nil, fmt.Errorf("%s is set both on its own and as a matrix list", name)
+	}
+	if len(list) > 0 {
+		return list, nil
+	}
+	if single == "" {
+		return nil, fmt.Errorf("%s is required", name)
+	}
+	return []string{single}, nil
+}
+
+// rootfsStem drops the archive and image extensions from a rootfs name.
+func rootfsStem(name string) string {
+	for _, ext := range []string{".tar.gz", ".tar.xz", ".img.gz", ".img.xz", ".tgz", ".txz", ".gz", ".xz", ".tar", ".img"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// TargetName is the device, plus the kernel and rootfs when those vary
+// between the targets of a matrix.
+func TargetName(config BuildConfig, kernel, rootfs bool) string {
+	parts := []string{config.Device}
+	if kernel {
+		parts = append(parts, config.Kernel)
+	}
+	if rootfs {
+		parts = append(parts, rootfsStem(config.Rootfs))
+	}
+	return strings.Join(parts, "/")
+}
+
+// Result is the outcome of one target of a matrix build.
+type Result struct {
+	Target   string
+	Config   BuildConfig
+	Duration time.Duration
+	Err      error
+}
+
+// BuildMatrix builds every target, at most jobs at a time, and returns one
+// result per target in the same order. Kernel and rootfs trees are
+// extracted once and shared between targets that use the same ones, through
+// the staging directory of the config unless the targets set NoCache.
+func BuildMatrix(ctx context.Context, targets []BuildConfig, dm *download.Manager, jobs int) ([]Result, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	if dm == nil {
+		var err error
+		if dm, err = download.NewManager(); err != nil {
+			return nil, fmt.Errorf("failed to create download manager: %w", err)
+		}
+	}
+
+	kernels, rootfs := map[string]bool{}, map[string]bool{}
+	for _, t := range targets {
+		kernels[t.Kernel] = true
+		rootfs[t.Rootfs] = true
+	}
+
+	shared := NewStaging(dm.Config.StagingDir(), dm.Config.StagingLimit())
+	if targets[0].NoCache {
+		root := targets[0].WorkRoot
+		if root != "" {
+			if err := os.MkdirAll(root, 0755); err != nil {
+				return nil, fmt.Errorf("create work root: %w", err)
+			}
+		}
+		sharedDir, err := os.MkdirTemp(root, "omb-shared-")
+		if err != nil {
+			return nil, fmt.Errorf("create shared staging directory: %w", err)
+		}
+		defer os.RemoveAll(sharedDir)
+		shared = NewStaging(sharedDir, 0)
+	}
+
+	results := make([]Result, len(targets))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, config := range targets {
+		results[i] = Result{Target: TargetName(config, len(kernels) > 1, len(rootfs) > 1), Config: config}
+
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			r.Err = buildTarget(ctx, r, dm, shared)
+			r.Duration = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+func buildTarget(ctx context.Context, r *Result, dm *download.Manager, shared *Staging) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("build cancelled: %w", err)
+	}
+
+	b, err := NewBuilder(r.Config, dm)
+	if err != nil {
+		return err
+	}
+	b.Target = r.Target
+	b.Shared = shared
+
+	err = b.Build(ctx)
+	b.Cleanup()
+	return err
+}
@@ -0,0 +1,170 @@
+package builder
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/ext4"
+)
+
+// fileMeta is what the staging directory cannot hold without root on the
+// build host: owner, exact mode, device numbers and extended attributes
+// such as file capabilities. Mode is an ext4 mode, file type bits included.
+type fileMeta struct {
+	Mode   uint16
+	UID    uint32
+	GID    uint32
+	Mtime  time.Time
+	Major  uint32
+	Minor  uint32
+	Xattrs map[string][]byte
+}
+
+// ext4Metadata is the part of m the ext4 writer sets on every inode.
+func (m fileMeta) ext4Metadata() ext4.Metadata {
+	return ext4.Metadata{
+		Mode:   m.Mode &^ ext4.ModeTypeMask,
+		UID:    m.UID,
+		GID:    m.GID,
+		Mtime:  m.Mtime,
+		Xattrs: m.Xattrs,
+	}
+}
+
+// paxXattrPrefix marks extended attributes in tar PAX headers.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// metaTable maps slash separated paths relative to the staging root to the
+// metadata of the source entry. Device nodes, FIFOs and sockets only exist
+// here; everything else also has a staged file.
+type metaTable map[string]fileMeta
+
+func (m metaTable) recordInode(name string, inode *ext4.Inode, xattrs map[string][]byte) {
+	if m == nil {
+		return
+	}
+	m[name] = fileMeta{
+		Mode:   inode.Mode,
+		UID:    inode.UID,
+		GID:    inode.GID,
+		Mtime:  inode.Mtime,
+		Major:  inode.Major,
+		Minor:  inode.Minor,
+		Xattrs: xattrs,
+	}
+}
+
+func (m metaTable) recordTar(name string, header *tar.Header) {
+	if m == nil {
+		return
+	}
+
+	var fileType uint16
+	switch header.Typeflag {
+	case tar.TypeDir:
+		fileType = ext4.ModeDir
+	case tar.TypeReg:
+		fileType = ext4.ModeRegular
+	case tar.TypeSymlink:
+		fileType = ext4.ModeSymlink
+	case tar.TypeChar:
+		fileType = ext4.ModeChar
+	case tar.TypeBlock:
+		fileType = ext4.ModeBlock
+	case tar.TypeFifo:
+		fileType = ext4.ModeFIFO
+	default:
+		return
+	}
+
+	var xattrs map[string][]byte
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			if xattrs == nil {
+				xattrs = map[string][]byte{}
+			}
+			xattrs[name] = []byte(value)
+		}
+	}
+
+	m[name] = fileMeta{
+		Mode:   fileType | uint16(header.Mode&07777),
+		UID:    uint32(header.Uid),
+		GID:    uint32(header.Gid),
+		Mtime:  header.ModTime,
+		Major:  uint32(header.Devmajor),
+		Minor:  uint32(header.Devminor),
+		Xattrs: xattrs,
+	}
+}
+
+// metadata returns the ext4 metadata for a staged entry. The recorded
+// source metadata wins unless a later build step replaced the entry with
+// one of a different type; entries added by the build are owned by root.
+func (m metaTable) metadata(name string, info os.FileInfo) ext4.Metadata {
+	if meta, ok := m[name]; ok && meta.Mode&ext4.ModeTypeMask == hostFileType(info.Mode()) {
+		return meta.ext4Metadata()
+	}
+	return ext4.Metadata{Mode: hostPerm(info.Mode()), Mtime: info.ModTime()}
+}
+
+// specials returns the device nodes, FIFOs and sockets in the table, sorted
+// so parents come before children.
+func (m metaTable) specials() []string {
+	var names []string
+	for name, meta := range m {
+		switch meta.Mode & ext4.ModeTypeMask {
+		case ext4.ModeChar, ext4.ModeBlock, ext4.ModeFIFO, ext4.ModeSocket:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forget drops the metadata of an entry that a build step replaced.
+func (m metaTable) forget(name string) {
+	delete(m, filepath.ToSlash(name))
+}
+
+func hostFileType(mode os.FileMode) uint16 {
+	switch {
+	case mode.IsDir():
+		return ext4.ModeDir
+	case mode&os.ModeSymlink != 0:
+		return ext4.ModeSymlink
+	case mode&os.ModeNamedPipe != 0:
+		return ext4.ModeFIFO
+	case mode&os.ModeSocket != 0:
+		return ext4.ModeSocket
+	case mode&os.ModeCharDevice != 0:
+		return ext4.ModeChar
+	case mode&os.ModeDevice != 0:
+		return ext4.ModeBlock
+	}
+	return ext4.ModeRegular
+}
+
+func hostPerm(mode os.FileMode) uint16 {
+	perm := uint16(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+// stagedPerm keeps staged files readable and writable by the build user
+// whatever the source mode is; the real mode lives in the metaTable.
+func stagedPerm(perm uint16) os.FileMode {
+	return os.FileMode(perm&0777) | 0600
+}
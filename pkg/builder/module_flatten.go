@@ -1,7 +1,6 @@
 package builder
 
 import (
-	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -9,7 +8,12 @@ import (
 )
 
 func (b *Builder) copyModulesToRoot(modulesDir, kernelVersion string) error {
-	moduleVersionDir := filepath.Join(modulesDir, kernelVersion)
+	// The modules archive may link its release directory elsewhere; keep
+	// it inside the extracted tree.
+	moduleVersionDir, err := rootTarget(modulesDir, kernelVersion)
+	if err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(moduleVersionDir); os.IsNotExist(err) {
 		return nil
@@ -19,7 +23,7 @@ func (b *Builder) copyModulesToRoot(modulesDir, kernelVersion string) error {
 	os.Remove(filepath.Join(moduleVersionDir, "source"))
 
 	koFiles := []string{}
-	err := filepath.Walk(moduleVersionDir, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(moduleVersionDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -32,7 +36,7 @@ func (b *Builder) copyModulesToRoot(modulesDir, kernelVersion string) error {
 		return err
 	}
 
-	fmt.Printf("   Found %d modules to copy...\n", len(koFiles))
+	b.info("Found %d modules to copy...", len(koFiles))
 
 	count := 0
 	for _, koFile := range koFiles {
@@ -43,13 +47,13 @@ func (b *Builder) copyModulesToRoot(modulesDir, kernelVersion string) error {
 		}
 
 		if err := copyFileContent(koFile, targetName); err != nil {
-			fmt.Printf("   Warning: Could not copy module %s: %v\n", filepath.Base(koFile), err)
+			b.warn("Could not copy module %s: %v", filepath.Base(koFile), err)
 		} else {
 			count++
 		}
 	}
 
-	fmt.Printf("   Copied %d modules to root directory\n", count)
+	b.info("Copied %d modules to root directory", count)
 	return nil
 }
 
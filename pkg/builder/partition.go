@@ -0,0 +1,392 @@
+package builder
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+const (
+	sectorSize = 512
+	mib        = 1024 * 1024
+
+	// Space kept in front of the partitions for vendor bootloaders. It is
+	// always added to the image size, matching the ulo scripts.
+	bootloaderReserveMB = 16
+
+	// Partition names with a fixed meaning for the build stages.
+	PartitionBoot   = "boot"
+	PartitionRootfs = "rootfs"
+
+	// Filesystem types a partition can be formatted with.
+	FSFat32 = "fat32"
+	FSExt4  = "ext4"
+	FSSwap  = "swap"
+	FSNone  = "none"
+
+	// SizeRest makes a partition take whatever space is left in the image.
+	SizeRest = "rest"
+
+	// Partition table formats.
+	TableMBR = "mbr"
+	TableGPT = "gpt"
+)
+
+// PartitionSpec describes one partition of the output image as written in a
+// build profile.
+type PartitionSpec struct {
+	Name     string `yaml:"name"`
+	FS       string `yaml:"fs"`
+	Size     string `yaml:"size"`
+	Label    string `yaml:"label"`
+	Bootable bool   `yaml:"bootable"`
+	Align    string `yaml:"align"`
+}
+
+// plannedPartition is a PartitionSpec resolved to absolute sectors.
+type plannedPartition struct {
+	PartitionSpec
+	Index int
+	Start uint64
+	Size  uint64
+}
+
+type partitionPlan struct {
+	Table      string
+	ImageSize  int64
+	Partitions []plannedPartition
+
+	// GPT only: first sector of the primary partition entry array. It is
+	// moved away from sector 2 when the vendor bootloader lives there.
+	EntriesLBA uint64
+}
+
+// defaultPartitions returns the layout used when a profile has no
+// partitions list: a 256 MB FAT32 boot partition followed by an ext4 rootfs
+// filling the rest. Rockchip keeps idbloader, u-boot and trust between
+// sectors 64 and 32767, so its boot partition starts after the reserve.
+func defaultPartitions(vendor string) []PartitionSpec {
+	bootAlign := "1M"
+	if vendor == "rockchip" {
+		bootAlign = fmt.Sprintf("%dM", bootloaderReserveMB)
+	}
+
+	return []PartitionSpec{
+		{Name: PartitionBoot, FS: FSFat32, Size: "256M", Label: "BOOT", Bootable: true, Align: bootAlign},
+		{Name: PartitionRootfs, FS: FSExt4, Size: SizeRest, Label: "ROOTFS", Align: "1M"},
+	}
+}
+
+func (b *Builder) partitionSpecs(vendor string) []PartitionSpec {
+	if len(b.Config.Partitions) > 0 {
+		return b.Config.Partitions
+	}
+	return defaultPartitions(vendor)
+}
+
+func (b *Builder) partitionTable() (string, error) {
+	switch table := strings.ToLower(strings.TrimSpace(b.Config.Table)); table {
+	case "", TableMBR:
+		return TableMBR, nil
+	case TableGPT:
+		return TableGPT, nil
+	default:
+		return "", fmt.Errorf("unsupported partition table %q (use mbr or gpt)", b.Config.Table)
+	}
+}
+
+// planPartitions validates the specs and lays them out one after another.
+// The image is the bootloader reserve plus every fixed-size partition plus
+// restMB for the partition sized "rest". No partition may start inside the
+// vendor bootloader region or the partition table itself.
+func planPartitions(specs []PartitionSpec, restMB int, table string, loader bootloaderRegion) (*partitionPlan, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no partitions defined")
+	}
+	if table == TableMBR && len(specs) > 4 {
+		return nil, fmt.Errorf("MBR supports at most 4 primary partitions, got %d", len(specs))
+	}
+	if table == TableGPT && len(specs) > gptEntryCount {
+		return nil, fmt.Errorf("GPT supports at most %d partitions, got %d", gptEntryCount, len(specs))
+	}
+
+	seen := map[string]bool{}
+	restIndex := -1
+	fixed := uint64(0)
+	sizes := make([]uint64, len(specs))
+
+	for i, spec := range specs {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("partition %d has no name", i+1)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("duplicate partition name %q", spec.Name)
+		}
+		seen[spec.Name] = true
+
+		switch spec.FS {
+		case FSFat32, FSExt4, FSSwap, FSNone:
+		default:
+			return nil, fmt.Errorf("partition %q: unsupported fs %q (use fat32, ext4, swap or none)", spec.Name, spec.FS)
+		}
+		if spec.Name == PartitionRootfs && spec.FS != FSExt4 {
+			return nil, fmt.Errorf("partition %q must be ext4", spec.Name)
+		}
+		if spec.Name == PartitionBoot && spec.FS != FSFat32 && spec.FS != FSExt4 {
+			return nil, fmt.Errorf("partition %q must be fat32 or ext4", spec.Name)
+		}
+
+		if strings.EqualFold(strings.TrimSpace(spec.Size), SizeRest) {
+			if restIndex >= 0 {
+				return nil, fmt.Errorf("only one partition can use size %q", SizeRest)
+			}
+			restIndex = i
+			continue
+		}
+
+		size, err := parseSize(spec.Size)
+		if err != nil {
+			return nil, fmt.Errorf("partition %q: %w", spec.Name, err)
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("partition %q: size must be greater than zero", spec.Name)
+		}
+		sizes[i] = size
+		fixed += size
+	}
+
+	if !seen[PartitionBoot] {
+		return nil, fmt.Errorf("missing %q partition", PartitionBoot)
+	}
+	if !seen[PartitionRootfs] {
+		return nil, fmt.Errorf("missing %q partition", PartitionRootfs)
+	}
+
+	imageSize := uint64(bootloaderReserveMB)*mib + fixed
+	if restIndex >= 0 {
+		if restMB <= 0 {
+			return nil, fmt.Errorf("partition %q uses size %q but image size is %d MB", specs[restIndex].Name, SizeRest, restMB)
+		}
+		imageSize += uint64(restMB) * mib
+	}
+
+	plan := &partitionPlan{Table: table, ImageSize: int64(imageSize)}
+	next := uint64(mib)
+	if loader.End > next {
+		next = loader.End
+	}
+
+	if table == TableGPT {
+		entries, err := gptEntriesLBA(loader)
+		if err != nil {
+			return nil, err
+		}
+		plan.EntriesLBA = entries
+		if first := (entries + gptEntrySectors) * sectorSize; first > next {
+			next = first
+		}
+		// The backup header and entry array live in the last sectors.
+		imageSize -= (gptEntrySectors + 1) * sectorSize
+	}
+
+	for i, spec := range specs {
+		align := uint64(mib)
+		if spec.Align != "" {
+			a, err := parseSize(spec.Align)
+			if err != nil {
+				return nil, fmt.Errorf("partition %q: align: %w", spec.Name, err)
+			}
+			if a == 0 || a%sectorSize != 0 {
+				return nil, fmt.Errorf("partition %q: align must be a multiple of %d bytes", spec.Name, sectorSize)
+			}
+			align = a
+		}
+
+		start := (next + align - 1) / align * align
+		size := sizes[i]
+		if i == restIndex {
+			var after uint64
+			for _, s := range sizes[i+1:] {
+				after += s
+			}
+			if start+after >= imageSize {
+				return nil, fmt.Errorf("partition %q has no space left", spec.Name)
+			}
+			size = imageSize - start - after
+			size -= size % mib
+		}
+		if start+size > imageSize {
+			return nil, fmt.Errorf("partition %q does not fit in the %d MB image", spec.Name, imageSize/mib)
+		}
+
+		plan.Partitions = append(plan.Partitions, plannedPartition{
+			PartitionSpec: spec,
+			Index:         i + 1,
+			Start:         start / sectorSize,
+			Size:          size / sectorSize,
+		})
+		next = start + size
+	}
+
+	return plan, nil
+}
+
+// partitionPlan resolves the profile (or vendor default) layout for this
+// build. It is deterministic, so every stage gets the same answer.
+func (b *Builder) partitionPlan() (*partitionPlan, error) {
+	vendor, err := b.vendor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect vendor: %w", err)
+	}
+
+	table, err := b.partitionTable()
+	if err != nil {
+		return nil, err
+	}
+
+	return planPartitions(b.partitionSpecs(vendor), b.Config.Size, table, vendorBootloaderRegion(vendor))
+}
+
+func (p *partitionPlan) find(name string) (*plannedPartition, bool) {
+	for i := range p.Partitions {
+		if p.Partitions[i].Name == name {
+			return &p.Partitions[i], true
+		}
+	}
+	return nil, false
+}
+
+func (p *partitionPlan) partitionTable() partition.Table {
+	if p.Table == TableGPT {
+		return p.gptTable()
+	}
+	return p.mbrTable()
+}
+
+func (p *partitionPlan) mbrTable() *mbr.Table {
+	table := &mbr.Table{}
+	for _, part := range p.Partitions {
+		table.Partitions = append(table.Partitions, &mbr.Partition{
+			Bootable: part.Bootable,
+			Type:     mbrType(part.FS),
+			Start:    uint32(part.Start),
+			Size:     uint32(part.Size),
+		})
+	}
+	return table
+}
+
+func (p *partitionPlan) gptTable() *gpt.Table {
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		ProtectiveMBR:      true,
+	}
+	for _, part := range p.Partitions {
+		var attributes uint64
+		if part.Bootable {
+			attributes |= gptLegacyBootable
+		}
+		table.Partitions = append(table.Partitions, &gpt.Partition{
+			Start:      part.Start,
+			End:        part.Start + part.Size - 1,
+			Type:       gptType(part.Name, part.FS),
+			Name:       part.Name,
+			Attributes: attributes,
+		})
+	}
+	return table
+}
+
+func gptType(name, fs string) gpt.Type {
+	switch {
+	case name == PartitionRootfs:
+		return gpt.LinuxRootArm64
+	case fs == FSFat32:
+		return gpt.MicrosoftBasicData
+	case fs == FSSwap:
+		return gpt.LinuxSwap
+	default:
+		return gpt.LinuxFilesystem
+	}
+}
+
+func mbrType(fs string) mbr.Type {
+	switch fs {
+	case FSFat32:
+		return mbr.Fat32LBA
+	case FSSwap:
+		return mbr.LinuxSwap
+	default:
+		return mbr.Linux
+	}
+}
+
+// parseSize accepts a plain number of megabytes or a number with a K, M or
+// G suffix (powers of 1024).
+func parseSize(value string) (uint64, error) {
+	value = strings.TrimSpace(strings.ToUpper(value))
+	value = strings.TrimSuffix(value, "IB")
+	value = strings.TrimSuffix(value, "B")
+	if value == "" {
+		return 0, fmt.Errorf("size is required")
+	}
+
+	unit := uint64(mib)
+	switch value[len(value)-1] {
+	case 'K':
+		unit = 1024
+		value = value[:len(value)-1]
+	case 'M':
+		value = value[:len(value)-1]
+	case 'G':
+		unit = 1024 * mib
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * unit, nil
+}
+
+// writeSwapHeader writes a version 1 Linux swap signature at the start of
+// the region, the same thing mkswap does.
+func writeSwapHeader(imagePath string, offset, size int64, label string) error {
+	const pageSize = 4096
+
+	if size < 2*pageSize {
+		return fmt.Errorf("swap partition too small")
+	}
+	if len(label) > 16 {
+		return fmt.Errorf("swap label too long: %d bytes (max 16)", len(label))
+	}
+
+	page := make([]byte, pageSize)
+	binary.LittleEndian.PutUint32(page[1024:], 1)
+	binary.LittleEndian.PutUint32(page[1028:], uint32(size/pageSize-1))
+	if _, err := rand.Read(page[1036:1052]); err != nil {
+		return fmt.Errorf("failed to generate swap uuid: %w", err)
+	}
+	copy(page[1052:1068], label)
+	copy(page[pageSize-10:], "SWAPSPACE2")
+
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(page, offset); err != nil {
+		return fmt.Errorf("failed to write swap header: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package builder
+
+import "testing"
+
+// TestDefaultPartitions pins the layout used when a profile has no
+// partitions list. Amlogic and Allwinner keep the layout of the original
+// single-layout builder; Rockchip starts BOOT at 16 MB because its u-boot
+// (sector 16384) and trust (sector 24576) would otherwise land inside it.
+func TestDefaultPartitions(t *testing.T) {
+	const sizeMB = 1024
+	imageSize := int64(16+256+sizeMB) * mib
+
+	tests := []struct {
+		vendor     string
+		bootStart  uint64
+		rootStart  uint64
+		rootSizeMB uint64
+	}{
+		{"amlogic", 2048, 2048 + 256*2048, sizeMB + 15},
+		{"allwinner", 2048, 2048 + 256*2048, sizeMB + 15},
+		{"rockchip", 16 * 2048, 16*2048 + 256*2048, sizeMB},
+	}
+	for _, tt := range tests {
+		for _, table := range []string{TableMBR, TableGPT} {
+			if tt.vendor == "amlogic" && table == TableGPT {
+				// The Amlogic loader overwrites the GPT header.
+				continue
+			}
+			loader := vendorBootloaderRegion(tt.vendor)
+			plan, err := planPartitions(defaultPartitions(tt.vendor), sizeMB, table, loader)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", tt.vendor, table, err)
+			}
+			if plan.ImageSize != imageSize {
+				t.Errorf("%s/%s: image size %d, want %d", tt.vendor, table, plan.ImageSize, imageSize)
+			}
+
+			for _, p := range plan.Partitions {
+				if loader.overlaps(p.Start*sectorSize, (p.Start+p.Size)*sectorSize) {
+					t.Errorf("%s/%s: partition %s overlaps the bootloader", tt.vendor, table, p.Name)
+				}
+			}
+			if table == TableGPT {
+				// GPT entries may move behind the loader; only MBR has
+				// a layout to keep.
+				continue
+			}
+
+			boot, ok := plan.find(PartitionBoot)
+			if !ok || boot.Start != tt.bootStart || boot.Size != 256*2048 || !boot.Bootable || boot.FS != FSFat32 {
+				t.Errorf("%s/%s: boot partition %+v, want FAT32 at sector %d of 256 MB", tt.vendor, table, boot, tt.bootStart)
+			}
+			rootfs, ok := plan.find(PartitionRootfs)
+			if !ok || rootfs.Start != tt.rootStart || rootfs.FS != FSExt4 {
+				t.Errorf("%s/%s: rootfs partition %+v, want ext4 at sector %d", tt.vendor, table, rootfs, tt.rootStart)
+			}
+			if rootfs.Size != tt.rootSizeMB*2048 {
+				t.Errorf("%s/%s: rootfs is %d MB, want %d", tt.vendor, table, rootfs.Size/2048, tt.rootSizeMB)
+			}
+		}
+	}
+}
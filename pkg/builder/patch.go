@@ -0,0 +1,148 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Patch archives are extracted into the build directory once and then laid
+// over the staged trees. Entries under a top-level boot/ directory go to the
+// boot partition, everything else goes to the rootfs.
+const patchBootDir = "boot"
+
+func (b *Builder) patchDir() string {
+	return filepath.Join(b.TempDir, "patch")
+}
+
+func (b *Builder) preparePatch(ctx context.Context) error {
+	if !b.Config.Patch.Enabled() {
+		return nil
+	}
+
+	name := b.Config.Patch.String()
+	if strings.EqualFold(name, "true") {
+		return fmt.Errorf("patch: true does not name an archive, use e.g. patch: startup.tar.xz")
+	}
+
+	dm := b.Manager
+	patchPath := dm.GetPatchPath(name)
+	if _, err := os.Stat(patchPath); os.IsNotExist(err) {
+		b.info("Patch %s not found locally. Auto-downloading...", name)
+		if err := dm.DownloadPatch(ctx, name); err != nil {
+			return fmt.Errorf("failed to auto-download patch: %w", err)
+		}
+	} else {
+		b.info("Patch %s available", name)
+	}
+
+	patchDir := b.patchDir()
+	if err := os.RemoveAll(patchDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(patchDir, 0755); err != nil {
+		return err
+	}
+
+	if err := extractArchive(ctx, patchPath, patchDir); err != nil {
+		return fmt.Errorf("failed to extract patch %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// applyPatch copies the boot or rootfs part of the extracted patch over
+// destDir and returns the destDir-relative paths of files it replaced.
+func (b *Builder) applyPatch(ctx context.Context, boot bool, destDir string) ([]string, int, error) {
+	if !b.Config.Patch.Enabled() {
+		return nil, 0, nil
+	}
+
+	src := b.patchDir()
+	if boot {
+		src = filepath.Join(src, patchBootDir)
+	}
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+
+	var overwritten []string
+	count := 0
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		if !boot && (rel == patchBootDir || strings.HasPrefix(rel, patchBootDir+string(filepath.Separator))) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			target, err := rootTarget(destDir, rel)
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+
+		target, err := rootPath(destDir, rel)
+		if err != nil {
+			return err
+		}
+		name, err := stagedName(destDir, target)
+		if err != nil {
+			return err
+		}
+		if existing, err := os.Lstat(target); err == nil {
+			if existing.IsDir() {
+				return fmt.Errorf("patch file %s would replace a directory", rel)
+			}
+			overwritten = append(overwritten, name)
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+			if !boot {
+				b.rootfsMeta.forget(name)
+			}
+		}
+
+		count++
+		return copyFile(path, target)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Strings(overwritten)
+	return overwritten, count, nil
+}
+
+func (b *Builder) reportPatch(target string, overwritten []string, count int) {
+	if count == 0 {
+		return
+	}
+
+	b.step("Applied patch %s to %s (%d files, %d overwritten)",
+		b.Config.Patch, target, count, len(overwritten))
+	for _, rel := range overwritten {
+		b.info("  overwrote /%s", rel)
+	}
+}
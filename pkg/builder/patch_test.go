@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
+)
+
+func writeTestFile(t *testing.T, p, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertEmptyDirExcept(t *testing.T, dir, keep string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == keep {
+			continue
+		}
+		t.Errorf("wrote %s on the build host", filepath.Join(dir, e.Name()))
+	}
+}
+
+// TestStagedWritesStayInRoot checks the patch overlay, the copies into the
+// rootfs and the tweaks against a rootfs whose absolute symlinks, like
+// Debian's var/run -> /run, point at a directory of the build host.
+func TestStagedWritesStayInRoot(t *testing.T) {
+	host := t.TempDir()
+	writeTestFile(t, filepath.Join(host, "inittab"), "ttyS0\n")
+	rootfs := t.TempDir()
+	for name, target := range map[string]string{"var/run": host, "lib": host, "etc/inittab": filepath.Join(host, "inittab")} {
+		if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(rootfs, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(rootfs, "etc", "hosts"), "old")
+
+	b := &Builder{Config: BuildConfig{Patch: "startup.tar.gz"}, TempDir: t.TempDir(), Reporter: report.Discard, rootfsMeta: metaTable{}}
+	writeTestFile(t, filepath.Join(b.patchDir(), "var", "run", "foo"), "patched")
+	writeTestFile(t, filepath.Join(b.patchDir(), "etc", "hosts"), "new")
+	overwritten, count, err := b.applyPatch(context.Background(), false, rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || !slices.Equal(overwritten, []string{"etc/hosts"}) {
+		t.Errorf("patched %d files, overwrote %v; want 2, [etc/hosts]", count, overwritten)
+	}
+
+	modules := t.TempDir()
+	writeTestFile(t, filepath.Join(modules, "6.1.9", "kernel", "fs.ko"), "module")
+	if err := copyDir(context.Background(), modules, rootfs, "lib/modules"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replaceInFileOS(rootfs, "etc/inittab", "ttyS0", "ttyS2"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEmptyDirExcept(t, host, "inittab")
+	if data, _ := os.ReadFile(filepath.Join(host, "inittab")); string(data) != "ttyS0\n" {
+		t.Errorf("tweak edited the host's inittab: %q", data)
+	}
+	inside := filepath.Join(rootfs, host)
+	for p, want := range map[string]string{
+		filepath.Join(inside, "foo"):                                 "patched",
+		filepath.Join(inside, "modules", "6.1.9", "kernel", "fs.ko"): "module",
+		filepath.Join(rootfs, "etc", "hosts"):                        "new",
+	} {
+		if got, err := os.ReadFile(p); err != nil || string(got) != want {
+			t.Errorf("%s: %q (%v), want %q", p, got, err, want)
+		}
+	}
+}
@@ -2,105 +2,107 @@ package builder
 
 import (
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
-	"github.com/bobbyunknown/Oh-my-builder/pkg/download"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 	"github.com/ulikunitz/xz"
 )
 
-func (b *Builder) InstallRootfs() error {
-	fmt.Println("📦 Installing rootfs...")
+func (b *Builder) InstallRootfs(ctx context.Context) error {
+	b.startStage(report.StageRootfs, "Installing rootfs...")
 
-	dm, err := download.NewManager()
-	if err != nil {
-		return fmt.Errorf("failed to create download manager: %w", err)
-	}
-
-	rootfsPath := dm.GetRootfsPath(b.Config.Rootfs)
+	rootfsPath := b.Manager.GetRootfsPath(b.Config.Rootfs)
 	rootfsDir := filepath.Join(b.TempDir, "rootfs")
 
 	if err := os.MkdirAll(rootfsDir, 0755); err != nil {
 		return err
 	}
+	b.rootfsMeta = metaTable{}
 
-	if err := b.extractRootfs(rootfsPath, rootfsDir); err != nil {
-		return fmt.Errorf("failed to extract rootfs: %w", err)
+	err := b.stageCached(ctx, "rootfs", []string{filepath.Base(rootfsPath)}, []string{rootfsPath}, rootfsDir, b.rootfsMeta, func(dir string, meta metaTable) error {
+		if err := b.extractRootfs(ctx, rootfsPath, dir, meta); err != nil {
+			return fmt.Errorf("failed to extract rootfs: %w", err)
+		}
+		b.step("Extracted rootfs")
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	fmt.Println("   ✓ Extracted rootfs")
 
 	modulesDir := filepath.Join(b.TempDir, "modules")
 	if _, err := os.Stat(modulesDir); err == nil {
-		destModules := filepath.Join(rootfsDir, "lib", "modules")
-		if err := copyDir(modulesDir, destModules); err != nil {
+		if err := copyDir(ctx, modulesDir, rootfsDir, "lib/modules"); err != nil {
 			return fmt.Errorf("failed to copy modules: %w", err)
 		}
-		fmt.Println("   ✓ Copied kernel modules")
+		b.step("Copied kernel modules")
 	}
 
 	deviceRootDir := filepath.Join(b.TempDir, "device_root")
 	if _, err := os.Stat(deviceRootDir); err == nil {
-		if err := copyDir(deviceRootDir, rootfsDir); err != nil {
+		if err := copyDir(ctx, deviceRootDir, rootfsDir, "."); err != nil {
 			return fmt.Errorf("failed to copy device files: %w", err)
 		}
-		fmt.Println("   ✓ Copied device files")
+		b.step("Copied device files")
 	}
 
-	if err := b.installFirmware(rootfsDir); err != nil {
+	if err := b.installFirmware(ctx, rootfsDir); err != nil {
 		return fmt.Errorf("failed to install firmware: %w", err)
 	}
-	fmt.Println("   ✓ Installed firmware files")
+	b.step("Installed firmware files")
 
 	if err := b.applyTweaks(rootfsDir); err != nil {
 		return fmt.Errorf("failed to apply tweaks: %w", err)
 	}
-	fmt.Println("   ✓ Applied rootfs tweaks")
-
-	fmt.Println("   Writing rootfs to partition...")
+	b.step("Applied rootfs tweaks")
 
-	// Open the image file
-	f, err := os.OpenFile(b.Config.Output, os.O_RDWR, 0644)
+	overwritten, count, err := b.applyPatch(ctx, false, rootfsDir)
 	if err != nil {
-		return fmt.Errorf("failed to open image: %w", err)
+		return fmt.Errorf("failed to apply patch: %w", err)
 	}
-	defer f.Close()
+	b.reportPatch("rootfs", overwritten, count)
 
-	partitionOffset := int64(526336 * 512)
-	partitionSize := int64(2127872 * 512)
+	b.info("Writing rootfs to partition...")
 
-	if _, err := f.Seek(partitionOffset, 0); err != nil {
-		return fmt.Errorf("failed to seek to partition: %w", err)
+	plan, err := b.partitionPlan()
+	if err != nil {
+		return fmt.Errorf("invalid partition layout: %w", err)
+	}
+	part, ok := plan.find(PartitionRootfs)
+	if !ok {
+		return fmt.Errorf("no %s partition in layout", PartitionRootfs)
 	}
 
-	if err := b.writeRootfsWithExt4fs(f, partitionSize, rootfsDir); err != nil {
+	if err := b.writeExt4Partition(ctx, part.Index, rootfsDir, part.Label, b.rootfsMeta); err != nil {
 		return fmt.Errorf("failed to write rootfs: %w", err)
 	}
 
-	fmt.Println("   ✓ Wrote rootfs to partition")
+	b.step("Wrote rootfs to partition")
 	return nil
 }
 
-func (b *Builder) extractRootfs(rootfsPath, destDir string) error {
+func (b *Builder) extractRootfs(ctx context.Context, rootfsPath, destDir string, meta metaTable) error {
 	ext := strings.ToLower(filepath.Ext(rootfsPath))
 
 	switch ext {
 	case ".xz":
-		return b.extractXZ(rootfsPath, destDir)
+		return b.extractXZ(ctx, rootfsPath, destDir, meta)
 	case ".gz":
 		if strings.HasSuffix(rootfsPath, ".tar.gz") {
-			return extractTarGz(rootfsPath, destDir)
+			return extractTarGz(ctx, rootfsPath, destDir, meta)
 		}
-		return b.extractGZ(rootfsPath, destDir)
+		return b.extractGZ(ctx, rootfsPath, destDir, meta)
 	default:
 		return fmt.Errorf("unsupported rootfs format: %s", ext)
 	}
 }
 
-func (b *Builder) extractXZ(xzPath, destDir string) error {
+func (b *Builder) extractXZ(ctx context.Context, xzPath, destDir string, meta metaTable) error {
 	file, err := os.Open(xzPath)
 	if err != nil {
 		return err
@@ -119,16 +121,16 @@ func (b *Builder) extractXZ(xzPath, destDir string) error {
 	}
 	defer out.Close()
 
-	if _, err := io.Copy(out, xzr); err != nil {
+	if _, err := io.Copy(out, ctxReader{ctx, xzr}); err != nil {
 		return err
 	}
 	out.Close()
 
-	fmt.Println("   Decompressed .xz to .img")
-	return b.extractExt4Image(imgPath, destDir)
+	b.info("Decompressed .xz to .img")
+	return b.extractExt4Image(ctx, imgPath, destDir, meta)
 }
 
-func (b *Builder) extractGZ(gzPath, destDir string) error {
+func (b *Builder) extractGZ(ctx context.Context, gzPath, destDir string, meta metaTable) error {
 	file, err := os.Open(gzPath)
 	if err != nil {
 		return err
@@ -148,17 +150,17 @@ func (b *Builder) extractGZ(gzPath, destDir string) error {
 	}
 	defer out.Close()
 
-	if _, err := io.Copy(out, gzr); err != nil {
+	if _, err := io.Copy(out, ctxReader{ctx, gzr}); err != nil {
 		return err
 	}
 	out.Close()
 
-	fmt.Println("   Decompressed .gz to .img")
-	return b.extractExt4Image(imgPath, destDir)
+	b.info("Decompressed .gz to .img")
+	return b.extractExt4Image(ctx, imgPath, destDir, meta)
 }
 
 func (b *Builder) applyTweaks(rootfsDir string) error {
-	vendor, err := config.GetDeviceVendor(b.Config.Device)
+	vendor, err := b.vendor()
 	if err != nil {
 		return err
 	}
@@ -174,24 +176,25 @@ func (b *Builder) applyTweaks(rootfsDir string) error {
 }
 
 func (b *Builder) applyAmlogicTweaks(rootfsDir string) error {
-	pwmFile := filepath.Join(rootfsDir, "etc", "modules.d", "pwm-meson")
+	pwmFile, err := rootTarget(rootfsDir, "etc/modules.d/pwm-meson")
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(filepath.Dir(pwmFile), 0755); err != nil {
 		return err
 	}
-	if err := os.WriteFile(pwmFile, []byte("pwm_meson\n"), 0644); err != nil {
+	if err := replaceFile(pwmFile, []byte("pwm_meson\n"), 0644); err != nil {
 		return err
 	}
 
-	inittab := filepath.Join(rootfsDir, "etc", "inittab")
-	if err := replaceInFileOS(inittab, "ttyAMA0", "ttyAML0"); err != nil {
+	if err := replaceInFileOS(rootfsDir, "etc/inittab", "ttyAMA0", "ttyAML0"); err != nil {
 		return err
 	}
-	if err := replaceInFileOS(inittab, "ttyS0", "tty0"); err != nil {
+	if err := replaceInFileOS(rootfsDir, "etc/inittab", "ttyS0", "tty0"); err != nil {
 		return err
 	}
 
-	bootScript := filepath.Join(rootfsDir, "etc", "init.d", "boot")
-	if err := prependLineBeforeOS(bootScript, "kmodloader", "\tmkdir -p /tmp/upgrade"); err != nil {
+	if err := prependLineBeforeOS(rootfsDir, "etc/init.d/boot", "kmodloader", "\tmkdir -p /tmp/upgrade"); err != nil {
 		return err
 	}
 
@@ -199,11 +202,10 @@ func (b *Builder) applyAmlogicTweaks(rootfsDir string) error {
 }
 
 func (b *Builder) applyAllwinnerRockchipTweaks(rootfsDir string) error {
-	inittab := filepath.Join(rootfsDir, "etc", "inittab")
-	if err := replaceInFileOS(inittab, "ttyAMA0", "tty1"); err != nil {
+	if err := replaceInFileOS(rootfsDir, "etc/inittab", "ttyAMA0", "tty1"); err != nil {
 		return err
 	}
-	if err := replaceInFileOS(inittab, "ttyS0", "ttyS2"); err != nil {
+	if err := replaceInFileOS(rootfsDir, "etc/inittab", "ttyS0", "ttyS2"); err != nil {
 		return err
 	}
 
@@ -211,20 +213,24 @@ func (b *Builder) applyAllwinnerRockchipTweaks(rootfsDir string) error {
 }
 
 func (b *Builder) applyCommonTweaks(rootfsDir string) error {
-	bootScript := filepath.Join(rootfsDir, "etc", "init.d", "boot")
-	if err := prependLineBeforeOS(bootScript, "kmodloader", "\tulimit -n 131072"); err != nil {
+	if err := prependLineBeforeOS(rootfsDir, "etc/init.d/boot", "kmodloader", "\tulimit -n 131072"); err != nil {
 		return err
 	}
 
-	mac80211 := filepath.Join(rootfsDir, "lib", "netifd", "wireless", "mac80211.sh")
-	if err := replaceInFileOS(mac80211, "iw ", "ipconfig "); err != nil {
+	if err := replaceInFileOS(rootfsDir, "lib/netifd/wireless/mac80211.sh", "iw ", "ipconfig "); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func replaceInFileOS(filePath, old, new string) error {
+// replaceInFileOS edits the file name of the staged tree root, following
+// symlinks inside the tree.
+func replaceInFileOS(root, name, old, new string) error {
+	filePath, err := rootTarget(root, name)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil
 	}
@@ -239,10 +245,14 @@ func replaceInFileOS(filePath, old, new string) error {
 		return nil
 	}
 
-	return os.WriteFile(filePath, []byte(updated), 0644)
+	return replaceFile(filePath, []byte(updated), 0644)
 }
 
-func prependLineBeforeOS(filePath, marker, line string) error {
+func prependLineBeforeOS(root, name, marker, line string) error {
+	filePath, err := rootTarget(root, name)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil
 	}
@@ -263,35 +273,88 @@ func prependLineBeforeOS(filePath, marker, line string) error {
 	}
 
 	updated := text[:idx] + line + "\n" + text[idx:]
-	return os.WriteFile(filePath, []byte(updated), 0644)
+	return replaceFile(filePath, []byte(updated), 0644)
+}
+
+// replaceFile writes data to a new file in place of filePath, keeping the
+// permissions of the file it replaces. Staged files can be hard links into
+// a tree other builds are using, so they are never rewritten in place.
+func replaceFile(filePath string, data []byte, perm os.FileMode) error {
+	if info, err := os.Lstat(filePath); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := removeFile(filePath); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filePath, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(filePath, perm)
 }
 
-func copyDir(src, dst string) error {
+// removeFile removes filePath unless it is missing or a directory.
+func removeFile(filePath string) error {
+	info, err := os.Lstat(filePath)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	return os.Remove(filePath)
+}
+
+// copyDir copies src to dir of the staged tree root, resolving every path
+// inside root.
+func copyDir(ctx context.Context, src, root, dir string) error {
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		rel, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
 		}
 
-		target := filepath.Join(dst, rel)
-
+		name := filepath.Join(dir, rel)
 		if info.IsDir() {
+			target, err := rootTarget(root, name)
+			if err != nil {
+				return err
+			}
 			return os.MkdirAll(target, info.Mode())
 		}
 
+		target, err := rootPath(root, name)
+		if err != nil {
+			return err
+		}
 		return copyFile(path, target)
 	})
 }
 
+// copyFile copies a regular file, or recreates a symlink with the same
+// target. Links are never followed: absolute targets point into the image,
+// not the build host. A dst in a staged tree must come from rootPath.
 func copyFile(src, dst string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 		return err
 	}
 
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if srcInfo.Mode()&os.ModeSymlink != 0 {
+		return copySymlink(src, dst)
+	}
+	// Replace rather than rewrite, so a staged hard link or symlink does not
+	// carry the change to another name.
+	if err := removeFile(dst); err != nil {
+		return err
+	}
+
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
@@ -308,26 +371,31 @@ func copyFile(src, dst string) error {
 		return err
 	}
 
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-
 	return os.Chmod(dst, srcInfo.Mode())
 }
 
-func (b *Builder) installFirmware(rootfsDir string) error {
-	dm, err := download.NewManager()
+func copySymlink(src, dst string) error {
+	target, err := os.Readlink(src)
 	if err != nil {
 		return err
 	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
 
-	if err := dm.DownloadFirmware(); err != nil {
+func (b *Builder) installFirmware(ctx context.Context, rootfsDir string) error {
+	dm := b.Manager
+	if err := dm.DownloadFirmware(ctx); err != nil {
 		return err
 	}
 
 	firmwareSrc := dm.GetFirmwarePath()
-	firmwareDst := filepath.Join(rootfsDir, "lib", "firmware")
+	firmwareDst, err := rootPath(rootfsDir, "lib/firmware")
+	if err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(firmwareSrc); os.IsNotExist(err) {
 		return nil
@@ -337,5 +405,5 @@ func (b *Builder) installFirmware(rootfsDir string) error {
 		return err
 	}
 
-	return copyDir(firmwareSrc, firmwareDst)
+	return cloneTree(ctx, firmwareSrc, firmwareDst)
 }
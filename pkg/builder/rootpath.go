@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks bounds the links followed while resolving one path, as on
+// Linux.
+const maxSymlinks = 40
+
+// rootPath returns where the entry name of the staged tree root lives on
+// the host. Symlinks among its parent directories are followed the way
+// they resolve once root is the image's /: absolute targets start at root
+// and ".." stops there. So a staged var/run -> /run takes var/run/foo to
+// root/run/foo instead of the build host's /run/foo. The entry itself is
+// not followed, so it can be replaced.
+func rootPath(root, name string) (string, error) {
+	return resolveInRoot(root, name, false)
+}
+
+// rootTarget is rootPath that also follows the entry itself, for
+// directories to write into and files to edit.
+func rootTarget(root, name string) (string, error) {
+	return resolveInRoot(root, name, true)
+}
+
+func resolveInRoot(root, name string, followLast bool) (string, error) {
+	root = filepath.Clean(root)
+	pending := pathElems(name)
+	var resolved []string
+	links := 0
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+		if elem == ".." {
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		if len(pending) == 0 && !followLast {
+			resolved = append(resolved, elem)
+			break
+		}
+
+		p := filepath.Join(root, filepath.Join(resolved...), elem)
+		info, err := os.Lstat(p)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// Missing parents are created as directories.
+			resolved = append(resolved, elem)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = resolved[:0]
+		}
+		pending = append(pathElems(target), pending...)
+	}
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
+
+// pathElems splits a slash or host separated path into its elements,
+// dropping empty ones and ".".
+func pathElems(name string) []string {
+	var elems []string
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem != "" && elem != "." {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// stagedName returns the slash separated name of a resolved path below
+// root, as the metadata table keys it.
+func stagedName(root, p string) (string, error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
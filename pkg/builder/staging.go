@@ -0,0 +1,434 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stagingFormat is part of every key; bump it when the way trees are
+// extracted changes, so stale entries are not reused.
+const stagingFormat = "1"
+
+// Staging holds kernel and rootfs trees extracted once and reused by later
+// builds and by the other targets of a matrix build. Each builder gets a
+// hard-linked copy, so everything that changes a staged file must replace
+// it rather than write to it in place.
+type Staging struct {
+	dir string
+	// maxSize bounds the entries on disk, 0 for no limit.
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*stagingEntry
+	hashes  map[string]fileHash
+}
+
+type stagingEntry struct {
+	done chan struct{}
+	dir  string
+	meta metaTable
+	err  error
+}
+
+type fileHash struct {
+	size  int64
+	mtime time.Time
+	sum   string
+}
+
+// NewStaging keeps trees below dir, one directory per hash of their
+// inputs. Entries that are complete on disk are reused, so dir can be a
+// persistent cache or a temporary directory the caller removes. Whenever
+// an entry is added, the least recently used ones are removed until the
+// rest fit in maxSize bytes; 0 keeps everything.
+func NewStaging(dir string, maxSize int64) *Staging {
+	return &Staging{dir: dir, maxSize: maxSize, entries: map[string]*stagingEntry{}, hashes: map[string]fileHash{}}
+}
+
+// get returns the tree for key, from memory, from disk, or by running fill
+// into a fresh directory. Concurrent callers for the same key wait for the
+// first one. The boolean is true for the caller whose fill ran.
+func (s *Staging) get(key string, withMeta bool, fill func(dir string, meta metaTable) error) (*stagingEntry, bool) {
+	s.mu.Lock()
+	if e, ok := s.entries[key]; ok {
+		s.mu.Unlock()
+		<-e.done
+		return e, false
+	}
+	e := &stagingEntry{done: make(chan struct{})}
+	s.entries[key] = e
+	s.mu.Unlock()
+	defer close(e.done)
+
+	entryDir := filepath.Join(s.dir, key)
+	if err := s.load(e, entryDir, withMeta); err == nil {
+		// The entry's mtime records its last use, for Prune.
+		now := time.Now()
+		os.Chtimes(entryDir, now, now)
+		return e, false
+	} else if !errors.Is(err, fs.ErrNotExist) || fileExists(filepath.Join(entryDir, "tree")) {
+		// A damaged entry; replace it.
+		os.RemoveAll(entryDir)
+	}
+
+	e.err = s.fill(entryDir, withMeta, fill)
+	if e.err == nil {
+		e.err = s.load(e, entryDir, withMeta)
+	}
+	if e.err == nil && s.maxSize > 0 {
+		// Failing to prune does not fail the build.
+		s.Prune(s.maxSize, 0)
+	}
+	if e.err != nil {
+		// Let a later build try again.
+		s.mu.Lock()
+		delete(s.entries, key)
+		s.mu.Unlock()
+	}
+	return e, true
+}
+
+func (s *Staging) load(e *stagingEntry, entryDir string, withMeta bool) error {
+	tree := filepath.Join(entryDir, "tree")
+	if _, err := os.Stat(tree); err != nil {
+		return err
+	}
+	e.dir = tree
+	if !withMeta {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(entryDir, "meta.json"))
+	if err != nil {
+		return err
+	}
+	e.meta = metaTable{}
+	return json.Unmarshal(data, &e.meta)
+}
+
+// fill builds the entry in a temporary directory and renames it into
+// place, so another build never sees it half done.
+func (s *Staging) fill(entryDir string, withMeta bool, fill func(dir string, meta metaTable) error) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create staging cache: %w", err)
+	}
+	tmp, err := os.MkdirTemp(s.dir, ".partial-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	tree := filepath.Join(tmp, "tree")
+	if err := os.Mkdir(tree, 0755); err != nil {
+		return err
+	}
+	var meta metaTable
+	if withMeta {
+		meta = metaTable{}
+	}
+	if err := fill(tree, meta); err != nil {
+		return err
+	}
+	if withMeta {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, "meta.json"), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, entryDir); err != nil {
+		// Another process finished the same entry first.
+		if _, serr := os.Stat(filepath.Join(entryDir, "tree")); serr == nil {
+			return nil
+		}
+		return fmt.Errorf("failed to store staged tree: %w", err)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// key hashes what identifies a staged tree: its kind, the parameters that
+// change how it is built and the contents of its input files.
+func (s *Staging) key(what string, params, inputs []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", stagingFormat, what)
+	for _, p := range params {
+		fmt.Fprintf(h, "%s\x00", p)
+	}
+	for _, path := range inputs {
+		sum, err := s.hashFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Leave it to fill to report the missing file.
+			sum = "missing"
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the SHA-256 of path, remembering it for as long as the
+// file keeps its size and mtime.
+func (s *Staging) hashFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	cached, ok := s.hashes[path]
+	s.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.mtime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	s.hashes[path] = fileHash{size: info.Size(), mtime: info.ModTime(), sum: sum}
+	s.mu.Unlock()
+	return sum, nil
+}
+
+// stageCached fills dest through fill, or with a copy of what fill produced
+// earlier for the same params and input file contents. meta, when not nil,
+// receives the recorded metadata either way.
+func (b *Builder) stageCached(ctx context.Context, what string, params, inputs []string, dest string, meta metaTable, fill func(dir string, meta metaTable) error) error {
+	if b.Shared == nil {
+		return fill(dest, meta)
+	}
+
+	key, err := b.Shared.key(what, params, inputs)
+	if err != nil {
+		return err
+	}
+	e, filled := b.Shared.get(key, meta != nil, fill)
+	if e.err != nil {
+		return e.err
+	}
+	if !filled {
+		b.step("Reusing staged %s from cache (%s)", what, key[:12])
+	}
+
+	if err := cloneTree(ctx, e.dir, dest); err != nil {
+		return fmt.Errorf("failed to copy staged %s: %w", what, err)
+	}
+	maps.Copy(meta, e.meta)
+	return nil
+}
+
+// cloneTree recreates src below dst, hard-linking regular files where the
+// filesystem allows it and copying them otherwise. Hard links within src
+// stay hard links and holes stay holes.
+func cloneTree(ctx context.Context, src, dst string) error {
+	links := map[hostFileKey]string{}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			return copySymlink(path, target)
+		case d.Type().IsRegular():
+			if err := removeFile(target); err != nil {
+				return err
+			}
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if key, ok := hostLinkKey(info); ok {
+				if first, seen := links[key]; seen {
+					return os.Link(first, target)
+				}
+				links[key] = target
+			}
+			return copyFileSparse(ctx, path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFileSparse(ctx context.Context, src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := copySparse(out, ctxReader{ctx, in}); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, perm)
+}
+
+// stagingRecentUse is how long an entry is kept after its last use
+// regardless of the size limit, since another build may still be copying
+// it.
+const stagingRecentUse = time.Hour
+
+// Prune removes entries, least recently used first, until the rest take at
+// most maxSize bytes, and every entry not used for olderThan; a zero
+// argument does not apply. Entries this Staging has handed out are kept,
+// and the size limit spares ones another build used within the last hour.
+// It returns the number of entries removed and the bytes they took.
+func (s *Staging) Prune(maxSize int64, olderThan time.Duration) (int, int64, error) {
+	dirents, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read staging cache: %w", err)
+	}
+
+	type entry struct {
+		dir     string
+		used    time.Time
+		size    int64
+		partial bool
+	}
+	var entries []entry
+	var total int64
+	for _, d := range dirents {
+		if !d.IsDir() {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(s.dir, d.Name())
+		size, err := treeSize(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		entries = append(entries, entry{dir, info.ModTime(), size, strings.HasPrefix(d.Name(), ".partial-")})
+		total += size
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	s.mu.Lock()
+	inUse := map[string]bool{}
+	for key := range s.entries {
+		inUse[filepath.Join(s.dir, key)] = true
+	}
+	s.mu.Unlock()
+
+	var removed int
+	var freed int64
+	now := time.Now()
+	for _, e := range entries {
+		if inUse[e.dir] {
+			continue
+		}
+		age := now.Sub(e.used)
+		recent := age < stagingRecentUse
+		// Partial entries older than an hour were left by builds that
+		// were killed.
+		expired := (e.partial && !recent) || (olderThan > 0 && age > olderThan)
+		overSize := maxSize > 0 && total > maxSize && !recent
+		if !expired && !overSize {
+			continue
+		}
+		if err := os.RemoveAll(e.dir); err != nil {
+			return removed, freed, fmt.Errorf("failed to remove %s: %w", e.dir, err)
+		}
+		removed++
+		freed += e.size
+		total -= e.size
+	}
+	return removed, freed, nil
+}
+
+// treeSize adds up the regular files below dir, counting hard-linked
+// files once.
+func treeSize(dir string) (int64, error) {
+	var size int64
+	seen := map[hostFileKey]bool{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if key, ok := hostLinkKey(info); ok {
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %w", dir, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,77 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStagingPrune(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	entry := func(name string, size int, used time.Duration) {
+		t.Helper()
+		tree := filepath.Join(dir, name, "tree")
+		if err := os.MkdirAll(tree, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tree, "file"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(-used)
+		if err := os.Chtimes(filepath.Join(dir, name), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry("oldest", 1000, 72*time.Hour)
+	entry("older", 1000, 48*time.Hour)
+	entry("recent", 1000, time.Minute)
+	entry(".partial-killed", 10, 3*time.Hour)
+	entry(".partial-running", 10, time.Minute)
+
+	s := NewStaging(dir, 0)
+	removed, freed, err := s.Prune(1500, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 || freed != 2010 {
+		t.Errorf("Prune removed %d entries, %d bytes; want 3, 2010", removed, freed)
+	}
+	for name, want := range map[string]bool{"oldest": false, "older": false, "recent": true, ".partial-killed": false, ".partial-running": true} {
+		if got := fileExists(filepath.Join(dir, name)); got != want {
+			t.Errorf("%s kept = %v, want %v", name, got, want)
+		}
+	}
+
+	// An age limit removes whatever was not used since, however small.
+	if removed, _, err := s.Prune(0, time.Nanosecond); err != nil || removed != 2 {
+		t.Errorf("Prune by age removed %d entries (%v), want 2", removed, err)
+	}
+}
+
+func TestStagingTouchesReusedEntries(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStaging(dir, 0)
+	fill := func(dir string, meta metaTable) error {
+		return os.WriteFile(filepath.Join(dir, "file"), []byte("x"), 0644)
+	}
+	if e, _ := s.get("key", false, fill); e.err != nil {
+		t.Fatal(e.err)
+	}
+
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "key"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if e, filled := NewStaging(dir, 0).get("key", false, fill); e.err != nil || filled {
+		t.Fatalf("entry not reused: filled=%v err=%v", filled, e.err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(old) {
+		t.Errorf("reused entry kept its old mtime %v", info.ModTime())
+	}
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Checksums maps the repository path of every file in the kernel, rootfs,
+// patch, loader and firmware indexes next to the config to its index
+// entry, named by that path. Index files that do not exist yet are
+// skipped, and entries written before checksums were recorded are left
+// out.
+func (c *Config) Checksums() (map[string]IndexFile, error) {
+	sums := map[string]IndexFile{}
+	add := func(name string, f IndexFile) {
+		if f.SHA256 != "" {
+			f.Name = name
+			sums[name] = f
+		}
+	}
+
+	var kernels KernelIndex
+	if err := loadIndex(c.IndexPath("kernels.yaml"), &kernels); err != nil {
+		return nil, err
+	}
+	for _, k := range kernels.Kernels {
+		for _, f := range k.Files {
+			add(path.Join(k.Path, f.Name), f)
+		}
+	}
+
+	var rootfs RootfsIndex
+	if err := loadIndex(c.IndexPath("rootfs.yaml"), &rootfs); err != nil {
+		return nil, err
+	}
+	for _, r := range rootfs.Rootfs {
+		add(r.Path, IndexFile{Size: r.Size, SHA256: r.SHA256})
+	}
+
+	var patches PatchIndex
+	if err := loadIndex(c.IndexPath("patch.yaml"), &patches); err != nil {
+		return nil, err
+	}
+	for _, p := range patches.Patches {
+		add(p.Path, IndexFile{Size: p.Size, SHA256: p.SHA256})
+	}
+
+	var loaders LoaderIndex
+	if err := loadIndex(c.IndexPath("loader.yaml"), &loaders); err != nil {
+		return nil, err
+	}
+	for _, l := range loaders.Loaders {
+		for _, f := range l.Files {
+			add(path.Join(l.Path, f.Name), f)
+		}
+	}
+
+	var firmware FirmwareIndex
+	if err := loadIndex(c.IndexPath("firmware.yaml"), &firmware); err != nil {
+		return nil, err
+	}
+	for _, f := range firmware.Firmware.Files {
+		add(path.Join(firmware.Firmware.Path, f.Name), f)
+	}
+
+	return sums, nil
+}
+
+// loadIndex reads an index file into v, leaving v empty when the file does
+// not exist.
+func loadIndex(indexPath string, v any) error {
+	data, err := os.ReadFile(indexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Base(indexPath), err)
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", filepath.Base(indexPath), err)
+	}
+	return nil
+}
+
+// Origins maps the path of every kernel, rootfs, patch, loader, device and
+// firmware entry in the local indexes to the repository it was indexed from.
+// Entries from indexes written before repositories were recorded are left
+// out.
+func (c *Config) Origins() (map[string]string, error) {
+	origins := map[string]string{}
+	add := func(p, repo string) {
+		if repo != "" {
+			origins[p] = repo
+		}
+	}
+
+	var kernels KernelIndex
+	if err := loadIndex(c.IndexPath("kernels.yaml"), &kernels); err != nil {
+		return nil, err
+	}
+	for _, k := range kernels.Kernels {
+		add(k.Path, k.Repo)
+	}
+
+	var rootfs RootfsIndex
+	if err := loadIndex(c.IndexPath("rootfs.yaml"), &rootfs); err != nil {
+		return nil, err
+	}
+	for _, r := range rootfs.Rootfs {
+		add(r.Path, r.Repo)
+	}
+
+	var patches PatchIndex
+	if err := loadIndex(c.IndexPath("patch.yaml"), &patches); err != nil {
+		return nil, err
+	}
+	for _, p := range patches.Patches {
+		add(p.Path, p.Repo)
+	}
+
+	var loaders LoaderIndex
+	if err := loadIndex(c.IndexPath("loader.yaml"), &loaders); err != nil {
+		return nil, err
+	}
+	for _, l := range loaders.Loaders {
+		add(l.Path, l.Repo)
+	}
+
+	var firmware FirmwareIndex
+	if err := loadIndex(c.IndexPath("firmware.yaml"), &firmware); err != nil {
+		return nil, err
+	}
+	add(firmware.Firmware.Path, firmware.Firmware.Repo)
+
+	var devices DeviceIndex
+	if err := loadIndex(c.IndexPath("devices.yaml"), &devices); err != nil {
+		return nil, err
+	}
+	for _, d := range devices.Devices {
+		add(d.Path, d.Repo)
+	}
+
+	return origins, nil
+}
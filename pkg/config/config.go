@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -12,13 +13,37 @@ import (
 type Config struct {
 	Version      string                `yaml:"version"`
 	Repositories map[string]Repository `yaml:"repositories"`
+
+	// Offline builds from the download cache and the local indexes only,
+	// like the --offline flag.
+	Offline bool `yaml:"offline"`
+
+	// AutoUpdate makes build and list update indexes older than the
+	// cache_ttl of the repositories instead of only warning about them.
+	AutoUpdate bool `yaml:"auto_update"`
+
+	// Cache is the directory downloads and staged trees are kept in. A
+	// relative path is taken from the directory above Dir, the checkout
+	// that holds configs/; empty means .cache there.
+	Cache string `yaml:"cache_dir"`
+
+	// StagingMaxSize bounds the staged trees kept between builds, in MB.
+	// The least recently used ones are removed beyond it; 0 means 8192
+	// and a negative value keeps everything.
+	StagingMaxSize int64 `yaml:"staging_max_size"`
+
+	// Dir is the directory config.yaml was loaded from. The index files
+	// (devices.yaml, kernels.yaml, ...) are read from the same directory.
+	Dir string `yaml:"-"`
 }
 
 type Repository struct {
+	Priority    int               `yaml:"priority"`
 	Type        string            `yaml:"type"`
 	URL         string            `yaml:"url"`
 	Branch      string            `yaml:"branch"`
 	Path        string            `yaml:"path"`
+	Token       string            `yaml:"token"`
 	CacheTTL    int               `yaml:"cache_ttl"`
 	Description string            `yaml:"description"`
 	Components  map[string]string `yaml:"components"`
@@ -36,6 +61,7 @@ type Device struct {
 	Name   string `yaml:"name"`
 	Vendor string `yaml:"vendor"`
 	Path   string `yaml:"path"`
+	Repo   string `yaml:"repo,omitempty"`
 }
 
 type KernelIndex struct {
@@ -47,9 +73,13 @@ type KernelIndex struct {
 }
 
 type Kernel struct {
-	Version string `yaml:"version"`
-	Vendor  string `yaml:"vendor"`
-	Path    string `yaml:"path"`
+	Version string      `yaml:"version"`
+	Release string      `yaml:"release,omitempty"`
+	Vendor  string      `yaml:"vendor"`
+	Vendors []string    `yaml:"vendors,omitempty"`
+	Path    string      `yaml:"path"`
+	Repo    string      `yaml:"repo,omitempty"`
+	Files   []IndexFile `yaml:"files"`
 }
 
 type RootfsIndex struct {
@@ -61,17 +91,123 @@ type RootfsIndex struct {
 }
 
 type Rootfs struct {
-	Name string `yaml:"name"`
-	Path string `yaml:"path"`
+	Name   string `yaml:"name"`
+	Size   int64  `yaml:"size"`
+	Path   string `yaml:"path"`
+	SHA256 string `yaml:"sha256"`
+	Repo   string `yaml:"repo,omitempty"`
+}
+
+type PatchIndex struct {
+	Patches []Patch `yaml:"patches"`
+}
+
+type Patch struct {
+	Name   string `yaml:"name"`
+	Size   int64  `yaml:"size"`
+	Path   string `yaml:"path"`
+	SHA256 string `yaml:"sha256"`
+	Repo   string `yaml:"repo,omitempty"`
+}
+
+type LoaderIndex struct {
+	Loaders []Loader `yaml:"loaders"`
+}
+
+type Loader struct {
+	Vendor string      `yaml:"vendor"`
+	Path   string      `yaml:"path"`
+	Repo   string      `yaml:"repo,omitempty"`
+	Files  []IndexFile `yaml:"files"`
+}
+
+type FirmwareIndex struct {
+	Metadata struct {
+		Generated string `yaml:"generated"`
+		Source    string `yaml:"source"`
+	} `yaml:"metadata"`
+	Firmware struct {
+		Path  string      `yaml:"path"`
+		Repo  string      `yaml:"repo,omitempty"`
+		Files []IndexFile `yaml:"files"`
+	} `yaml:"firmware"`
+}
+
+// IndexFile is a file recorded in an index with its size and SHA-256.
+type IndexFile struct {
+	Name    string   `yaml:"name"`
+	Size    int64    `yaml:"size"`
+	SHA256  string   `yaml:"sha256"`
+	DTBs    []string `yaml:"dtbs,omitempty"`
+	Release string   `yaml:"release,omitempty"`
+}
+
+// CacheRoot resolves the cache directory, without depending on the
+// working directory when the config was loaded from an absolute path.
+func (c *Config) CacheRoot() string {
+	cache := c.Cache
+	if cache == "" {
+		cache = ".cache"
+	}
+	return c.checkoutPath(cache)
+}
+
+// LocalDir returns the directory a type local repository reads: path, or
+// url when path is empty. Like cache_dir, a relative one is taken from the
+// directory above Dir.
+func (c *Config) LocalDir(r Repository) string {
+	dir := r.Path
+	if dir == "" {
+		dir = r.URL
+	}
+	if dir == "" {
+		return ""
+	}
+	return c.checkoutPath(dir)
+}
+
+// checkoutPath resolves p against the directory above Dir, the checkout
+// that holds configs/.
+func (c *Config) checkoutPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	base := "."
+	if c.Dir != "" {
+		base = filepath.Dir(c.Dir)
+	}
+	return filepath.Join(base, p)
+}
+
+// CacheDir is where downloads from every repository are kept.
+func (c *Config) CacheDir() string {
+	return filepath.Join(c.CacheRoot(), "data")
 }
 
-func (r *Repository) CacheDir() string {
-	return filepath.Join(".cache", "data")
+// StagingDir is where extracted kernel and rootfs trees are kept between
+// builds.
+func (c *Config) StagingDir() string {
+	return filepath.Join(c.CacheRoot(), "staging")
+}
+
+// StagingLimit returns StagingMaxSize in bytes, 0 for no limit.
+func (c *Config) StagingLimit() int64 {
+	switch {
+	case c.StagingMaxSize < 0:
+		return 0
+	case c.StagingMaxSize == 0:
+		return 8192 << 20
+	}
+	return c.StagingMaxSize << 20
 }
 
 func Load() (*Config, error) {
-	configPath := "configs/config.yaml"
+	return LoadFile(filepath.Join("configs", "config.yaml"))
+}
 
+// LoadFile reads the config at configPath. Unlike Load it does not depend
+// on the working directory.
+func LoadFile(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config: %w", err)
@@ -81,12 +217,52 @@ func Load() (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	cfg.Dir = filepath.Dir(configPath)
 
 	return &cfg, nil
 }
 
+// RepositoryNames returns the names of the data repositories, highest
+// priority first. Repositories with the same priority are in name order.
+func (c *Config) RepositoryNames() []string {
+	names := make([]string, 0, len(c.Repositories))
+	for name := range c.Repositories {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := c.Repositories[names[i]].Priority, c.Repositories[names[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// IndexPath returns the path of an index file next to the config.
+func (c *Config) IndexPath(name string) string {
+	if c.Dir == "" {
+		return filepath.Join("configs", name)
+	}
+	return filepath.Join(c.Dir, name)
+}
+
+// DeviceVendor looks up the vendor of a device in the devices.yaml next to
+// the config.
+func (c *Config) DeviceVendor(deviceName string) (string, error) {
+	devices, err := LoadDevicesFile(c.IndexPath("devices.yaml"))
+	if err != nil {
+		return "", err
+	}
+	return devices.vendor(deviceName)
+}
+
 func LoadDevices() (*DeviceIndex, error) {
-	data, err := os.ReadFile("configs/devices.yaml")
+	return LoadDevicesFile(filepath.Join("configs", "devices.yaml"))
+}
+
+func LoadDevicesFile(path string) (*DeviceIndex, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read devices.yaml: %w", err)
 	}
@@ -113,6 +289,33 @@ func LoadKernels() (*KernelIndex, error) {
 	return &index, nil
 }
 
+// FindKernel returns the entry of a kernel version in the kernel index,
+// or nil when it is not listed.
+func (c *Config) FindKernel(version string) (*Kernel, error) {
+	var index KernelIndex
+	if err := loadIndex(c.IndexPath("kernels.yaml"), &index); err != nil {
+		return nil, err
+	}
+	for i := range index.Kernels {
+		if index.Kernels[i].Version == version {
+			return &index.Kernels[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// DTBs lists the device trees the kernel has for vendor, as recorded by
+// the index.
+func (k *Kernel) DTBs(vendor string) []string {
+	name := fmt.Sprintf("dtb-%s-%s.tar.gz", vendor, k.Version)
+	for _, f := range k.Files {
+		if f.Name == name {
+			return f.DTBs
+		}
+	}
+	return nil
+}
+
 func LoadRootfs() (*RootfsIndex, error) {
 	data, err := os.ReadFile("configs/rootfs.yaml")
 	if err != nil {
@@ -127,12 +330,29 @@ func LoadRootfs() (*RootfsIndex, error) {
 	return &index, nil
 }
 
+func LoadPatches() (*PatchIndex, error) {
+	data, err := os.ReadFile("configs/patch.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read patch.yaml: %w", err)
+	}
+
+	var index PatchIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse patch.yaml: %w", err)
+	}
+
+	return &index, nil
+}
+
 func GetDeviceVendor(deviceName string) (string, error) {
 	devices, err := LoadDevices()
 	if err != nil {
 		return "", err
 	}
+	return devices.vendor(deviceName)
+}
 
+func (devices *DeviceIndex) vendor(deviceName string) (string, error) {
 	deviceName = strings.ToLower(deviceName)
 	for _, device := range devices.Devices {
 		if strings.ToLower(device.Name) == deviceName {
@@ -0,0 +1,52 @@
+package config
+
+import "time"
+
+// IndexFiles are the index files 'omb repo update' writes next to
+// config.yaml.
+var IndexFiles = []string{"kernels.yaml", "rootfs.yaml", "devices.yaml", "patch.yaml", "loader.yaml", "firmware.yaml"}
+
+// CacheTTL is how long the local indexes are trusted: the smallest
+// cache_ttl, in seconds, of the repositories. Zero means no limit.
+func (c *Config) CacheTTL() time.Duration {
+	var ttl time.Duration
+	for _, r := range c.Repositories {
+		d := time.Duration(r.CacheTTL) * time.Second
+		if d > 0 && (ttl == 0 || d < ttl) {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+// IndexAge returns how long ago the oldest local index was fetched or
+// last found current by 'omb repo update'. Missing indexes are ignored;
+// without any the age is zero.
+func (c *Config) IndexAge() (time.Duration, error) {
+	var oldest time.Time
+	for _, name := range IndexFiles {
+		var index struct {
+			Metadata struct {
+				Generated string `yaml:"generated"`
+				Checked   string `yaml:"checked"`
+			} `yaml:"metadata"`
+		}
+		if err := loadIndex(c.IndexPath(name), &index); err != nil {
+			return 0, err
+		}
+
+		var fresh time.Time
+		for _, stamp := range []string{index.Metadata.Generated, index.Metadata.Checked} {
+			if t, err := time.Parse(time.RFC3339, stamp); err == nil && t.After(fresh) {
+				fresh = t
+			}
+		}
+		if !fresh.IsZero() && (oldest.IsZero() || fresh.Before(oldest)) {
+			oldest = fresh
+		}
+	}
+	if oldest.IsZero() {
+		return 0, nil
+	}
+	return time.Since(oldest), nil
+}
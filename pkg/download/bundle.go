@@ -0,0 +1,220 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/repo"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
+)
+
+const defaultParallel = 4
+
+// kernelRequired lists the files of a kernel bundle a build for vendor
+// reads: the boot files, the modules and the vendor's device trees. Without
+// a vendor no device trees are required. Other files in the bundle are
+// fetched when possible.
+func kernelRequired(version, vendor string) []string {
+	files := []string{"boot-" + version + ".tar.gz", "modules-" + version + ".tar.gz"}
+	if vendor != "" {
+		files = append(files, fmt.Sprintf("dtb-%s-%s.tar.gz", vendor, version))
+	}
+	return files
+}
+
+// missingKernelFile fails when a required file is not among the files the
+// index or the repository has for a kernel.
+func missingKernelFile(version string, files, required []string) error {
+	for _, file := range required {
+		if !slices.Contains(files, file) {
+			return fmt.Errorf("kernel %s has no %s", version, file)
+		}
+	}
+	return nil
+}
+
+// downloadBundle fetches files from remoteDir into dir, at most
+// m.Parallel at a time, and shows them as one download called name. A
+// failure on a required file cancels the others and is returned; other
+// failures are reported as warnings.
+func (m *Manager) downloadBundle(ctx context.Context, name, remoteDir, dir string, files []string, required func(string) bool) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := newBundleProgress(m, name)
+	for _, file := range files {
+		if sum, ok := m.checksums()[remoteDir+"/"+file]; ok {
+			progress.totals[file] = sum.Size
+		}
+	}
+	dm := m.withReporter(progress)
+
+	jobs := m.Parallel
+	if jobs <= 0 {
+		jobs = defaultParallel
+	}
+	sem := make(chan struct{}, jobs)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, file := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			remotePath, localPath := remoteDir+"/"+file, filepath.Join(dir, file)
+			if m.verifyCached(ctx, localPath, remotePath) == nil {
+				// Completed by an earlier, interrupted run.
+				return
+			}
+			err := dm.downloadFile(ctx, remotePath, localPath)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			if !required(file) {
+				m.warn("skipped %s: %v", file, err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to download %s: %w", file, err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil && parent.Err() != nil {
+		firstErr = parent.Err()
+	}
+	progress.finish(firstErr)
+	return firstErr
+}
+
+// clone returns a manager with m's settings, sources and index.
+func (m *Manager) clone() *Manager {
+	m.loadSources()
+	c := &Manager{
+		Config:        m.Config,
+		Client:        m.Client,
+		Reporter:      m.Reporter,
+		MaxAttempts:   m.MaxAttempts,
+		RetryDelay:    m.RetryDelay,
+		StallTimeout:  m.StallTimeout,
+		RateLimitWait: m.RateLimitWait,
+		Offline:       m.Offline,
+		Source:        m.Source,
+		Parallel:      m.Parallel,
+		sources:       m.sources,
+		origins:       m.origins,
+		sourceErr:     m.sourceErr,
+		sums:          m.checksums(),
+	}
+	c.sourceOnce.Do(func() {})
+	c.sumsOnce.Do(func() {})
+	return c
+}
+
+// withReporter returns a copy of m that reports to r.
+func (m *Manager) withReporter(r report.Reporter) *Manager {
+	c := m.clone()
+	c.Reporter = r
+	return c
+}
+
+// pinned returns a copy of m that takes every file from src.
+func (m *Manager) pinned(src repo.Source) *Manager {
+	c := m.clone()
+	c.Source = src
+	c.sources = []repo.Source{src}
+	c.origins = nil
+	c.sourceErr = nil
+	return c
+}
+
+// bundleProgress folds the download events of several files into one
+// download. Other events are passed on unchanged.
+type bundleProgress struct {
+	m    *Manager
+	name string
+
+	mu      sync.Mutex
+	started bool
+	bytes   map[string]int64
+	totals  map[string]int64
+}
+
+func newBundleProgress(m *Manager, name string) *bundleProgress {
+	return &bundleProgress{m: m, name: name, bytes: map[string]int64{}, totals: map[string]int64{}}
+}
+
+func (p *bundleProgress) Report(e report.Event) {
+	switch e.Kind {
+	case report.DownloadStarted, report.DownloadProgress, report.DownloadFinished:
+	default:
+		p.m.report(e)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytes[e.File] = e.Bytes
+	if e.Total > 0 {
+		p.totals[e.File] = e.Total
+	}
+	if e.Kind == report.DownloadFinished {
+		// The bundle finishes once, in finish.
+		return
+	}
+
+	kind := report.DownloadProgress
+	if !p.started {
+		kind = report.DownloadStarted
+		p.started = true
+	}
+	bytes, total := p.sum()
+	p.m.report(report.Event{Kind: kind, File: p.name, Bytes: bytes, Total: total})
+}
+
+func (p *bundleProgress) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.started {
+		return
+	}
+
+	e := report.Event{Kind: report.DownloadFinished, File: p.name}
+	e.Bytes, e.Total = p.sum()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	p.m.report(e)
+}
+
+func (p *bundleProgress) sum() (bytes, total int64) {
+	for _, n := range p.bytes {
+		bytes += n
+	}
+	for _, n := range p.totals {
+		total += n
+	}
+	if total == 0 {
+		total = -1
+	}
+	return bytes, total
+}
@@ -0,0 +1,311 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/repo"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
+)
+
+const (
+	defaultMaxAttempts  = 5
+	defaultRetryDelay   = time.Second
+	maxRetryDelay       = 30 * time.Second
+	defaultStallTimeout = 60 * time.Second
+)
+
+// newHTTPClient bounds connecting and waiting for response headers. The
+// body has no overall deadline, since a rootfs can take many minutes; a
+// stalled transfer is caught by the Manager's StallTimeout instead.
+func newHTTPClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	transport.RegisterProtocol("file", repo.NewFileTransport())
+	return &http.Client{Transport: transport}
+}
+
+// retryableError marks failures worth another attempt: network errors,
+// stalls and server-side HTTP errors. wait, when set, is how long the
+// server asked to wait before the next attempt.
+type retryableError struct {
+	err  error
+	wait time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// fetch downloads url to path. Data goes to path+".part" first and is
+// renamed into place once complete; an interrupted transfer is retried
+// with exponential backoff and resumed with a Range request, also by a
+// later call after the process was stopped. header is added to every
+// request. When want is set, the file must match its size and SHA-256
+// before it is moved into place.
+func (m *Manager) fetch(ctx context.Context, url, path, name string, header http.Header, want *config.IndexFile) error {
+	if m.Offline {
+		return &MissingError{Missing: []string{name + ": not downloaded"}}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	part := path + ".part"
+
+	attempts := m.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultMaxAttempts
+	}
+	delay := m.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		_, statErr := os.Stat(part)
+		resumed := statErr == nil
+
+		err = m.fetchOnce(ctx, url, part, name, header, want)
+		if err == nil && want != nil {
+			if err = verifyFile(ctx, part, *want); err != nil {
+				os.Remove(part)
+				os.Remove(part + ".etag")
+				err = fmt.Errorf("%s: %w", name, err)
+				// A resumed part may have been appended to a different
+				// version of the file; a fresh download can still succeed.
+				if resumed && ctx.Err() == nil {
+					err = &retryableError{err: err}
+				}
+			}
+		}
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var retry *retryableError
+		if !errors.As(err, &retry) || attempt == attempts {
+			return err
+		}
+
+		wait := max(delay, retry.wait)
+		m.warn("%s: %v; retrying in %s (attempt %d of %d)", name, err, wait.Round(time.Millisecond), attempt+1, attempts)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+
+	os.Remove(part + ".etag")
+	if err := os.Rename(part, path); err != nil {
+		return fmt.Errorf("failed to move download into place: %w", err)
+	}
+	return nil
+}
+
+// fetchOnce makes one request, appending to part when the server honours
+// the Range for the bytes already there.
+func (m *Manager) fetchOnce(ctx context.Context, url, part, name string, header http.Header, want *config.IndexFile) error {
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// Only resume if the file has not changed since the part was
+		// started; otherwise the server sends all of it.
+		if etag, err := os.ReadFile(part + ".etag"); err == nil && len(etag) > 0 {
+			req.Header.Set("If-Range", string(etag))
+		}
+	}
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return &retryableError{err: fmt.Errorf("download failed: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if wait, limited := repo.RateLimitWait(resp); limited {
+		limit := m.RateLimitWait
+		if limit <= 0 {
+			limit = repo.DefaultRateLimitWait
+		}
+		if wait > limit {
+			return &repo.RateLimitError{Host: req.URL.Host, Reset: time.Now().Add(wait), Authenticated: req.Header.Get("Authorization") != ""}
+		}
+		return &retryableError{err: fmt.Errorf("download failed: HTTP %d (rate limited)", resp.StatusCode), wait: wait}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	total := resp.ContentLength
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			os.Remove(part)
+			return &retryableError{err: fmt.Errorf("download failed: unexpected Content-Range %q", resp.Header.Get("Content-Range"))}
+		}
+		flags |= os.O_APPEND
+		total = size
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+		if total < 0 && want != nil {
+			total = want.Size
+		}
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			os.WriteFile(part+".etag", []byte(etag), 0644)
+		} else {
+			os.Remove(part + ".etag")
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The part is stale or already complete; start over.
+		os.Remove(part)
+		return &retryableError{err: fmt.Errorf("download failed: HTTP %d", resp.StatusCode)}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &retryableError{err: fmt.Errorf("download failed: HTTP %d", resp.StatusCode)}
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("download failed: HTTP %d: %w", resp.StatusCode, repo.ErrNotFound)
+	default:
+		return fmt.Errorf("download failed: HTTP %d", resp.StatusCode)
+	}
+
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+
+	stall := m.StallTimeout
+	if stall <= 0 {
+		stall = defaultStallTimeout
+	}
+	body := newStallReader(resp.Body, stall, cancel)
+	defer body.stop()
+
+	m.report(report.Event{Kind: report.DownloadStarted, File: name, Bytes: offset, Total: total})
+	pw := &progressWriter{m: m, name: name, total: total, written: offset}
+	_, err = io.Copy(io.MultiWriter(out, pw), body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil && total > 0 && pw.written != total {
+		err = &retryableError{err: fmt.Errorf("connection closed after %d of %d bytes", pw.written, total)}
+	}
+	if err != nil {
+		m.report(report.Event{Kind: report.DownloadFinished, File: name, Bytes: pw.written, Total: total, Error: err.Error()})
+		if body.stalled() {
+			return &retryableError{err: fmt.Errorf("no data received for %s", stall)}
+		}
+		if ctx.Err() == nil {
+			var retry *retryableError
+			if !errors.As(err, &retry) {
+				err = &retryableError{err: fmt.Errorf("download failed: %w", err)}
+			}
+		}
+		return err
+	}
+
+	m.report(report.Event{Kind: report.DownloadFinished, File: name, Bytes: pw.written, Total: total})
+	return nil
+}
+
+// parseContentRange reads "bytes start-end/size". size is -1 when the
+// server does not know it.
+func parseContentRange(value string) (start, size int64, ok bool) {
+	value, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, sizeText, found := strings.Cut(value, "/")
+	if !found {
+		return 0, 0, false
+	}
+	startText, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size = -1
+	if sizeText != "*" {
+		if size, err = strconv.ParseInt(sizeText, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, size, true
+}
+
+// stallReader cancels the request when no data arrives for timeout.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu    sync.Mutex
+	fired bool
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *stallReader {
+	s := &stallReader{r: r, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.fired = true
+		s.mu.Unlock()
+		cancel()
+	})
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+func (s *stallReader) stop() { s.timer.Stop() }
+
+func (s *stallReader) stalled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fired
+}
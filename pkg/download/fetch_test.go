@@ -0,0 +1,249 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
+)
+
+const testETag = `"v1"`
+
+// fetchServer serves data, recording every request. Requests for which
+// drop returns a cut-off point get a full-length 200 response whose
+// connection is closed after that many bytes.
+type fetchServer struct {
+	data        []byte
+	ignoreRange bool
+	drop        func(attempt int) (int, bool)
+	stall       func(attempt int) (int, bool)
+
+	mu       sync.Mutex
+	requests []http.Header
+}
+
+func (s *fetchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Clone())
+	attempt := len(s.requests)
+	s.mu.Unlock()
+
+	if s.drop != nil {
+		if n, ok := s.drop(attempt); ok {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nETag: %s\r\n\r\n", len(s.data), testETag)
+			buf.Write(s.data[:n])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+	}
+	if s.stall != nil {
+		if n, ok := s.stall(attempt); ok {
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(s.data[:n])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+	}
+
+	w.Header().Set("ETag", testETag)
+	start := 0
+	if rng := r.Header.Get("Range"); rng != "" && !s.ignoreRange {
+		start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.data)-1, len(s.data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.data)-start))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	w.Write(s.data[start:])
+}
+
+func (s *fetchServer) headers() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]http.Header(nil), s.requests...)
+}
+
+func testManager(t *testing.T) *Manager {
+	t.Helper()
+	return &Manager{
+		Config:       &config.Config{Dir: t.TempDir()},
+		Client:       &http.Client{},
+		Reporter:     report.Discard,
+		MaxAttempts:  5,
+		RetryDelay:   time.Millisecond,
+		StallTimeout: 5 * time.Second,
+	}
+}
+
+func testData(t *testing.T, size int) ([]byte, *config.IndexFile) {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return data, &config.IndexFile{Name: "file.bin", Size: int64(size), SHA256: hex.EncodeToString(sum[:])}
+}
+
+func assertDownloaded(t *testing.T, path string, data []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes that differ from the %d served", len(got), len(data))
+	}
+	for _, leftover := range []string{path + ".part", path + ".part.etag"} {
+		if _, err := os.Stat(leftover); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s left behind (%v)", filepath.Base(leftover), err)
+		}
+	}
+}
+
+func TestFetchResumesDroppedConnection(t *testing.T) {
+	data, want := testData(t, 256<<10)
+	path := filepath.Join(t.TempDir(), "file.bin")
+
+	var seenDuringRetry error
+	srv := &fetchServer{data: data}
+	srv.drop = func(attempt int) (int, bool) {
+		switch attempt {
+		case 1:
+			return 100000, true
+		case 2:
+			// Nothing may be at the final path before the rename.
+			if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+				seenDuringRetry = fmt.Errorf("final file exists while resuming: %v", err)
+			}
+			return 150000, true
+		}
+		return 0, false
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	m := testManager(t)
+	if err := m.fetch(context.Background(), ts.URL+"/file.bin", path, "file.bin", nil, want); err != nil {
+		t.Fatal(err)
+	}
+	if seenDuringRetry != nil {
+		t.Error(seenDuringRetry)
+	}
+	assertDownloaded(t, path, data)
+
+	requests := srv.headers()
+	if len(requests) != 3 {
+		t.Fatalf("made %d requests, want 3", len(requests))
+	}
+	if r := requests[0].Get("Range"); r != "" {
+		t.Errorf("first request sent Range %q", r)
+	}
+	// The second attempt also drops, after 150000 bytes of a full 200
+	// response, so the third resumes from there.
+	for i, offset := range []int{100000, 150000} {
+		h := requests[i+1]
+		if got, want := h.Get("Range"), fmt.Sprintf("bytes=%d-", offset); got != want {
+			t.Errorf("request %d sent Range %q, want %q", i+2, got, want)
+		}
+		if got := h.Get("If-Range"); got != testETag {
+			t.Errorf("request %d sent If-Range %q, want %q", i+2, got, testETag)
+		}
+	}
+}
+
+func TestFetchGivesUpAfterMaxAttempts(t *testing.T) {
+	data, want := testData(t, 64<<10)
+	path := filepath.Join(t.TempDir(), "file.bin")
+
+	srv := &fetchServer{data: data, drop: func(int) (int, bool) { return 0, true }}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	m := testManager(t)
+	m.MaxAttempts = 3
+	if err := m.fetch(context.Background(), ts.URL+"/file.bin", path, "file.bin", nil, want); err == nil {
+		t.Fatal("fetch succeeded against a server that always drops the connection")
+	}
+	if n := len(srv.headers()); n != 3 {
+		t.Errorf("made %d requests, want 3", n)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("final file exists after a failed download (%v)", err)
+	}
+}
+
+func TestFetchRestartsStalledTransfer(t *testing.T) {
+	data, want := testData(t, 64<<10)
+	path := filepath.Join(t.TempDir(), "file.bin")
+
+	srv := &fetchServer{data: data}
+	srv.stall = func(attempt int) (int, bool) { return 1000, attempt == 1 }
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	m := testManager(t)
+	m.StallTimeout = 200 * time.Millisecond
+	start := time.Now()
+	if err := m.fetch(context.Background(), ts.URL+"/file.bin", path, "file.bin", nil, want); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stalled transfer took %s to be abandoned", elapsed)
+	}
+	assertDownloaded(t, path, data)
+
+	requests := srv.headers()
+	if len(requests) != 2 {
+		t.Fatalf("made %d requests, want 2", len(requests))
+	}
+	if got := requests[1].Get("Range"); got != "bytes=1000-" {
+		t.Errorf("retry after stall sent Range %q, want bytes=1000-", got)
+	}
+}
+
+func TestFetchServerIgnoringRange(t *testing.T) {
+	data, want := testData(t, 64<<10)
+	path := filepath.Join(t.TempDir(), "file.bin")
+
+	srv := &fetchServer{data: data, ignoreRange: true}
+	srv.drop = func(attempt int) (int, bool) { return 20000, attempt == 1 }
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	m := testManager(t)
+	if err := m.fetch(context.Background(), ts.URL+"/file.bin", path, "file.bin", nil, want); err != nil {
+		t.Fatal(err)
+	}
+	// The 200 answer to the Range request replaces the part instead of
+	// being appended to it.
+	assertDownloaded(t, path, data)
+	if got := srv.headers()[1].Get("Range"); got != "bytes=20000-" {
+		t.Errorf("retry sent Range %q, want bytes=20000-", got)
+	}
+}
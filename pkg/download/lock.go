@@ -0,0 +1,80 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const lockPollInterval = 200 * time.Millisecond
+
+// lockCache takes an exclusive lock on the data cache, waiting for other
+// omb processes that are writing to it. Everything that adds, replaces or
+// removes cache entries holds it; readers rely on entries being renamed
+// into place once complete.
+func (m *Manager) lockCache(ctx context.Context) (func(), error) {
+	cacheDir := m.cacheDir()
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(cacheDir, ".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache lock: %w", err)
+	}
+
+	waiting := false
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock cache: %w", err)
+		}
+		if locked {
+			break
+		}
+		if !waiting {
+			m.info("Waiting for another build to finish writing the cache...")
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	return func() {
+		unlock(f)
+		f.Close()
+	}, nil
+}
+
+// ClearCache removes every download from the cache, waiting for builds
+// that are writing to it.
+func (m *Manager) ClearCache(ctx context.Context) error {
+	unlock, err := m.lockCache(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cacheDir := m.cacheDir()
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache: %w", err)
+	}
+	for _, e := range entries {
+		if e.Name() == ".lock" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(cacheDir, e.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package download
+
+import "os"
+
+// Without flock, concurrent builds are only protected by downloads being
+// renamed into place.
+func tryLock(f *os.File) (bool, error) { return true, nil }
+
+func unlock(f *os.File) {}
@@ -4,34 +4,63 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
-	"github.com/schollz/progressbar/v3"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/repo"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/report"
 )
 
 type Manager struct {
-	Config *config.Config
-	Client *http.Client
-}
-
-type FileMetadata struct {
-	Name string
-	Size int64
-	Path string
-}
-
-type githubContent struct {
-	Name string `json:"name"`
-	Path string `json:"path"`
-	Type string `json:"type"`
-	Size int    `json:"size"`
+	Config   *config.Config
+	Client   *http.Client
+	Reporter report.Reporter
+
+	// A failed download is tried MaxAttempts times in all, waiting
+	// RetryDelay before the first retry and twice as long before each
+	// next one. A transfer that receives nothing for StallTimeout counts
+	// as failed. Zero values mean 5 attempts, 1s and 60s.
+	MaxAttempts  int
+	RetryDelay   time.Duration
+	StallTimeout time.Duration
+
+	// A request refused by a rate limit waits for it to reset if that
+	// takes at most RateLimitWait, zero meaning 2 minutes, and fails
+	// with a repo.RateLimitError otherwise.
+	RateLimitWait time.Duration
+
+	// Offline makes the manager use only the cache and the local indexes.
+	// Anything that would need a download fails with a MissingError.
+	Offline bool
+
+	// Source is where files are downloaded from. When nil there is one
+	// source per repository in the config: files are taken from the
+	// repository the index lists them in, or else from the first one by
+	// priority that has them.
+	Source repo.Source
+
+	// Parallel is how many files of a kernel bundle are downloaded at
+	// once. Zero means 4.
+	Parallel int
+
+	sourceOnce sync.Once
+	sources    []repo.Source
+	origins    map[string]repo.Source
+	sourceErr  error
+
+	sumsOnce sync.Once
+	sums     map[string]config.IndexFile
 }
 
 func NewManager() (*Manager, error) {
@@ -40,599 +69,472 @@ func NewManager() (*Manager, error) {
 		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 
+	return NewManagerWithConfig(cfg), nil
+}
+
+// NewManagerWithConfig returns a manager for an already loaded config, for
+// callers that do not keep configs/ in their working directory.
+func NewManagerWithConfig(cfg *config.Config) *Manager {
 	return &Manager{
-		Config: cfg,
-		Client: &http.Client{},
-	}, nil
+		Config:   cfg,
+		Client:   newHTTPClient(),
+		Reporter: report.NewText(os.Stdout),
+		Offline:  cfg.Offline,
+	}
 }
 
-func (m *Manager) DownloadFile(remotePath, localPath string) error {
-	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
-		return fmt.Errorf("create directory: %w", err)
+func (m *Manager) report(e report.Event) {
+	if m.Reporter != nil {
+		m.Reporter.Report(e)
 	}
+}
 
-	repo := m.Config.Repositories["data"]
-	owner := m.getOwner(repo.URL)
-	repoName := m.getRepo(repo.URL)
+func (m *Manager) info(format string, args ...any) {
+	m.report(report.Event{Kind: report.Info, Message: fmt.Sprintf(format, args...)})
+}
 
-	isLFSFile := strings.HasPrefix(remotePath, "kernels/") ||
-		strings.HasPrefix(remotePath, "rootfs/") ||
-		strings.HasPrefix(remotePath, "devices/")
+func (m *Manager) step(format string, args ...any) {
+	m.report(report.Event{Kind: report.Step, Message: fmt.Sprintf(format, args...)})
+}
 
-	var downloadURL string
-	if isLFSFile {
-		downloadURL = fmt.Sprintf("https://media.githubusercontent.com/media/%s/%s/%s/%s",
-			owner, repoName, repo.Branch, remotePath)
-	} else {
-		downloadURL = fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s",
-			owner, repoName, repo.Branch, remotePath)
-	}
+func (m *Manager) warn(format string, args ...any) {
+	m.report(report.Event{Kind: report.Warning, Message: fmt.Sprintf(format, args...)})
+}
 
-	resp, err := m.Client.Get(downloadURL)
-	if err != nil {
-		return fmt.Errorf("download failed: %w", err)
-	}
-	defer resp.Body.Close()
+type progressWriter struct {
+	m       *Manager
+	name    string
+	total   int64
+	written int64
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed: HTTP %d", resp.StatusCode)
-	}
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	p.m.report(report.Event{Kind: report.DownloadProgress, File: p.name, Bytes: p.written, Total: p.total})
+	return len(b), nil
+}
 
-	out, err := os.Create(localPath)
+// DownloadFile fetches remotePath from the data repository into localPath.
+// The file only appears at localPath once complete. Failed transfers are
+// retried, and an interrupted download is resumed from localPath+".part"
+// by the next call.
+func (m *Manager) DownloadFile(ctx context.Context, remotePath, localPath string) error {
+	unlock, err := m.lockCache(ctx)
 	if err != nil {
-		return fmt.Errorf("create file: %w", err)
+		return err
 	}
-	defer out.Close()
-
-	bar := progressbar.DefaultBytes(
-		resp.ContentLength,
-		filepath.Base(localPath),
-	)
+	defer unlock()
 
-	_, err = io.Copy(io.MultiWriter(out, bar), resp.Body)
-	fmt.Println()
-
-	return err
+	return m.downloadFile(ctx, remotePath, localPath)
 }
 
-func (m *Manager) DownloadKernel(version string) error {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	kernelDir := filepath.Join(cacheDir, "kernels", version)
-
-	if _, err := os.Stat(kernelDir); err == nil {
-		files, err := m.listDirectory(fmt.Sprintf("kernels/%s", version))
-		if err == nil {
-			allValid := true
-			for _, file := range files {
-				remotePath := fmt.Sprintf("kernels/%s/%s", version, file)
-				localPath := filepath.Join(kernelDir, file)
-
-				valid, err := m.validateCachedFile(localPath, remotePath)
-				if err != nil || !valid {
-					allValid = false
-					break
-				}
-			}
-
-			if allValid {
-				fmt.Printf("Kernel %s already cached and valid\n", version)
-				return nil
-			}
-			fmt.Printf("Kernel %s cache invalid, re-downloading...\n", version)
-			os.RemoveAll(kernelDir)
-		}
+func (m *Manager) downloadFile(ctx context.Context, remotePath, localPath string) error {
+	var want *config.IndexFile
+	if sum, ok := m.checksums()[remotePath]; ok {
+		want = &sum
 	}
+	return m.fromSources(remotePath, func(src repo.Source) error {
+		return m.fetch(ctx, src.FileURL(remotePath), localPath, filepath.Base(localPath), sourceHeader(src, nil), want)
+	})
+}
 
-	fmt.Printf("Downloading kernel %s...\n", version)
-
-	files, err := m.listDirectory(fmt.Sprintf("kernels/%s", version))
+// DownloadKernel fetches the bundle of a kernel version into the cache. It
+// fails when the boot files, the modules or, if vendor is set, the
+// vendor's device trees cannot be downloaded; other files are skipped with
+// a warning.
+func (m *Manager) DownloadKernel(ctx context.Context, version, vendor string) error {
+	unlock, err := m.lockCache(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to list kernel files: %w", err)
+		return err
 	}
+	defer unlock()
 
-	for _, file := range files {
-		remotePath := fmt.Sprintf("kernels/%s/%s", version, file)
-		localPath := filepath.Join(kernelDir, file)
+	cacheDir := m.cacheDir()
+	kernelDir := filepath.Join(cacheDir, "kernels", version)
 
-		if err := m.DownloadFile(remotePath, localPath); err != nil {
-			fmt.Printf("Warning: failed to download %s: %v\n", file, err)
+	remoteDir := fmt.Sprintf("kernels/%s", version)
+	files := m.indexedFiles(remoteDir)
+	required := kernelRequired(version, vendor)
+	if len(files) > 0 {
+		if err := missingKernelFile(version, files, required); err != nil {
+			return err
 		}
 	}
 
-	return nil
-}
+	ok, err := m.useCached(ctx, Artifact{Kind: KindKernel, Name: version, Vendor: vendor}, m.kernelStatus(ctx, version, vendor))
+	if ok || err != nil {
+		return err
+	}
+	os.RemoveAll(kernelDir)
 
-func (m *Manager) DownloadRootfs(name string) error {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	localPath := filepath.Join(cacheDir, "rootfs", name)
-	remotePath := fmt.Sprintf("rootfs/%s", name)
+	m.info("Downloading kernel %s...", version)
 
-	if _, err := os.Stat(localPath); err == nil {
-		valid, err := m.validateCachedFile(localPath, remotePath)
-		if err == nil && valid {
-			fmt.Printf("Rootfs %s already cached and valid\n", name)
-			return nil
+	dm := m
+	if len(files) == 0 {
+		listed, src, err := m.listDirectory(ctx, remoteDir)
+		if err != nil {
+			return fmt.Errorf("failed to list kernel files: %w", err)
 		}
-		fmt.Printf("Rootfs %s cache invalid, re-downloading...\n", name)
-		os.Remove(localPath)
+		if err := missingKernelFile(version, listed, required); err != nil {
+			return err
+		}
+		files = listed
+		dm = m.pinned(src)
 	}
 
-	fmt.Printf("Downloading rootfs %s...\n", name)
-	return m.DownloadFile(remotePath, localPath)
-}
+	// Fill a staging directory so other builds never see a half
+	// downloaded kernel. It survives an interrupted run, so the next one
+	// resumes the files that were in progress.
+	stagingDir := kernelDir + ".partial"
+	if err := pruneStaging(stagingDir, files); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", stagingDir, err)
+	}
 
-func (m *Manager) GetKernelPath(version string) string {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	return filepath.Join(cacheDir, "kernels", version)
-}
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return err
+	}
+	if err := dm.downloadBundle(ctx, fmt.Sprintf("kernel-%s", version), remoteDir, stagingDir, files, func(file string) bool {
+		return slices.Contains(required, file)
+	}); err != nil {
+		return err
+	}
 
-func (m *Manager) GetRootfsPath(name string) string {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	return filepath.Join(cacheDir, "rootfs", name)
+	if err := os.RemoveAll(kernelDir); err != nil {
+		return err
+	}
+	if err := os.Rename(stagingDir, kernelDir); err != nil {
+		return fmt.Errorf("failed to move kernel into cache: %w", err)
+	}
+	return nil
 }
 
-func (m *Manager) DownloadLoader(vendor, device string) error {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	loaderDir := filepath.Join(cacheDir, "loader", vendor)
-
-	if _, err := os.Stat(loaderDir); err == nil {
-		fmt.Printf("Loader files for %s already cached\n", vendor)
+// pruneStaging removes everything in dir but files and their partial
+// downloads, which are kept to be checked or resumed.
+func pruneStaging(dir string, files []string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
 		return nil
 	}
-
-	fmt.Printf("Downloading loader folder for %s from GitHub...\n", vendor)
-
-	owner := m.getOwner(repo.URL)
-	repoName := m.getRepo(repo.URL)
-
-	archiveURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/zipball/%s",
-		owner, repoName, repo.Branch)
-
-	req, err := http.NewRequest("GET", archiveURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-
-	resp, err := m.Client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to download archive: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download archive: HTTP %d", resp.StatusCode)
+	keep := map[string]bool{}
+	for _, file := range files {
+		keep[file] = true
+		keep[file+".part"] = true
+		keep[file+".part.etag"] = true
+	}
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	tempZip := filepath.Join(cacheDir, "temp_loader.zip")
-	out, err := os.Create(tempZip)
+func (m *Manager) DownloadRootfs(ctx context.Context, name string) error {
+	unlock, err := m.lockCache(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return err
 	}
+	defer unlock()
 
-	bar := progressbar.DefaultBytes(
-		resp.ContentLength,
-		fmt.Sprintf("loader-%s.zip", vendor),
-	)
-
-	_, err = io.Copy(io.MultiWriter(out, bar), resp.Body)
-	out.Close()
-	fmt.Println()
+	cacheDir := m.cacheDir()
+	localPath := filepath.Join(cacheDir, "rootfs", name)
+	remotePath := fmt.Sprintf("rootfs/%s", name)
 
-	if err != nil {
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to download: %w", err)
+	a := Artifact{Kind: KindRootfs, Name: name}
+	ok, err := m.useCached(ctx, a, m.cacheStatus(ctx, a))
+	if ok || err != nil {
+		return err
 	}
+	os.Remove(localPath)
 
-	fmt.Println("Extracting loader files...")
-	tempExtract := filepath.Join(cacheDir, "temp_loader_extract")
-	if err := m.extractZip(tempZip, tempExtract); err != nil {
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to extract: %w", err)
-	}
+	m.info("Downloading rootfs %s...", name)
+	return m.downloadFile(ctx, remotePath, localPath)
+}
 
-	entries, err := os.ReadDir(tempExtract)
+func (m *Manager) DownloadPatch(ctx context.Context, name string) error {
+	unlock, err := m.lockCache(ctx)
 	if err != nil {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to read extracted dir: %w", err)
-	}
-
-	if len(entries) == 0 {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("no files extracted")
+		return err
 	}
+	defer unlock()
 
-	repoRoot := filepath.Join(tempExtract, entries[0].Name())
-	loaderSrc := filepath.Join(repoRoot, "loader", vendor)
-
-	if _, err := os.Stat(loaderSrc); os.IsNotExist(err) {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("loader/%s folder not found in archive", vendor)
-	}
+	cacheDir := m.cacheDir()
+	localPath := filepath.Join(cacheDir, "patch", name)
+	remotePath := fmt.Sprintf("patch/%s", name)
 
-	if err := os.MkdirAll(filepath.Dir(loaderDir), 0755); err != nil {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
+	a := Artifact{Kind: KindPatch, Name: name}
+	ok, err := m.useCached(ctx, a, m.cacheStatus(ctx, a))
+	if ok || err != nil {
 		return err
 	}
+	os.Remove(localPath)
 
-	if err := os.Rename(loaderSrc, loaderDir); err != nil {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to move loader: %w", err)
-	}
-
-	os.RemoveAll(tempExtract)
-	os.Remove(tempZip)
-
-	fmt.Printf("✓ Loader for %s downloaded and extracted\n", vendor)
-	return nil
+	m.info("Downloading patch %s...", name)
+	return m.downloadFile(ctx, remotePath, localPath)
 }
 
-func (m *Manager) GetLoaderPath(vendor, device string) string {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	return filepath.Join(cacheDir, "loader", vendor)
+// cacheDir is where downloads are kept.
+func (m *Manager) cacheDir() string {
+	return m.Config.CacheDir()
 }
 
-func (m *Manager) DownloadFirmware() error {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	firmwareDir := filepath.Join(cacheDir, "firmware")
-
-	if _, err := os.Stat(firmwareDir); err == nil {
-		fmt.Println("Firmware files already cached")
-		return nil
-	}
-
-	fmt.Println("Downloading firmware folder from GitHub...")
+func (m *Manager) GetKernelPath(version string) string {
+	return filepath.Join(m.cacheDir(), "kernels", version)
+}
 
-	owner := m.getOwner(repo.URL)
-	repoName := m.getRepo(repo.URL)
+func (m *Manager) GetRootfsPath(name string) string {
+	return filepath.Join(m.cacheDir(), "rootfs", name)
+}
 
-	archiveURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/zipball/%s",
-		owner, repoName, repo.Branch)
+func (m *Manager) GetPatchPath(name string) string {
+	return filepath.Join(m.cacheDir(), "patch", name)
+}
 
-	req, err := http.NewRequest("GET", archiveURL, nil)
+func (m *Manager) DownloadLoader(ctx context.Context, vendor, device string) error {
+	unlock, err := m.lockCache(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	defer unlock()
 
-	resp, err := m.Client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to download archive: %w", err)
-	}
-	defer resp.Body.Close()
+	cacheDir := m.cacheDir()
+	loaderDir := filepath.Join(cacheDir, "loader", vendor)
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download archive: HTTP %d", resp.StatusCode)
+	a := Artifact{Kind: KindLoader, Name: vendor}
+	ok, err := m.useCached(ctx, a, m.cacheStatus(ctx, a))
+	if ok || err != nil {
+		return err
 	}
+	os.RemoveAll(loaderDir)
 
-	tempZip := filepath.Join(cacheDir, "temp_firmware.zip")
-	out, err := os.Create(tempZip)
+	m.info("Downloading loader folder for %s...", vendor)
+	err = m.downloadFolder(ctx, "loader/"+vendor, loaderDir, fmt.Sprintf("loader-%s", vendor), func(dir string) error {
+		if err := m.verifyLoader(ctx, vendor, dir); err != nil {
+			return fmt.Errorf("downloaded loader for %s does not match the index: %w", vendor, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return err
 	}
 
-	bar := progressbar.DefaultBytes(
-		resp.ContentLength,
-		"firmware.zip",
-	)
+	m.step("Loader for %s downloaded and extracted", vendor)
+	return nil
+}
 
-	_, err = io.Copy(io.MultiWriter(out, bar), resp.Body)
-	out.Close()
-	fmt.Println()
+// verifyLoader checks the loader files of vendor in dir against the index.
+func (m *Manager) verifyLoader(ctx context.Context, vendor, dir string) error {
+	return m.verifyFolder(ctx, "loader/"+vendor, dir)
+}
 
-	if err != nil {
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to download: %w", err)
+// verifyFolder checks the files the index lists below remoteDir in dir.
+func (m *Manager) verifyFolder(ctx context.Context, remoteDir, dir string) error {
+	for _, file := range m.indexedFiles(remoteDir) {
+		if err := m.verifyCached(ctx, filepath.Join(dir, filepath.FromSlash(file)), remoteDir+"/"+file); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
 	}
+	return nil
+}
 
-	fmt.Println("Extracting firmware files...")
-	tempExtract := filepath.Join(cacheDir, "temp_extract")
-	if err := m.extractZip(tempZip, tempExtract); err != nil {
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to extract: %w", err)
-	}
+func (m *Manager) GetLoaderPath(vendor, device string) string {
+	return filepath.Join(m.cacheDir(), "loader", vendor)
+}
 
-	entries, err := os.ReadDir(tempExtract)
+func (m *Manager) DownloadFirmware(ctx context.Context) error {
+	unlock, err := m.lockCache(ctx)
 	if err != nil {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to read extracted dir: %w", err)
-	}
-
-	if len(entries) == 0 {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("no files extracted")
+		return err
 	}
+	defer unlock()
 
-	repoRoot := filepath.Join(tempExtract, entries[0].Name())
-	firmwareSrc := filepath.Join(repoRoot, "firmware")
+	cacheDir := m.cacheDir()
+	firmwareDir := filepath.Join(cacheDir, "firmware")
 
-	if _, err := os.Stat(firmwareSrc); os.IsNotExist(err) {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("firmware folder not found in archive")
+	a := Artifact{Kind: KindFirmware}
+	ok, err := m.useCached(ctx, a, m.cacheStatus(ctx, a))
+	if ok || err != nil {
+		return err
 	}
+	os.RemoveAll(firmwareDir)
 
-	if err := os.Rename(firmwareSrc, firmwareDir); err != nil {
-		os.RemoveAll(tempExtract)
-		os.Remove(tempZip)
-		return fmt.Errorf("failed to move firmware: %w", err)
+	m.info("Downloading firmware folder...")
+	err = m.downloadFolder(ctx, "firmware", firmwareDir, "firmware", func(dir string) error {
+		if err := m.verifyFolder(ctx, "firmware", dir); err != nil {
+			return fmt.Errorf("downloaded firmware does not match the index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	os.RemoveAll(tempExtract)
-	os.Remove(tempZip)
-
-	fmt.Println("✓ Firmware downloaded and extracted")
+	m.step("Firmware downloaded and extracted")
 	return nil
 }
 
 func (m *Manager) GetFirmwarePath() string {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
-	return filepath.Join(cacheDir, "firmware")
+	return filepath.Join(m.cacheDir(), "firmware")
 }
 
-func (m *Manager) ValidateCache() error {
-	repo := m.Config.Repositories["data"]
-	cacheDir := repo.CacheDir()
+// ValidateCache checks every cached kernel, rootfs, patch and loader file
+// against the checksums in the local indexes, without network access.
+// Files that do not match are removed, so they are downloaded again on
+// next use.
+func (m *Manager) ValidateCache(ctx context.Context) error {
+	cacheDir := m.cacheDir()
 
-	fmt.Println("\n🔍 Validating cached files...")
+	m.report(report.Event{Kind: report.CacheCheckStarted, Message: "Validating cached files..."})
 
 	validCount := 0
 	invalidCount := 0
+	unverifiedCount := 0
+
+	// result reports the outcome for one artifact.
+	result := func(a Artifact, status string, err error) {
+		e := report.Event{Kind: report.CacheChecked, File: a.String(), Status: status}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		m.report(e)
+	}
+
+	// check verifies one file and reports whether it is usable.
+	check := func(localPath, remotePath string) (bool, error) {
+		err := m.verifyCached(ctx, localPath, remotePath)
+		switch {
+		case err == nil:
+			validCount++
+			return true, nil
+		case errors.Is(err, errNotIndexed):
+			unverifiedCount++
+			return true, err
+		default:
+			invalidCount++
+			return false, err
+		}
+	}
 
 	kernelsDir := filepath.Join(cacheDir, "kernels")
-	if _, err := os.Stat(kernelsDir); err == nil {
-		entries, _ := os.ReadDir(kernelsDir)
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			version := entry.Name()
-			files, err := m.listDirectory(fmt.Sprintf("kernels/%s", version))
-			if err != nil {
-				continue
-			}
+	entries, _ := os.ReadDir(kernelsDir)
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasSuffix(entry.Name(), ".partial") {
+			continue
+		}
+		version := entry.Name()
+		a := Artifact{Kind: KindKernel, Name: version}
+		remoteDir := fmt.Sprintf("kernels/%s", version)
+		files := m.indexedFiles(remoteDir)
+		if len(files) == 0 {
+			unverifiedCount++
+			result(a, report.CacheUnverified, errNotIndexed)
+			continue
+		}
 
-			allValid := true
-			for _, file := range files {
-				remotePath := fmt.Sprintf("kernels/%s/%s", version, file)
-				localPath := filepath.Join(kernelsDir, version, file)
-
-				valid, err := m.validateCachedFile(localPath, remotePath)
-				if err != nil || !valid {
-					allValid = false
-					invalidCount++
-				} else {
-					validCount++
-				}
+		var problem error
+		for _, file := range files {
+			localPath := filepath.Join(kernelsDir, version, file)
+			if _, err := os.Stat(localPath); errors.Is(err, fs.ErrNotExist) {
+				// Device trees of other vendors may have been skipped.
+				continue
 			}
-
-			if allValid {
-				fmt.Printf("   ✓ Kernel %s: valid\n", version)
-			} else {
-				fmt.Printf("   ✗ Kernel %s: invalid (will re-download on next use)\n", version)
+			if ok, err := check(localPath, remoteDir+"/"+file); !ok {
+				problem = fmt.Errorf("%s: %w", file, err)
+				break
 			}
 		}
+		if problem != nil {
+			result(a, report.CacheInvalid, problem)
+			os.RemoveAll(filepath.Join(kernelsDir, version))
+		} else {
+			result(a, report.CacheValid, nil)
+		}
 	}
 
-	rootfsDir := filepath.Join(cacheDir, "rootfs")
-	if _, err := os.Stat(rootfsDir); err == nil {
-		entries, _ := os.ReadDir(rootfsDir)
+	for _, kind := range []string{KindRootfs, KindPatch} {
+		entries, _ := os.ReadDir(filepath.Join(cacheDir, kind))
 		for _, entry := range entries {
-			if entry.IsDir() {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".part.etag") {
 				continue
 			}
-			name := entry.Name()
-			remotePath := fmt.Sprintf("rootfs/%s", name)
-			localPath := filepath.Join(rootfsDir, name)
-
-			valid, err := m.validateCachedFile(localPath, remotePath)
-			if err != nil || !valid {
-				fmt.Printf("   ✗ Rootfs %s: invalid\n", name)
-				invalidCount++
-			} else {
-				fmt.Printf("   ✓ Rootfs %s: valid\n", name)
-				validCount++
+			a := Artifact{Kind: kind, Name: name}
+			localPath := filepath.Join(cacheDir, kind, name)
+
+			ok, err := check(localPath, kind+"/"+name)
+			switch {
+			case !ok:
+				result(a, report.CacheInvalid, err)
+				os.Remove(localPath)
+			case err != nil:
+				result(a, report.CacheUnverified, err)
+			default:
+				result(a, report.CacheValid, nil)
 			}
 		}
 	}
 
-	loaderArchives := []string{"amlogic.tar.gz", "allwinner.tar.gz", "rockchip.tar.gz"}
-	for _, archive := range loaderArchives {
-		archivePath := filepath.Join(cacheDir, "loader", archive)
-		if _, err := os.Stat(archivePath); err == nil {
-			remotePath := fmt.Sprintf("loader/%s", archive)
-			valid, err := m.validateCachedFile(archivePath, remotePath)
-			if err != nil || !valid {
-				fmt.Printf("   ✗ Loader %s: invalid\n", archive)
-				invalidCount++
-			} else {
-				fmt.Printf("   ✓ Loader %s: valid\n", archive)
-				validCount++
-			}
+	loaderDir := filepath.Join(cacheDir, "loader")
+	entries, _ = os.ReadDir(loaderDir)
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), "temp_") {
+			continue
 		}
-	}
-
-	firmwareArchive := filepath.Join(cacheDir, "firmware.tar.gz")
-	if _, err := os.Stat(firmwareArchive); err == nil {
-		valid, err := m.validateCachedFile(firmwareArchive, "firmware.tar.gz")
-		if err != nil || !valid {
-			fmt.Println("   ✗ Firmware: invalid")
+		vendor := entry.Name()
+		a := Artifact{Kind: KindLoader, Name: vendor}
+		err := m.verifyLoader(ctx, vendor, filepath.Join(loaderDir, vendor))
+		switch {
+		case len(m.indexedFiles("loader/"+vendor)) == 0:
+			unverifiedCount++
+			result(a, report.CacheUnverified, errNotIndexed)
+		case err != nil:
 			invalidCount++
-		} else {
-			fmt.Println("   ✓ Firmware: valid")
+			result(a, report.CacheInvalid, err)
+			os.RemoveAll(filepath.Join(loaderDir, vendor))
+		default:
 			validCount++
+			result(a, report.CacheValid, nil)
 		}
 	}
 
-	fmt.Printf("\n📊 Cache validation summary:\n")
-	fmt.Printf("   Valid files: %d\n", validCount)
-	fmt.Printf("   Invalid files: %d\n", invalidCount)
-
-	if invalidCount > 0 {
-		fmt.Println("\n💡 Invalid files will be automatically re-downloaded on next use")
-	}
-
-	return nil
-}
-
-func (m *Manager) listDirectoryRecursive(path string) ([]string, error) {
-	var allFiles []string
-
-	items, err := m.listDirectoryItems(path)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, item := range items {
-		itemPath := fmt.Sprintf("%s/%s", path, item.Name)
-
-		if item.Type == "file" {
-			allFiles = append(allFiles, itemPath)
-		} else if item.Type == "dir" {
-			subFiles, err := m.listDirectoryRecursive(itemPath)
-			if err != nil {
-				fmt.Printf("Warning: failed to scan directory %s: %v\n", itemPath, err)
-				continue
-			}
-			allFiles = append(allFiles, subFiles...)
-		}
-	}
-
-	return allFiles, nil
-}
-
-func (m *Manager) listDirectory(path string) ([]string, error) {
-	repo := m.Config.Repositories["data"]
-	owner := m.getOwner(repo.URL)
-	repoName := m.getRepo(repo.URL)
-
-	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s",
-		owner, repoName, path, repo.Branch)
-
-	resp, err := m.Client.Get(apiURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list directory: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to list directory: HTTP %d", resp.StatusCode)
-	}
-
-	var items []githubContent
-	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	var files []string
-	for _, item := range items {
-		if item.Type == "file" {
-			files = append(files, item.Name)
+	firmwareDir := filepath.Join(cacheDir, "firmware")
+	if _, err := os.Stat(firmwareDir); err == nil {
+		a := Artifact{Kind: KindFirmware}
+		err := m.verifyFolder(ctx, "firmware", firmwareDir)
+		switch {
+		case len(m.indexedFiles("firmware")) == 0:
+			unverifiedCount++
+			result(a, report.CacheUnverified, errNotIndexed)
+		case err != nil:
+			invalidCount++
+			result(a, report.CacheInvalid, err)
+			os.RemoveAll(firmwareDir)
+		default:
+			validCount++
+			result(a, report.CacheValid, nil)
 		}
 	}
 
-	return files, nil
-}
-
-func (m *Manager) listDirectoryItems(path string) ([]githubContent, error) {
-	repo := m.Config.Repositories["data"]
-	owner := m.getOwner(repo.URL)
-	repoName := m.getRepo(repo.URL)
-
-	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s",
-		owner, repoName, path, repo.Branch)
-
-	resp, err := m.Client.Get(apiURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list directory: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to list directory: HTTP %d", resp.StatusCode)
-	}
-
-	var items []githubContent
-	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return items, nil
-}
-
-func (m *Manager) getOwner(url string) string {
-	parts := filepath.Base(filepath.Dir(url))
-	return parts
-}
-
-func (m *Manager) getRepo(url string) string {
-	return filepath.Base(url)
-}
-
-func (m *Manager) getRemoteFileMetadata(remotePath string) (*FileMetadata, error) {
-	repo := m.Config.Repositories["data"]
-	owner := m.getOwner(repo.URL)
-	repoName := m.getRepo(repo.URL)
-
-	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s",
-		owner, repoName, remotePath, repo.Branch)
-
-	resp, err := m.Client.Get(apiURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get file metadata: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get file metadata: HTTP %d", resp.StatusCode)
-	}
-
-	var content githubContent
-	if err := json.NewDecoder(resp.Body).Decode(&content); err != nil {
-		return nil, fmt.Errorf("failed to decode metadata: %w", err)
-	}
-
-	return &FileMetadata{
-		Name: content.Name,
-		Size: int64(content.Size),
-		Path: content.Path,
-	}, nil
-}
-
-func (m *Manager) validateCachedFile(localPath, remotePath string) (bool, error) {
-	fileInfo, err := os.Stat(localPath)
-	if os.IsNotExist(err) {
-		return false, nil
-	}
-	if err != nil {
-		return false, fmt.Errorf("failed to stat file: %w", err)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	metadata, err := m.getRemoteFileMetadata(remotePath)
-	if err != nil {
-		return false, fmt.Errorf("failed to get remote metadata: %w", err)
+	summary := fmt.Sprintf("Cache validation: %d valid, %d invalid", validCount, invalidCount)
+	if unverifiedCount > 0 {
+		summary += fmt.Sprintf(", %d not in index", unverifiedCount)
 	}
-
-	if fileInfo.Size() != metadata.Size {
-		return false, nil
+	m.report(report.Event{Kind: report.CacheCheckFinished, Message: summary, Count: invalidCount})
+	if invalidCount > 0 {
+		m.info("💡 Invalid files were removed and will be downloaded again on next use")
 	}
 
-	return true, nil
+	return nil
 }
 
 func (m *Manager) extractTarGz(archivePath, destDir string) error {
@@ -685,7 +587,7 @@ func (m *Manager) extractTarGz(archivePath, destDir string) error {
 	return nil
 }
 
-func (m *Manager) extractZip(archivePath, destDir string) error {
+func (m *Manager) extractZip(ctx context.Context, archivePath, destDir string) error {
 	r, err := zip.OpenReader(archivePath)
 	if err != nil {
 		return fmt.Errorf("failed to open zip: %w", err)
@@ -693,6 +595,9 @@ func (m *Manager) extractZip(archivePath, destDir string) error {
 	defer r.Close()
 
 	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		target := filepath.Join(destDir, f.Name)
 
 		if f.FileInfo().IsDir() {
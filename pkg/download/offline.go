@@ -0,0 +1,219 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Artifact is something a build takes from the download cache. Name is
+// the kernel version, file name or vendor, and empty for the firmware.
+// Vendor, for a kernel, selects the device tree archive the build needs.
+type Artifact struct {
+	Kind   string
+	Name   string
+	Vendor string
+}
+
+const (
+	KindKernel   = "kernel"
+	KindRootfs   = "rootfs"
+	KindPatch    = "patch"
+	KindLoader   = "loader"
+	KindFirmware = "firmware"
+)
+
+func (a Artifact) String() string {
+	if a.Name == "" {
+		return a.Kind
+	}
+	return a.Kind + " " + a.Name
+}
+
+var errOffline = errors.New("offline mode: the data repository cannot be contacted")
+
+// MissingError lists the artifacts an offline manager needs but does not
+// have in a usable state.
+type MissingError struct {
+	Missing []string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("offline mode: %d artifact(s) not available in the cache:\n   - %s",
+		len(e.Missing), strings.Join(e.Missing, "\n   - "))
+}
+
+func missing(a Artifact, err error) string {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Sprintf("%s: not downloaded", a)
+	}
+	return fmt.Sprintf("%s: %v", a, err)
+}
+
+// CheckCached checks that every artifact is in the cache and matches the
+// index, without network access. The error lists all that are not.
+func (m *Manager) CheckCached(ctx context.Context, artifacts []Artifact) error {
+	var problems []string
+	for _, a := range artifacts {
+		err := m.cacheStatus(ctx, a)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && !errors.Is(err, errNotIndexed) {
+			problems = append(problems, missing(a, err))
+		}
+	}
+	if len(problems) > 0 {
+		return &MissingError{Missing: problems}
+	}
+	return nil
+}
+
+// cacheStatus returns nil when the cached artifact matches the index,
+// errNotIndexed when it is present but cannot be checked, an
+// fs.ErrNotExist error when it is missing and another error when it is
+// damaged.
+func (m *Manager) cacheStatus(ctx context.Context, a Artifact) error {
+	cacheDir := m.cacheDir()
+
+	switch a.Kind {
+	case KindKernel:
+		return m.kernelStatus(ctx, a.Name, a.Vendor)
+	case KindRootfs, KindPatch:
+		return m.verifyCached(ctx, filepath.Join(cacheDir, a.Kind, a.Name), a.Kind+"/"+a.Name)
+	case KindLoader:
+		loaderDir := filepath.Join(cacheDir, "loader", a.Name)
+		if _, err := os.Stat(loaderDir); err != nil {
+			return err
+		}
+		if len(m.indexedFiles("loader/"+a.Name)) == 0 {
+			return errNotIndexed
+		}
+		return m.verifyLoader(ctx, a.Name, loaderDir)
+	case KindFirmware:
+		firmwareDir := filepath.Join(cacheDir, "firmware")
+		if _, err := os.Stat(firmwareDir); err != nil {
+			return err
+		}
+		if len(m.indexedFiles("firmware")) == 0 {
+			return errNotIndexed
+		}
+		return m.verifyFolder(ctx, "firmware", firmwareDir)
+	}
+	return fmt.Errorf("unknown artifact kind %q", a.Kind)
+}
+
+func (m *Manager) kernelStatus(ctx context.Context, version, vendor string) error {
+	kernelDir := m.GetKernelPath(version)
+	if _, err := os.Stat(kernelDir); err != nil {
+		return err
+	}
+
+	remoteDir := fmt.Sprintf("kernels/%s", version)
+	files := m.indexedFiles(remoteDir)
+	if len(files) == 0 {
+		return errNotIndexed
+	}
+	required := kernelRequired(version, vendor)
+	if err := missingKernelFile(version, files, required); err != nil {
+		return err
+	}
+	for _, file := range files {
+		err := m.verifyCached(ctx, filepath.Join(kernelDir, file), remoteDir+"/"+file)
+		if errors.Is(err, fs.ErrNotExist) && !slices.Contains(required, file) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// useCached reports whether the cached copy of a can be used, given its
+// cacheStatus. When offline, an unusable copy is a MissingError; otherwise
+// the caller downloads it again.
+func (m *Manager) useCached(ctx context.Context, a Artifact, status error) (bool, error) {
+	label := strings.ToUpper(a.Kind[:1]) + a.String()[1:]
+	switch {
+	case status == nil:
+		m.info("%s already cached and valid", label)
+		return true, nil
+	case errors.Is(status, errNotIndexed):
+		m.info("%s already cached (%v)", label, status)
+		return true, nil
+	case ctx.Err() != nil:
+		return false, ctx.Err()
+	case m.Offline:
+		return false, &MissingError{Missing: []string{missing(a, status)}}
+	case !errors.Is(status, fs.ErrNotExist):
+		m.info("%s cache invalid (%v), re-downloading...", label, status)
+	}
+	return false, nil
+}
+
+// Cache states reported by CacheState.
+const (
+	CacheMissing = "missing"
+	CachePartial = "partial"
+	CacheCached  = "cached"
+)
+
+// CacheState tells whether a kernel, rootfs or patch is in the cache by
+// comparing file sizes with the index instead of hashing, so it is cheap
+// enough to ask for every entry of a listing. An interrupted download, or
+// a file whose size does not match the index, is partial.
+func (m *Manager) CacheState(a Artifact) string {
+	switch a.Kind {
+	case KindKernel:
+		kernelDir := m.GetKernelPath(a.Name)
+		if _, err := os.Stat(kernelDir); err != nil {
+			if _, err := os.Stat(kernelDir + ".partial"); err == nil {
+				return CachePartial
+			}
+			return CacheMissing
+		}
+		remoteDir := "kernels/" + a.Name
+		required := kernelRequired(a.Name, a.Vendor)
+		files := m.indexedFiles(remoteDir)
+		for _, file := range required {
+			if !slices.Contains(files, file) {
+				files = append(files, file)
+			}
+		}
+		for _, file := range files {
+			state := m.fileState(filepath.Join(kernelDir, file), remoteDir+"/"+file)
+			if state == CacheMissing && !slices.Contains(required, file) {
+				continue
+			}
+			if state != CacheCached {
+				return CachePartial
+			}
+		}
+		return CacheCached
+	case KindRootfs:
+		return m.fileState(m.GetRootfsPath(a.Name), "rootfs/"+a.Name)
+	case KindPatch:
+		return m.fileState(m.GetPatchPath(a.Name), "patch/"+a.Name)
+	}
+	return CacheMissing
+}
+
+func (m *Manager) fileState(localPath, remotePath string) string {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		if _, err := os.Stat(localPath + ".part"); err == nil {
+			return CachePartial
+		}
+		return CacheMissing
+	}
+	if want, ok := m.checksums()[remotePath]; ok && want.Size != info.Size() {
+		return CachePartial
+	}
+	return CacheCached
+}
@@ -0,0 +1,250 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/repo"
+)
+
+// loadSources makes a source for every repository in the config, in
+// priority order, and reads which repository each indexed artifact came
+// from. m.Source, when set, replaces them all.
+func (m *Manager) loadSources() error {
+	m.sourceOnce.Do(func() {
+		if m.Source != nil {
+			m.sources = []repo.Source{m.Source}
+			return
+		}
+
+		named := map[string]repo.Source{}
+		for _, name := range m.Config.RepositoryNames() {
+			r := m.Config.Repositories[name]
+			dir := r.Path
+			if r.Type == "local" {
+				dir = m.Config.LocalDir(r)
+			}
+			src, err := repo.NewSource(r.Type, r.URL, r.Branch, dir, r.Token)
+			if err != nil {
+				m.sourceErr = fmt.Errorf("invalid repository %s: %w", name, err)
+				return
+			}
+			switch src := src.(type) {
+			case *repo.GitHubClient:
+				src.Client = m.Client
+				src.RateLimitWait = m.RateLimitWait
+				src.OnRateLimit = func(wait time.Duration) {
+					m.warn("GitHub rate limit reached, waiting %s", wait.Round(time.Second))
+				}
+			case *repo.MirrorSource:
+				src.Client = m.Client
+			}
+			named[name] = src
+			m.sources = append(m.sources, src)
+		}
+		if len(m.sources) == 0 {
+			m.sourceErr = fmt.Errorf("no data repository configured")
+			return
+		}
+
+		origins, err := m.Config.Origins()
+		if err != nil {
+			m.warn("cannot read repository of indexed files: %v", err)
+		}
+		m.origins = map[string]repo.Source{}
+		for p, name := range origins {
+			if src, ok := named[name]; ok {
+				m.origins[p] = src
+			}
+		}
+	})
+	return m.sourceErr
+}
+
+// sourceHeader returns header with what downloads from src need added:
+// the token of a GitHub source.
+func sourceHeader(src repo.Source, header http.Header) http.Header {
+	gh, ok := src.(*repo.GitHubClient)
+	if !ok || gh.Token == "" {
+		return header
+	}
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Authorization", "Bearer "+gh.Token)
+	return header
+}
+
+// sourcesFor returns the sources to try for remotePath: the repository
+// the local index took it from, or every repository by priority when the
+// index does not say.
+func (m *Manager) sourcesFor(remotePath string) ([]repo.Source, error) {
+	if err := m.loadSources(); err != nil {
+		return nil, err
+	}
+	for p := path.Clean(remotePath); p != "." && p != "/"; p = path.Dir(p) {
+		if src, ok := m.origins[p]; ok {
+			return []repo.Source{src}, nil
+		}
+	}
+	return m.sources, nil
+}
+
+// fromSources calls fn with the sources for remotePath until one of them
+// has it, that is until fn returns something other than a not found error.
+func (m *Manager) fromSources(remotePath string, fn func(src repo.Source) error) error {
+	sources, err := m.sourcesFor(remotePath)
+	if err != nil {
+		return err
+	}
+	for _, src := range sources {
+		if err = fn(src); !errors.Is(err, repo.ErrNotFound) {
+			return err
+		}
+	}
+	return err
+}
+
+// listDirectory lists the files in dir, from the first repository that
+// has it, and returns that repository too.
+func (m *Manager) listDirectory(ctx context.Context, dir string) ([]string, repo.Source, error) {
+	var (
+		items []repo.GitHubContent
+		from  repo.Source
+	)
+	err := m.fromSources(dir, func(src repo.Source) error {
+		var err error
+		items, err = m.listDirectoryItems(ctx, src, dir)
+		from = src
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []string
+	for _, item := range items {
+		if item.Type == "file" {
+			files = append(files, item.Name)
+		}
+	}
+	return files, from, nil
+}
+
+func (m *Manager) listDirectoryItems(ctx context.Context, src repo.Source, path string) ([]repo.GitHubContent, error) {
+	if m.Offline {
+		return nil, errOffline
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	items, err := src.ListContents(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %w", err)
+	}
+	return items, nil
+}
+
+// listDirectoryRecursive returns the paths of all files below path,
+// relative to it.
+func (m *Manager) listDirectoryRecursive(ctx context.Context, src repo.Source, path string) ([]string, error) {
+	items, err := m.listDirectoryItems(ctx, src, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var allFiles []string
+	for _, item := range items {
+		switch item.Type {
+		case "file":
+			allFiles = append(allFiles, item.Name)
+		case "dir":
+			subFiles, err := m.listDirectoryRecursive(ctx, src, path+"/"+item.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range subFiles {
+				allFiles = append(allFiles, item.Name+"/"+f)
+			}
+		}
+	}
+	return allFiles, nil
+}
+
+// downloadFolder fetches everything below remoteDir into dest, from the
+// repository archive when the source has one and file by file otherwise.
+// check, when set, inspects the complete folder before it is moved to
+// dest.
+func (m *Manager) downloadFolder(ctx context.Context, remoteDir, dest, name string, check func(dir string) error) error {
+	return m.fromSources(remoteDir, func(src repo.Source) error {
+		return m.downloadFolderFrom(ctx, src, remoteDir, dest, name, check)
+	})
+}
+
+func (m *Manager) downloadFolderFrom(ctx context.Context, src repo.Source, remoteDir, dest, name string, check func(dir string) error) error {
+	cacheDir := filepath.Dir(dest)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+
+	tempExtract, err := os.MkdirTemp(cacheDir, "temp_"+filepath.Base(dest)+"_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempExtract)
+
+	var folder string
+	if archiver, ok := src.(repo.Archiver); ok {
+		tempZip := filepath.Join(cacheDir, fmt.Sprintf("temp_%s.zip", name))
+		defer os.Remove(tempZip)
+
+		header := sourceHeader(src, http.Header{"Accept": {"application/vnd.github.v3+json"}})
+		if err := m.fetch(ctx, archiver.ArchiveURL(), tempZip, name+".zip", header, nil); err != nil {
+			return fmt.Errorf("failed to download archive: %w", err)
+		}
+
+		m.info("Extracting %s files...", name)
+		if err := m.extractZip(ctx, tempZip, tempExtract); err != nil {
+			return fmt.Errorf("failed to extract: %w", err)
+		}
+
+		entries, err := os.ReadDir(tempExtract)
+		if err != nil {
+			return fmt.Errorf("failed to read extracted dir: %w", err)
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("no files extracted")
+		}
+		folder = filepath.Join(tempExtract, entries[0].Name(), filepath.FromSlash(remoteDir))
+		if _, err := os.Stat(folder); os.IsNotExist(err) {
+			return fmt.Errorf("%s folder: %w", remoteDir, repo.ErrNotFound)
+		}
+	} else {
+		files, err := m.listDirectoryRecursive(ctx, src, remoteDir)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", remoteDir, err)
+		}
+		folder = filepath.Join(tempExtract, "folder")
+		if err := m.pinned(src).downloadBundle(ctx, name, remoteDir, folder, files, func(string) bool { return true }); err != nil {
+			return err
+		}
+	}
+
+	if check != nil {
+		if err := check(folder); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(folder, dest); err != nil {
+		return fmt.Errorf("failed to move %s into cache: %w", remoteDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package download
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
+	"github.com/bobbyunknown/Oh-my-builder/pkg/repo"
+)
+
+// TestLocalSourceRelativePath checks that a relative local path is taken
+// from the checkout holding configs/, not the working directory.
+func TestLocalSourceRelativePath(t *testing.T) {
+	checkout := t.TempDir()
+	t.Chdir(t.TempDir())
+
+	m := testManager(t)
+	m.Config = &config.Config{
+		Dir: filepath.Join(checkout, "configs"),
+		Repositories: map[string]config.Repository{
+			"data":      {Type: "local", Path: "data"},
+			"overrides": {Type: "local", URL: "/srv/omb-overrides", Priority: 10},
+		},
+	}
+	if err := m.loadSources(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/srv/omb-overrides", filepath.Join(checkout, "data")}
+	if len(m.sources) != len(want) {
+		t.Fatalf("got %d sources, want %d", len(m.sources), len(want))
+	}
+	for i, src := range m.sources {
+		if dir := src.(*repo.LocalSource).Dir; dir != want[i] {
+			t.Errorf("source %d reads %s, want %s", i, dir, want[i])
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bobbyunknown/Oh-my-builder/pkg/config"
+)
+
+// errNotIndexed means the index has no checksum for a file, either because
+// it is not listed or because the index predates checksums.
+var errNotIndexed = errors.New("no checksum in index, run 'omb repo update'")
+
+// checksums returns the index entries by repository path. They are read
+// once per Manager; the indexes only change with 'omb repo update'.
+func (m *Manager) checksums() map[string]config.IndexFile {
+	m.sumsOnce.Do(func() {
+		sums, err := m.Config.Checksums()
+		if err != nil {
+			m.warn("cannot verify downloads: %v", err)
+			sums = map[string]config.IndexFile{}
+		}
+		m.sums = sums
+	})
+	return m.sums
+}
+
+// indexedFiles lists the files the index records below dir, by their path
+// relative to it.
+func (m *Manager) indexedFiles(dir string) []string {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	var files []string
+	for name := range m.checksums() {
+		if rel, ok := strings.CutPrefix(name, prefix); ok {
+			files = append(files, rel)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// verifyCached checks the cached file at localPath against the index entry
+// for remotePath, without any network access.
+func (m *Manager) verifyCached(ctx context.Context, localPath, remotePath string) error {
+	if _, err := os.Stat(localPath); err != nil {
+		return err
+	}
+	want, ok := m.checksums()[path.Clean(remotePath)]
+	if !ok {
+		return errNotIndexed
+	}
+	return verifyFile(ctx, localPath, want)
+}
+
+func verifyFile(ctx context.Context, localPath string, want config.IndexFile) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != want.Size {
+		return fmt.Errorf("size mismatch: %d bytes, index has %d", info.Size(), want.Size)
+	}
+
+	sum, err := fileSHA256(ctx, localPath)
+	if err != nil {
+		return err
+	}
+	if sum != want.SHA256 {
+		return fmt.Errorf("checksum mismatch: sha256 %s, index has %s", sum, want.SHA256)
+	}
+	return nil
+}
+
+func fileSHA256(ctx context.Context, localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, ctxReader{ctx, f}); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", localPath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
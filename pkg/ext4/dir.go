@@ -0,0 +1,124 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+)
+
+// DirEntry is one name in a directory.
+type DirEntry struct {
+	Name  string
+	Inode uint32
+}
+
+// ReadDir lists a directory without its "." and ".." entries, sorted by
+// name.
+func (fs *FS) ReadDir(dir *Inode) ([]DirEntry, error) {
+	if !dir.IsDir() {
+		return nil, fmt.Errorf("inode %d is not a directory", dir.Num)
+	}
+
+	f, err := fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, f.Size())
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, fmt.Errorf("failed to read directory %d: %w", dir.Num, err)
+	}
+
+	var entries []DirEntry
+	for off := 0; off+8 <= len(data); {
+		ino := binary.LittleEndian.Uint32(data[off:])
+		recLen := int(binary.LittleEndian.Uint16(data[off+4:]))
+		nameLen := int(binary.LittleEndian.Uint16(data[off+6:]))
+		if fs.incompat&incompatFiletype != 0 {
+			nameLen = int(data[off+6])
+		}
+		if recLen < 8 || off+recLen > len(data) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("corrupt directory entry in inode %d at offset %d", dir.Num, off)
+		}
+
+		name := string(data[off+8 : off+8+nameLen])
+		if ino != 0 && name != "." && name != ".." {
+			entries = append(entries, DirEntry{Name: name, Inode: ino})
+		}
+		off += recLen
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// Readlink returns the target of a symlink inode. Short targets live in the
+// inode itself ("fast" symlinks), longer ones in a data block.
+func (fs *FS) Readlink(inode *Inode) (string, error) {
+	if !inode.IsSymlink() {
+		return "", fmt.Errorf("inode %d is not a symlink", inode.Num)
+	}
+
+	dataBlocks := inode.blocks
+	if inode.fileACL != 0 {
+		dataBlocks -= uint64(fs.blockSize / 512)
+	}
+	fast := inode.Flags&inodeFlagInlineData != 0 || dataBlocks == 0
+	if fast && inode.Size < uint64(len(inode.block)) {
+		return string(inode.block[:inode.Size]), nil
+	}
+
+	f, err := fs.Open(inode)
+	if err != nil {
+		return "", err
+	}
+	target := make([]byte, inode.Size)
+	if _, err := io.ReadFull(f, target); err != nil {
+		return "", fmt.Errorf("failed to read symlink %d: %w", inode.Num, err)
+	}
+	return string(target), nil
+}
+
+// WalkFunc is called for every entry below the root with its slash
+// separated path relative to the root, e.g. "etc/passwd".
+type WalkFunc func(name string, inode *Inode) error
+
+// Walk visits the whole tree depth first, parents before children.
+func (fs *FS) Walk(fn WalkFunc) error {
+	root, err := fs.Inode(RootInode)
+	if err != nil {
+		return err
+	}
+	return fs.walk("", root, fn, map[uint32]bool{RootInode: true})
+}
+
+func (fs *FS) walk(dir string, inode *Inode, fn WalkFunc, seen map[uint32]bool) error {
+	entries, err := fs.ReadDir(inode)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		child, err := fs.Inode(entry.Inode)
+		if err != nil {
+			return err
+		}
+
+		name := path.Join(dir, entry.Name)
+		if err := fn(name, child); err != nil {
+			return err
+		}
+
+		if child.IsDir() {
+			if seen[child.Num] {
+				return fmt.Errorf("directory loop at %s", name)
+			}
+			seen[child.Num] = true
+			if err := fs.walk(name, child, fn, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package ext4
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// File reads the data of a regular file, directory or slow symlink.
+// Holes and uninitialized extents read as zeros.
+type File struct {
+	fs      *FS
+	inode   *Inode
+	extents []extent
+	offset  int64
+}
+
+// Open returns a reader for the data of inode.
+func (fs *FS) Open(inode *Inode) (*File, error) {
+	extents, err := fs.extents(inode)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].Logical < extents[j].Logical })
+	return &File{fs: fs, inode: inode, extents: extents}, nil
+}
+
+func (f *File) Size() int64 { return int64(f.inode.Size) }
+
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= f.Size() {
+		return 0, io.EOF
+	}
+
+	want := len(p)
+	if remaining := f.Size() - off; int64(want) > remaining {
+		want = int(remaining)
+	}
+
+	bs := f.fs.blockSize
+	n := 0
+	for n < want {
+		pos := off + int64(n)
+		logical := uint64(pos / bs)
+		within := pos % bs
+
+		chunk := want - n
+		e := f.find(logical)
+		if e == nil || e.Uninit {
+			// Zero-fill up to the next mapped extent.
+			if next, ok := f.nextMapped(logical); ok {
+				if limit := int64(next)*bs - pos; int64(chunk) > limit {
+					chunk = int(limit)
+				}
+			}
+			clear(p[n : n+chunk])
+			n += chunk
+			continue
+		}
+
+		runEnd := int64(e.Logical+e.Length) * bs
+		if limit := runEnd - pos; int64(chunk) > limit {
+			chunk = int(limit)
+		}
+		physical := int64(e.Physical+(logical-e.Logical))*bs + within
+		if _, err := f.fs.r.ReadAt(p[n:n+chunk], physical); err != nil {
+			return n, fmt.Errorf("failed to read inode %d data: %w", f.inode.Num, err)
+		}
+		n += chunk
+	}
+
+	if want < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// find returns the initialized or uninitialized extent containing logical.
+func (f *File) find(logical uint64) *extent {
+	i := sort.Search(len(f.extents), func(i int) bool {
+		return f.extents[i].Logical+f.extents[i].Length > logical
+	})
+	if i < len(f.extents) && f.extents[i].Logical <= logical {
+		return &f.extents[i]
+	}
+	return nil
+}
+
+// nextMapped returns the first block after logical that holds data.
+func (f *File) nextMapped(logical uint64) (uint64, bool) {
+	for _, e := range f.extents {
+		if e.Logical > logical && !e.Uninit {
+			return e.Logical, true
+		}
+	}
+	return 0, false
+}
+
+// Ranges returns the byte ranges of the file that hold data. Holes and
+// uninitialized extents are left out.
+func (f *File) Ranges() []Range {
+	bs := uint64(f.fs.blockSize)
+	var ranges []Range
+	for _, e := range f.extents {
+		if e.Uninit {
+			continue
+		}
+		start := e.Logical * bs
+		end := min((e.Logical+e.Length)*bs, uint64(f.Size()))
+		if start >= end {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == int64(start) {
+			ranges[n-1].Length += int64(end - start)
+			continue
+		}
+		ranges = append(ranges, Range{Offset: int64(start), Length: int64(end - start)})
+	}
+	return ranges
+}
@@ -0,0 +1,427 @@
+package ext4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// fsWriter writes a planned tree and the metadata describing it.
+type fsWriter struct {
+	w     *Writer
+	l     *layout
+	a     *allocator
+	dst   io.WriterAt
+	nodes []*node
+
+	uuid     [16]byte
+	hashSeed [16]byte
+	usedDirs []uint32
+}
+
+func (f *fsWriter) write() error {
+	if _, err := rand.Read(f.uuid[:]); err != nil {
+		return fmt.Errorf("failed to generate UUID: %w", err)
+	}
+	if _, err := rand.Read(f.hashSeed[:]); err != nil {
+		return fmt.Errorf("failed to generate hash seed: %w", err)
+	}
+
+	for _, n := range f.nodes {
+		if err := f.writeData(n); err != nil {
+			return err
+		}
+	}
+	if err := f.writeInodeTables(); err != nil {
+		return err
+	}
+	if err := f.writeBitmaps(); err != nil {
+		return err
+	}
+	return f.writeSuperblocks()
+}
+
+func (f *fsWriter) writeAt(p []byte, block uint64) error {
+	if _, err := f.dst.WriteAt(p, int64(block)*blockSize); err != nil {
+		return fmt.Errorf("failed to write block %d: %w", block, err)
+	}
+	return nil
+}
+
+// writeData writes the contents of a node and fills in its i_block.
+func (f *fsWriter) writeData(n *node) error {
+	if n.xattrBlock != nil {
+		if err := f.writeAt(n.xattrBlock, n.xattrAt); err != nil {
+			return err
+		}
+	}
+
+	switch n.mode & ModeTypeMask {
+	case ModeDir:
+		if err := f.writeRuns(n, bytes.NewReader(n.dir)); err != nil {
+			return err
+		}
+	case ModeRegular:
+		if err := f.writeFile(n); err != nil {
+			return err
+		}
+	case ModeSymlink:
+		if !n.usesExtents() {
+			copy(n.iblock[:], n.target)
+			return nil
+		}
+		if err := f.writeRuns(n, bytes.NewReader([]byte(n.target))); err != nil {
+			return err
+		}
+	case ModeChar, ModeBlock:
+		encodeDevice(n.iblock[:], n.major, n.minor)
+		return nil
+	default:
+		return nil
+	}
+
+	return f.writeTree(n)
+}
+
+func (f *fsWriter) writeFile(n *node) error {
+	if n.size == 0 {
+		return nil
+	}
+
+	r, err := n.source()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", n.name, err)
+	}
+	defer r.Close()
+
+	if err := f.writeRuns(n, r); err != nil {
+		return fmt.Errorf("failed to write %s: %w", n.name, err)
+	}
+	return nil
+}
+
+// writeRuns copies the data of n from r into its extents, skipping the
+// holes between them, and zeroes the tail of each extent's last block.
+func (f *fsWriter) writeRuns(n *node, r io.Reader) error {
+	var pos uint64
+	for _, e := range n.data {
+		start := e.Logical * blockSize
+		if start >= n.size {
+			break
+		}
+		if err := skip(r, int64(start-pos)); err != nil {
+			return err
+		}
+
+		off := int64(e.Physical) * blockSize
+		length := min(n.size-start, e.Length*blockSize)
+		if _, err := io.CopyN(io.NewOffsetWriter(f.dst, off), r, int64(length)); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("file is shorter than %d bytes", n.size)
+			}
+			return err
+		}
+		pos = start + length
+
+		if pad := e.Length*blockSize - length; pad > 0 {
+			if _, err := f.dst.WriteAt(make([]byte, pad), off+int64(length)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skip moves r forward by n bytes, seeking when it can.
+func skip(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, r, n); err != nil {
+		return fmt.Errorf("file is shorter than its data ranges: %w", err)
+	}
+	return nil
+}
+
+type extentIndex struct {
+	logical uint64
+	block   uint64
+}
+
+// writeTree writes the extent tree of n bottom up: leaf blocks holding the
+// extents, then index blocks, until the top level fits in i_block.
+func (f *fsWriter) writeTree(n *node) error {
+	if len(n.tree) == 0 {
+		putExtentHeader(n.iblock[:], len(n.data), extentsInInode, 0)
+		for i, e := range n.data {
+			putExtent(n.iblock[12+i*12:], e)
+		}
+		return nil
+	}
+
+	var indexes []extentIndex
+	for i, block := range n.tree[0] {
+		chunk := n.data[i*extentsPerBlock : min(len(n.data), (i+1)*extentsPerBlock)]
+		buf := make([]byte, blockSize)
+		putExtentHeader(buf, len(chunk), extentsPerBlock, 0)
+		for j, e := range chunk {
+			putExtent(buf[12+j*12:], e)
+		}
+		if err := f.writeAt(buf, block); err != nil {
+			return err
+		}
+		indexes = append(indexes, extentIndex{logical: chunk[0].Logical, block: block})
+	}
+
+	for depth := 1; depth < len(n.tree); depth++ {
+		var next []extentIndex
+		for i, block := range n.tree[depth] {
+			chunk := indexes[i*extentsPerBlock : min(len(indexes), (i+1)*extentsPerBlock)]
+			buf := make([]byte, blockSize)
+			putExtentHeader(buf, len(chunk), extentsPerBlock, depth)
+			for j, idx := range chunk {
+				putExtentIndex(buf[12+j*12:], idx)
+			}
+			if err := f.writeAt(buf, block); err != nil {
+				return err
+			}
+			next = append(next, extentIndex{logical: chunk[0].logical, block: block})
+		}
+		indexes = next
+	}
+
+	putExtentHeader(n.iblock[:], len(indexes), extentsInInode, len(n.tree))
+	for i, idx := range indexes {
+		putExtentIndex(n.iblock[12+i*12:], idx)
+	}
+	return nil
+}
+
+func putExtentHeader(b []byte, entries, max, depth int) {
+	binary.LittleEndian.PutUint16(b[0:], extentMagic)
+	binary.LittleEndian.PutUint16(b[2:], uint16(entries))
+	binary.LittleEndian.PutUint16(b[4:], uint16(max))
+	binary.LittleEndian.PutUint16(b[6:], uint16(depth))
+}
+
+func putExtent(b []byte, e extent) {
+	length := uint16(e.Length)
+	if e.Uninit {
+		length += extentInitMaxLen
+	}
+	binary.LittleEndian.PutUint32(b[0:], uint32(e.Logical))
+	binary.LittleEndian.PutUint16(b[4:], length)
+	binary.LittleEndian.PutUint16(b[6:], uint16(e.Physical>>32))
+	binary.LittleEndian.PutUint32(b[8:], uint32(e.Physical))
+}
+
+func putExtentIndex(b []byte, idx extentIndex) {
+	binary.LittleEndian.PutUint32(b[0:], uint32(idx.logical))
+	binary.LittleEndian.PutUint32(b[4:], uint32(idx.block))
+	binary.LittleEndian.PutUint16(b[8:], uint16(idx.block>>32))
+}
+
+// writeInodeTables writes every group's inode table, zeroing unused slots.
+func (f *fsWriter) writeInodeTables() error {
+	f.usedDirs = make([]uint32, f.l.groups)
+	table := make([]byte, f.l.itableBlocks*blockSize)
+
+	next := 0
+	for g := uint32(0); g < f.l.groups; g++ {
+		clear(table)
+		for ; next < len(f.nodes); next++ {
+			n := f.nodes[next]
+			if (n.ino-1)/f.l.inodesPerGroup != g {
+				break
+			}
+			index := (n.ino - 1) % f.l.inodesPerGroup
+			f.putInode(table[index*inodeSize:(index+1)*inodeSize], n)
+			if n.isDir() {
+				f.usedDirs[g]++
+			}
+		}
+		if err := f.writeAt(table, f.l.inodeTable(g)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fsWriter) putInode(b []byte, n *node) {
+	mtime := n.md.Mtime
+	if mtime.IsZero() {
+		mtime = f.w.now
+	}
+	sec, extra := encodeTime(mtime)
+
+	links := n.links
+	if n.isDir() && links > maxDirLinks {
+		links = 1
+	}
+
+	var flags uint32
+	if n.usesExtents() {
+		flags |= inodeFlagExtents
+	}
+	blocks := n.allocatedBlocks() * (blockSize / 512)
+
+	le := binary.LittleEndian
+	le.PutUint16(b[0x00:], n.mode|n.md.Mode)
+	le.PutUint16(b[0x02:], uint16(n.md.UID))
+	le.PutUint32(b[0x04:], uint32(n.size))
+	le.PutUint32(b[0x08:], sec)
+	le.PutUint32(b[0x0C:], sec)
+	le.PutUint32(b[0x10:], sec)
+	le.PutUint16(b[0x18:], uint16(n.md.GID))
+	le.PutUint16(b[0x1A:], uint16(links))
+	le.PutUint32(b[0x1C:], uint32(blocks))
+	le.PutUint32(b[0x20:], flags)
+	copy(b[0x28:0x28+60], n.iblock[:])
+	le.PutUint32(b[0x68:], uint32(n.xattrAt))
+	le.PutUint32(b[0x6C:], uint32(n.size>>32))
+	le.PutUint16(b[0x74:], uint16(blocks>>32))
+	le.PutUint16(b[0x76:], uint16(n.xattrAt>>32))
+	le.PutUint16(b[0x78:], uint16(n.md.UID>>16))
+	le.PutUint16(b[0x7A:], uint16(n.md.GID>>16))
+	le.PutUint16(b[0x80:], extraIsize)
+	le.PutUint32(b[0x84:], extra)
+	le.PutUint32(b[0x88:], extra)
+	le.PutUint32(b[0x8C:], extra)
+	le.PutUint32(b[0x90:], sec)
+	le.PutUint32(b[0x94:], extra)
+
+	if n.xattrInline != nil {
+		le.PutUint32(b[128+extraIsize:], xattrMagic)
+		copy(b[128+extraIsize+4:], n.xattrInline)
+	}
+}
+
+// encodeTime splits t into the 32-bit seconds field and the extra field
+// carrying the epoch bits and nanoseconds.
+func encodeTime(t time.Time) (uint32, uint32) {
+	sec := t.Unix()
+	epoch := uint32((sec-int64(int32(sec)))>>32) & 3
+	return uint32(sec), uint32(t.Nanosecond())<<2 | epoch
+}
+
+func (f *fsWriter) groupInodes(g uint32) uint32 {
+	last := f.nodes[len(f.nodes)-1].ino
+	start := g * f.l.inodesPerGroup
+	if last <= start {
+		return 0
+	}
+	return min(last-start, f.l.inodesPerGroup)
+}
+
+func (f *fsWriter) groupUsedBlocks(g uint32) uint64 {
+	return f.l.metaBlocks(g) + f.a.used[g]
+}
+
+func (f *fsWriter) writeBitmaps() error {
+	bitmap := make([]byte, blockSize)
+	for g := uint32(0); g < f.l.groups; g++ {
+		clear(bitmap)
+		setBits(bitmap, 0, f.groupUsedBlocks(g))
+		setBits(bitmap, f.l.groupBlocks(g), blockSize*8)
+		if err := f.writeAt(bitmap, f.l.blockBitmap(g)); err != nil {
+			return err
+		}
+
+		clear(bitmap)
+		setBits(bitmap, 0, uint64(f.groupInodes(g)))
+		setBits(bitmap, uint64(f.l.inodesPerGroup), blockSize*8)
+		if err := f.writeAt(bitmap, f.l.inodeBitmap(g)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setBits(bitmap []byte, from, to uint64) {
+	for i := from; i < to; i++ {
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+}
+
+func (f *fsWriter) writeSuperblocks() error {
+	gdt := make([]byte, f.l.gdtBlocks*blockSize)
+	var freeBlocks, freeInodes uint64
+	for g := uint32(0); g < f.l.groups; g++ {
+		free := f.l.groupBlocks(g) - f.groupUsedBlocks(g)
+		freeI := f.l.inodesPerGroup - f.groupInodes(g)
+		freeBlocks += free
+		freeInodes += uint64(freeI)
+
+		d := gdt[g*descSize:]
+		binary.LittleEndian.PutUint32(d[0x00:], uint32(f.l.blockBitmap(g)))
+		binary.LittleEndian.PutUint32(d[0x04:], uint32(f.l.inodeBitmap(g)))
+		binary.LittleEndian.PutUint32(d[0x08:], uint32(f.l.inodeTable(g)))
+		binary.LittleEndian.PutUint16(d[0x0C:], uint16(free))
+		binary.LittleEndian.PutUint16(d[0x0E:], uint16(freeI))
+		binary.LittleEndian.PutUint16(d[0x10:], uint16(f.usedDirs[g]))
+	}
+
+	for g := uint32(0); g < f.l.groups; g++ {
+		if !hasSuper(g) {
+			continue
+		}
+
+		block := make([]byte, blockSize)
+		offset := 0
+		if g == 0 {
+			offset = superblockOffset
+		}
+		f.putSuperblock(block[offset:offset+superblockSize], g, freeBlocks, freeInodes)
+
+		if err := f.writeAt(block, f.l.groupStart(g)); err != nil {
+			return err
+		}
+		if err := f.writeAt(gdt, f.l.groupStart(g)+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fsWriter) putSuperblock(b []byte, group uint32, freeBlocks, freeInodes uint64) {
+	now := uint32(f.w.now.Unix())
+
+	le := binary.LittleEndian
+	le.PutUint32(b[0x00:], uint32(f.l.inodes()))
+	le.PutUint32(b[0x04:], uint32(f.l.blocks))
+	le.PutUint32(b[0x0C:], uint32(freeBlocks))
+	le.PutUint32(b[0x10:], uint32(freeInodes))
+	le.PutUint32(b[0x18:], 2)
+	le.PutUint32(b[0x1C:], 2)
+	le.PutUint32(b[0x20:], blocksPerGroup)
+	le.PutUint32(b[0x24:], blocksPerGroup)
+	le.PutUint32(b[0x28:], f.l.inodesPerGroup)
+	le.PutUint32(b[0x30:], now)
+	le.PutUint16(b[0x36:], 0xFFFF)
+	le.PutUint16(b[0x38:], superblockMagic)
+	le.PutUint16(b[0x3A:], 1)
+	le.PutUint16(b[0x3C:], 1)
+	le.PutUint32(b[0x40:], now)
+	le.PutUint32(b[0x4C:], 1)
+	le.PutUint32(b[0x54:], firstIno)
+	le.PutUint16(b[0x58:], inodeSize)
+	le.PutUint16(b[0x5A:], uint16(group))
+	le.PutUint32(b[0x5C:], compatExtAttr|compatDirIndex)
+	le.PutUint32(b[0x60:], incompatFiletype|incompatExtents)
+	le.PutUint32(b[0x64:], roCompatSparseSuper|roCompatLargeFile|roCompatHugeFile|roCompatDirNlink|roCompatExtraIsize)
+	copy(b[0x68:0x78], f.uuid[:])
+	copy(b[0x78:0x88], f.w.label)
+	copy(b[0xEC:0xFC], f.hashSeed[:])
+	b[0xFC] = 1 // half_md4
+	le.PutUint32(b[0x108:], now)
+	le.PutUint16(b[0x15C:], extraIsize)
+	le.PutUint16(b[0x15E:], extraIsize)
+	le.PutUint32(b[0x160:], flagsSignedHash)
+}
@@ -0,0 +1,44 @@
+package ext4
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestInlineData checks that files mkfs.ext4 stored inside their inode are
+// refused rather than read as empty.
+func TestInlineData(t *testing.T) {
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		t.Skip("mkfs.ext4 not installed")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "hostname"), []byte("OpenWrt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := filepath.Join(dir, "inline.img")
+	if out, err := exec.Command(mkfs, "-q", "-F", "-O", "inline_data", "-d", src, img, "8M").CombinedOutput(); err != nil {
+		t.Skipf("mkfs.ext4 cannot make an inline_data image: %v\n%s", err, out)
+	}
+
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fs, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode := lookup(t, tree(t, fs), "hostname")
+	if _, err := fs.Open(inode); err == nil || !strings.Contains(err.Error(), "inline data is not supported") {
+		t.Errorf("opening an inline file: got %v, want the inline data error", err)
+	}
+}
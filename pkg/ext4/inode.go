@@ -0,0 +1,266 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// File type bits of an ext4 mode, the same values as S_IF* on Linux.
+const (
+	ModeTypeMask = 0xF000
+	ModeFIFO     = 0x1000
+	ModeChar     = 0x2000
+	ModeDir      = 0x4000
+	ModeBlock    = 0x6000
+	ModeRegular  = 0x8000
+	ModeSymlink  = 0xA000
+	ModeSocket   = 0xC000
+)
+
+const (
+	inodeFlagExtents    = 0x80000
+	inodeFlagInlineData = 0x10000000
+
+	extentMagic      = 0xF30A
+	extentInitMaxLen = 32768
+)
+
+// Inode is the on-disk metadata of a file. Mode is the raw ext4 mode,
+// file type bits included.
+type Inode struct {
+	Num   uint32
+	Mode  uint16
+	UID   uint32
+	GID   uint32
+	Size  uint64
+	Links uint16
+	Flags uint32
+	Mtime time.Time
+
+	// Major and Minor are set for character and block devices.
+	Major uint32
+	Minor uint32
+
+	blocks  uint64
+	fileACL uint64
+	block   [60]byte
+	xattrs  []byte
+}
+
+func (i *Inode) Type() uint16    { return i.Mode & ModeTypeMask }
+func (i *Inode) IsDir() bool     { return i.Type() == ModeDir }
+func (i *Inode) IsRegular() bool { return i.Type() == ModeRegular }
+func (i *Inode) IsSymlink() bool { return i.Type() == ModeSymlink }
+func (i *Inode) IsDevice() bool  { return i.Type() == ModeChar || i.Type() == ModeBlock }
+
+// Perm returns the permission bits, including setuid, setgid and sticky.
+func (i *Inode) Perm() uint16 { return i.Mode &^ ModeTypeMask }
+
+// Inode reads inode number ino.
+func (fs *FS) Inode(ino uint32) (*Inode, error) {
+	if ino == 0 || ino > fs.inodeCount {
+		return nil, fmt.Errorf("inode %d out of range", ino)
+	}
+
+	group := (ino - 1) / fs.inodesPerGroup
+	index := (ino - 1) % fs.inodesPerGroup
+	raw := make([]byte, fs.inodeSize)
+	offset := int64(fs.inodeTables[group])*fs.blockSize + int64(index)*fs.inodeSize
+	if _, err := fs.r.ReadAt(raw, offset); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", ino, err)
+	}
+
+	inode := &Inode{
+		Num:     ino,
+		Mode:    binary.LittleEndian.Uint16(raw[0x00:]),
+		Size:    uint64(binary.LittleEndian.Uint32(raw[0x04:])) | uint64(binary.LittleEndian.Uint32(raw[0x6C:]))<<32,
+		Links:   binary.LittleEndian.Uint16(raw[0x1A:]),
+		Flags:   binary.LittleEndian.Uint32(raw[0x20:]),
+		blocks:  uint64(binary.LittleEndian.Uint32(raw[0x1C:])) | uint64(binary.LittleEndian.Uint16(raw[0x74:]))<<32,
+		fileACL: uint64(binary.LittleEndian.Uint32(raw[0x68:])) | uint64(binary.LittleEndian.Uint16(raw[0x76:]))<<32,
+	}
+	copy(inode.block[:], raw[0x28:0x28+60])
+
+	inode.UID = uint32(binary.LittleEndian.Uint16(raw[0x02:])) | uint32(binary.LittleEndian.Uint16(raw[0x78:]))<<16
+	inode.GID = uint32(binary.LittleEndian.Uint16(raw[0x18:])) | uint32(binary.LittleEndian.Uint16(raw[0x7A:]))<<16
+
+	mtime := int64(int32(binary.LittleEndian.Uint32(raw[0x10:])))
+	var nsec int64
+	if fs.inodeSize > 128 && binary.LittleEndian.Uint16(raw[0x80:]) >= 12 {
+		extra := binary.LittleEndian.Uint32(raw[0x88:])
+		mtime += int64(extra&3) << 32
+		nsec = int64(extra >> 2)
+	}
+	inode.Mtime = time.Unix(mtime, nsec)
+
+	if fs.inodeSize > 128 {
+		start := 128 + int64(binary.LittleEndian.Uint16(raw[0x80:]))
+		if start+4 <= fs.inodeSize && binary.LittleEndian.Uint32(raw[start:]) == xattrMagic {
+			inode.xattrs = raw[start+4:]
+		}
+	}
+
+	if inode.IsDevice() {
+		inode.Major, inode.Minor = decodeDevice(inode.block[:])
+	}
+
+	return inode, nil
+}
+
+// extent maps length blocks starting at logical block Logical to physical
+// blocks starting at Physical. Uninitialized extents read as zeros.
+type extent struct {
+	Logical  uint64
+	Physical uint64
+	Length   uint64
+	Uninit   bool
+}
+
+// extents returns the block mapping of an inode in logical order. Holes are
+// simply missing from the list.
+func (fs *FS) extents(inode *Inode) ([]extent, error) {
+	if inode.Flags&inodeFlagInlineData != 0 {
+		return nil, fmt.Errorf("inode %d: inline data is not supported", inode.Num)
+	}
+
+	var out []extent
+	if inode.Flags&inodeFlagExtents != 0 {
+		if err := fs.walkExtentNode(inode.block[:], 0, &out); err != nil {
+			return nil, fmt.Errorf("inode %d: %w", inode.Num, err)
+		}
+		return out, nil
+	}
+
+	blocks := (inode.Size + uint64(fs.blockSize) - 1) / uint64(fs.blockSize)
+	m := &blockMapper{fs: fs, remaining: blocks, out: &out}
+	for i := 0; i < 12 && m.remaining > 0; i++ {
+		m.add(uint64(binary.LittleEndian.Uint32(inode.block[i*4:])))
+	}
+	for level, off := 1, 48; level <= 3 && m.remaining > 0; level, off = level+1, off+4 {
+		if err := m.indirect(uint64(binary.LittleEndian.Uint32(inode.block[off:])), level); err != nil {
+			return nil, fmt.Errorf("inode %d: %w", inode.Num, err)
+		}
+	}
+	return out, nil
+}
+
+func (fs *FS) walkExtentNode(node []byte, depth int, out *[]extent) error {
+	if depth > 5 {
+		return fmt.Errorf("extent tree too deep")
+	}
+	if len(node) < 12 || binary.LittleEndian.Uint16(node[0:]) != extentMagic {
+		return fmt.Errorf("bad extent header")
+	}
+
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	level := binary.LittleEndian.Uint16(node[6:])
+	if 12+entries*12 > len(node) {
+		return fmt.Errorf("extent node overflows its block")
+	}
+
+	for i := 0; i < entries; i++ {
+		e := node[12+i*12:]
+		if level == 0 {
+			length := uint64(binary.LittleEndian.Uint16(e[4:]))
+			uninit := length > extentInitMaxLen
+			if uninit {
+				length -= extentInitMaxLen
+			}
+			*out = append(*out, extent{
+				Logical:  uint64(binary.LittleEndian.Uint32(e[0:])),
+				Physical: uint64(binary.LittleEndian.Uint16(e[6:]))<<32 | uint64(binary.LittleEndian.Uint32(e[8:])),
+				Length:   length,
+				Uninit:   uninit,
+			})
+			continue
+		}
+
+		leaf := uint64(binary.LittleEndian.Uint32(e[4:])) | uint64(binary.LittleEndian.Uint16(e[8:]))<<32
+		child, err := fs.readBlock(leaf)
+		if err != nil {
+			return err
+		}
+		if err := fs.walkExtentNode(child, depth+1, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockMapper turns the ext2/ext3 direct and indirect block pointers into
+// extents, merging physically contiguous runs.
+type blockMapper struct {
+	fs        *FS
+	logical   uint64
+	remaining uint64
+	out       *[]extent
+}
+
+func (m *blockMapper) add(physical uint64) {
+	if physical != 0 {
+		if n := len(*m.out); n > 0 {
+			last := &(*m.out)[n-1]
+			if last.Logical+last.Length == m.logical && last.Physical+last.Length == physical {
+				last.Length++
+				m.logical++
+				m.remaining--
+				return
+			}
+		}
+		*m.out = append(*m.out, extent{Logical: m.logical, Physical: physical, Length: 1})
+	}
+	m.logical++
+	m.remaining--
+}
+
+func (m *blockMapper) indirect(block uint64, level int) error {
+	perBlock := uint64(m.fs.blockSize / 4)
+	if block == 0 {
+		// A missing pointer block is a hole covering everything below it.
+		span := perBlock
+		for i := 1; i < level; i++ {
+			span *= perBlock
+		}
+		if span > m.remaining {
+			span = m.remaining
+		}
+		m.logical += span
+		m.remaining -= span
+		return nil
+	}
+
+	buf, err := m.fs.readBlock(block)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < perBlock && m.remaining > 0; i++ {
+		ptr := uint64(binary.LittleEndian.Uint32(buf[i*4:]))
+		if level == 1 {
+			m.add(ptr)
+			continue
+		}
+		if err := m.indirect(ptr, level-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeDevice reads a device number from i_block: the old 8:8 encoding in
+// the first word, or the Linux "new" encoding in the second.
+func decodeDevice(block []byte) (major, minor uint32) {
+	if old := binary.LittleEndian.Uint32(block[0:]); old != 0 {
+		return (old >> 8) & 0xff, old & 0xff
+	}
+	dev := binary.LittleEndian.Uint32(block[4:])
+	return (dev & 0xfff00) >> 8, (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
+
+func encodeDevice(block []byte, major, minor uint32) {
+	if major < 256 && minor < 256 {
+		binary.LittleEndian.PutUint32(block[0:], major<<8|minor)
+		return
+	}
+	binary.LittleEndian.PutUint32(block[4:], (minor&0xff)|(major<<8)|((minor&^0xff)<<12))
+}
@@ -0,0 +1,171 @@
+package ext4
+
+import "fmt"
+
+const (
+	blockSize      = 4096
+	blocksPerGroup = blockSize * 8
+	inodeSize      = 256
+	extraIsize     = 32
+	inodesPerBlock = blockSize / inodeSize
+	descSize       = 32
+
+	// One inode per 16 KiB of space, the mke2fs default.
+	bytesPerInode = 16384
+
+	firstIno     = 11
+	lostFoundIno = 11
+)
+
+// layout places the metadata of every block group. Groups without the
+// flex_bg feature carry their own bitmaps and inode table; groups 0, 1 and
+// powers of 3, 5 and 7 also carry a superblock and descriptor table copy.
+type layout struct {
+	blocks         uint64
+	groups         uint32
+	inodesPerGroup uint32
+	gdtBlocks      uint64
+	itableBlocks   uint64
+}
+
+func newLayout(size int64, minInodes uint64) (*layout, error) {
+	l := &layout{blocks: uint64(size) / blockSize}
+	if l.blocks < 64 {
+		return nil, fmt.Errorf("filesystem too small: %d bytes", size)
+	}
+
+	l.groups = uint32((l.blocks + blocksPerGroup - 1) / blocksPerGroup)
+	for {
+		l.gdtBlocks = (uint64(l.groups)*descSize + blockSize - 1) / blockSize
+
+		inodes := l.blocks * blockSize / bytesPerInode
+		if inodes < minInodes {
+			inodes = minInodes
+		}
+		ipg := (inodes + uint64(l.groups) - 1) / uint64(l.groups)
+		ipg = (ipg + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+		if ipg < inodesPerBlock {
+			ipg = inodesPerBlock
+		}
+		if ipg > blockSize*8 {
+			return nil, fmt.Errorf("too many inodes for a %d MB filesystem", size>>20)
+		}
+		l.inodesPerGroup = uint32(ipg)
+		l.itableBlocks = ipg / inodesPerBlock
+
+		// Drop a trailing group too small to hold its own metadata.
+		last := l.groups - 1
+		if l.groupBlocks(last) > l.metaBlocks(last) {
+			break
+		}
+		if l.groups == 1 {
+			return nil, fmt.Errorf("filesystem too small: %d bytes", size)
+		}
+		l.groups--
+		l.blocks = uint64(l.groups) * blocksPerGroup
+	}
+
+	return l, nil
+}
+
+func (l *layout) inodes() uint64 { return uint64(l.groups) * uint64(l.inodesPerGroup) }
+
+func (l *layout) groupStart(g uint32) uint64 { return uint64(g) * blocksPerGroup }
+
+func (l *layout) groupBlocks(g uint32) uint64 {
+	if end := l.groupStart(g) + blocksPerGroup; end > l.blocks {
+		return l.blocks - l.groupStart(g)
+	}
+	return blocksPerGroup
+}
+
+func (l *layout) superBlocks(g uint32) uint64 {
+	if hasSuper(g) {
+		return 1 + l.gdtBlocks
+	}
+	return 0
+}
+
+func (l *layout) metaBlocks(g uint32) uint64 { return l.superBlocks(g) + 2 + l.itableBlocks }
+
+func (l *layout) blockBitmap(g uint32) uint64 { return l.groupStart(g) + l.superBlocks(g) }
+func (l *layout) inodeBitmap(g uint32) uint64 { return l.blockBitmap(g) + 1 }
+func (l *layout) inodeTable(g uint32) uint64  { return l.blockBitmap(g) + 2 }
+func (l *layout) dataStart(g uint32) uint64   { return l.groupStart(g) + l.metaBlocks(g) }
+func (l *layout) groupEnd(g uint32) uint64    { return l.groupStart(g) + l.groupBlocks(g) }
+
+// dataBlocks is the space left for directories, files and extent blocks.
+func (l *layout) dataBlocks() uint64 {
+	var n uint64
+	for g := uint32(0); g < l.groups; g++ {
+		n += l.groupBlocks(g) - l.metaBlocks(g)
+	}
+	return n
+}
+
+// hasSuper reports whether group g holds a backup superblock under the
+// sparse_super feature.
+func hasSuper(g uint32) bool {
+	if g <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// allocator hands out data blocks front to back, so every group's used
+// blocks form a single run after its metadata.
+type allocator struct {
+	l     *layout
+	group uint32
+	next  uint64
+	used  []uint64
+	short uint64
+}
+
+func newAllocator(l *layout) *allocator {
+	return &allocator{l: l, next: l.dataStart(0), used: make([]uint64, l.groups)}
+}
+
+// alloc returns n blocks as physically contiguous runs. When the
+// filesystem is full it keeps counting the shortfall so the caller can
+// report how much space was needed.
+func (a *allocator) alloc(n uint64) []extent {
+	var runs []extent
+	for n > 0 {
+		if a.group >= a.l.groups {
+			a.short += n
+			return nil
+		}
+		free := a.l.groupEnd(a.group) - a.next
+		if free == 0 {
+			a.group++
+			if a.group < a.l.groups {
+				a.next = a.l.dataStart(a.group)
+			}
+			continue
+		}
+		take := min(n, free)
+		runs = append(runs, extent{Physical: a.next, Length: take})
+		a.next += take
+		a.used[a.group] += take
+		n -= take
+	}
+	return runs
+}
+
+func (a *allocator) usedBlocks() uint64 {
+	var n uint64
+	for _, u := range a.used {
+		n += u
+	}
+	return n
+}
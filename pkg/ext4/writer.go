@@ -0,0 +1,471 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BlockSize is the block size of filesystems built by Writer.
+const BlockSize = blockSize
+
+const (
+	compatExtAttr  = 0x8
+	compatDirIndex = 0x20
+
+	incompatExtents = 0x40
+
+	roCompatSparseSuper = 0x1
+	roCompatLargeFile   = 0x2
+	roCompatHugeFile    = 0x8
+	roCompatDirNlink    = 0x20
+	roCompatExtraIsize  = 0x40
+
+	flagsSignedHash = 0x1
+
+	extentsInInode  = 4
+	extentsPerBlock = (blockSize - 12) / 12
+	maxExtentLen    = extentInitMaxLen
+
+	maxLabelLength = 16
+	maxNameLength  = 255
+	maxDirLinks    = 65000
+)
+
+// Metadata is the ownership, permissions, modification time and extended
+// attributes of an inode. Mode holds the permission bits including setuid,
+// setgid and sticky; the file type comes from the call that creates the
+// inode. Xattrs are keyed by full name, e.g. security.capability, with
+// values as setxattr takes them.
+type Metadata struct {
+	Mode   uint16
+	UID    uint32
+	GID    uint32
+	Mtime  time.Time
+	Xattrs map[string][]byte
+}
+
+// Source opens the contents of a regular file. It is called once, while
+// the filesystem is written, and must yield exactly the declared size.
+type Source func() (io.ReadCloser, error)
+
+// SpaceError reports a tree that does not fit in the requested size.
+type SpaceError struct {
+	NeedBlocks uint64
+	FreeBlocks uint64
+	NeedInodes uint64
+	FreeInodes uint64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("filesystem full: need %d blocks and %d inodes, have %d blocks and %d inodes",
+		e.NeedBlocks, e.NeedInodes, e.FreeBlocks, e.FreeInodes)
+}
+
+type node struct {
+	name   string
+	mode   uint16
+	md     Metadata
+	size   uint64
+	source Source
+	spans  []span
+	target string
+	major  uint32
+	minor  uint32
+
+	parent   *node
+	children []dirent
+	names    map[string]*node
+	dir      []byte
+
+	ino    uint32
+	links  uint32
+	data   []extent
+	tree   [][]uint64
+	iblock [60]byte
+
+	xattrInline []byte
+	xattrBlock  []byte
+	xattrAt     uint64
+}
+
+// Range is a byte range of file data.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// span is a run of logical blocks that holds data.
+type span struct {
+	logical uint64
+	blocks  uint64
+}
+
+// blockSpans turns byte ranges into sorted, merged runs of whole blocks,
+// clipped to the file size.
+func blockSpans(data []Range, size int64) []span {
+	sorted := append([]Range(nil), data...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	var spans []span
+	for _, r := range sorted {
+		end := min(r.Offset+r.Length, size)
+		if r.Offset < 0 || end <= r.Offset {
+			continue
+		}
+		first := uint64(r.Offset) / blockSize
+		last := (uint64(end) + blockSize - 1) / blockSize
+
+		if n := len(spans); n > 0 && spans[n-1].logical+spans[n-1].blocks >= first {
+			spans[n-1].blocks = max(spans[n-1].blocks, last-spans[n-1].logical)
+			continue
+		}
+		spans = append(spans, span{first, last - first})
+	}
+	return spans
+}
+
+type dirent struct {
+	name string
+	node *node
+}
+
+func (n *node) isDir() bool { return n.mode&ModeTypeMask == ModeDir }
+
+// usesExtents reports whether i_block holds an extent tree rather than a
+// fast symlink target or device number.
+func (n *node) usesExtents() bool {
+	switch n.mode & ModeTypeMask {
+	case ModeDir, ModeRegular:
+		return true
+	case ModeSymlink:
+		return len(n.target) >= 60
+	}
+	return false
+}
+
+// Writer builds an ext4 filesystem from a tree described up front. Nothing
+// is written until Write, which lays the whole tree out in one pass.
+type Writer struct {
+	label string
+	now   time.Time
+	root  *node
+	nodes map[string]*node
+}
+
+func NewWriter(label string) (*Writer, error) {
+	if len(label) > maxLabelLength {
+		return nil, fmt.Errorf("label too long: %d bytes (max %d)", len(label), maxLabelLength)
+	}
+
+	now := time.Now()
+	root := &node{mode: ModeDir, md: Metadata{Mode: 0755, Mtime: now}, names: map[string]*node{}}
+	root.parent = root
+	return &Writer{
+		label: label,
+		now:   now,
+		root:  root,
+		nodes: map[string]*node{".": root},
+	}, nil
+}
+
+// Mkdir adds a directory. Paths are slash separated and relative to the
+// root; the parent must already exist.
+func (w *Writer) Mkdir(name string, md Metadata) error {
+	return w.add(name, &node{mode: ModeDir, md: md, names: map[string]*node{}})
+}
+
+// Create adds a regular file of size bytes read from src.
+func (w *Writer) Create(name string, md Metadata, size int64, src Source) error {
+	return w.CreateSparse(name, md, size, nil, src)
+}
+
+// CreateSparse adds a regular file whose data lives only in the given
+// ranges; everything else is a hole that takes no blocks. A nil data slice
+// means the whole file is data.
+func (w *Writer) CreateSparse(name string, md Metadata, size int64, data []Range, src Source) error {
+	if size < 0 {
+		return fmt.Errorf("%s: negative size", name)
+	}
+
+	n := &node{mode: ModeRegular, md: md, size: uint64(size), source: src}
+	if data == nil {
+		n.spans = []span{{0, (n.size + blockSize - 1) / blockSize}}
+	} else {
+		n.spans = blockSpans(data, size)
+	}
+	return w.add(name, n)
+}
+
+// Link adds name as another hard link to the existing non-directory
+// target.
+func (w *Writer) Link(name, target string) error {
+	n, ok := w.nodes[path.Clean(strings.TrimPrefix(target, "/"))]
+	if !ok {
+		return fmt.Errorf("%s: link target %s does not exist", name, target)
+	}
+	if n.isDir() {
+		return fmt.Errorf("%s: cannot hard link directory %s", name, target)
+	}
+	return w.link(name, n)
+}
+
+func (w *Writer) Symlink(name, target string, md Metadata) error {
+	if target == "" || len(target) >= blockSize {
+		return fmt.Errorf("%s: invalid symlink target length %d", name, len(target))
+	}
+	return w.add(name, &node{mode: ModeSymlink, md: md, size: uint64(len(target)), target: target})
+}
+
+// Mknod adds a character or block device, FIFO or socket. fileType is one
+// of ModeChar, ModeBlock, ModeFIFO or ModeSocket.
+func (w *Writer) Mknod(name string, fileType uint16, md Metadata, major, minor uint32) error {
+	switch fileType {
+	case ModeChar, ModeBlock, ModeFIFO, ModeSocket:
+	default:
+		return fmt.Errorf("%s: unsupported file type %#o", name, fileType)
+	}
+	return w.add(name, &node{mode: fileType, md: md, major: major, minor: minor})
+}
+
+func (w *Writer) add(name string, n *node) error {
+	n.name = path.Clean(strings.TrimPrefix(name, "/"))
+	n.md.Mode &= 07777
+
+	var err error
+	if n.xattrInline, n.xattrBlock, err = encodeXattrs(n.md.Xattrs); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return w.link(name, n)
+}
+
+func (w *Writer) link(name string, n *node) error {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if name == "." {
+		return fmt.Errorf("cannot replace the root directory")
+	}
+
+	parent, ok := w.nodes[path.Dir(name)]
+	if !ok || !parent.isDir() {
+		return fmt.Errorf("%s: parent directory does not exist", name)
+	}
+	base := path.Base(name)
+	if len(base) > maxNameLength {
+		return fmt.Errorf("%s: name longer than %d bytes", name, maxNameLength)
+	}
+	if _, exists := parent.names[base]; exists {
+		return fmt.Errorf("%s: already exists", name)
+	}
+
+	if n.isDir() {
+		n.parent = parent
+	}
+	parent.names[base] = n
+	parent.children = append(parent.children, dirent{name: base, node: n})
+	w.nodes[name] = n
+	return nil
+}
+
+// Write formats dst as an ext4 filesystem of size bytes holding the tree.
+// It returns a *SpaceError before writing anything if the tree does not
+// fit.
+func (w *Writer) Write(dst io.WriterAt, size int64) error {
+	lostFound := &node{mode: ModeDir, md: Metadata{Mode: 0700, Mtime: w.now}, parent: w.root}
+	if _, exists := w.root.names["lost+found"]; exists {
+		return fmt.Errorf("lost+found is created by the writer")
+	}
+
+	nodes := w.order(lostFound)
+	l, err := newLayout(size, uint64(len(nodes))+firstIno)
+	if err != nil {
+		return err
+	}
+	if uint64(nodes[len(nodes)-1].ino) > l.inodes() {
+		return &SpaceError{NeedInodes: uint64(nodes[len(nodes)-1].ino), FreeInodes: l.inodes()}
+	}
+
+	a := newAllocator(l)
+	for _, n := range nodes {
+		if n.isDir() {
+			extra := 0
+			if n == lostFound {
+				// Room for e2fsck to reconnect orphans without allocating.
+				extra = 3
+			}
+			n.dir = dirData(n, extra)
+		}
+		n.plan(a)
+	}
+	if a.short > 0 {
+		return &SpaceError{
+			NeedBlocks: a.usedBlocks() + a.short,
+			FreeBlocks: l.dataBlocks(),
+			NeedInodes: uint64(nodes[len(nodes)-1].ino),
+			FreeInodes: l.inodes(),
+		}
+	}
+
+	fw := &fsWriter{w: w, l: l, a: a, dst: dst, nodes: nodes}
+	return fw.write()
+}
+
+// order assigns inode numbers depth first with directory entries sorted
+// by name, links each node to its parent and returns the nodes in inode
+// order.
+func (w *Writer) order(lostFound *node) []*node {
+	w.root.ino = RootInode
+	lostFound.ino = lostFoundIno
+	w.root.children = append(w.root.children, dirent{name: "lost+found", node: lostFound})
+
+	nodes := []*node{w.root, lostFound}
+	next := uint32(firstIno + 1)
+
+	var visit func(dir *node)
+	visit = func(dir *node) {
+		sort.Slice(dir.children, func(i, j int) bool { return dir.children[i].name < dir.children[j].name })
+		dir.links = 2
+		for _, c := range dir.children {
+			if c.node.isDir() {
+				dir.links++
+			}
+			if c.node.ino == 0 {
+				c.node.ino = next
+				next++
+				nodes = append(nodes, c.node)
+			}
+			if !c.node.isDir() {
+				c.node.links++
+			}
+		}
+		for _, c := range dir.children {
+			if c.node.isDir() && c.node != lostFound {
+				visit(c.node)
+			}
+		}
+	}
+	visit(w.root)
+	lostFound.links = 2
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ino < nodes[j].ino })
+	return nodes
+}
+
+// plan allocates the xattr block, data blocks and extent tree blocks of a
+// node.
+func (n *node) plan(a *allocator) {
+	if n.xattrBlock != nil {
+		for _, run := range a.alloc(1) {
+			n.xattrAt = run.Physical
+		}
+	}
+
+	switch {
+	case n.isDir():
+		n.size = uint64(len(n.dir))
+		n.spans = []span{{0, n.size / blockSize}}
+	case n.mode&ModeTypeMask == ModeSymlink && n.usesExtents():
+		n.spans = []span{{0, 1}}
+	}
+
+	for _, sp := range n.spans {
+		logical := sp.logical
+		for _, run := range a.alloc(sp.blocks) {
+			for run.Length > 0 {
+				length := min(run.Length, maxExtentLen)
+				n.data = append(n.data, extent{Logical: logical, Physical: run.Physical, Length: length})
+				logical += length
+				run.Physical += length
+				run.Length -= length
+			}
+		}
+	}
+
+	// Extents beyond the four that fit in the inode go into leaf blocks,
+	// indexed by as many levels as it takes to get back down to four.
+	count := uint64(len(n.data))
+	for count > extentsInInode {
+		count = (count + extentsPerBlock - 1) / extentsPerBlock
+		var level []uint64
+		for _, run := range a.alloc(count) {
+			for i := uint64(0); i < run.Length; i++ {
+				level = append(level, run.Physical+i)
+			}
+		}
+		n.tree = append(n.tree, level)
+	}
+}
+
+func (n *node) allocatedBlocks() uint64 {
+	var total uint64
+	for _, e := range n.data {
+		total += e.Length
+	}
+	for _, level := range n.tree {
+		total += uint64(len(level))
+	}
+	if n.xattrBlock != nil {
+		total++
+	}
+	return total
+}
+
+// dirData returns the directory blocks of n. Entries are packed in order
+// and the last entry of each block stretches to the end of the block.
+func dirData(n *node, extraBlocks int) []byte {
+	entries := append([]dirent{{".", n}, {"..", n.parent}}, n.children...)
+
+	var data []byte
+	block := make([]byte, 0, blockSize)
+	last := -1
+	for _, e := range entries {
+		recLen := (8 + len(e.name) + 3) &^ 3
+		if len(block)+recLen > blockSize {
+			binary.LittleEndian.PutUint16(block[last+4:], uint16(blockSize-last))
+			data = append(data, block[:blockSize]...)
+			block = block[:0]
+		}
+
+		last = len(block)
+		block = block[:len(block)+recLen]
+		clear(block[last:])
+		binary.LittleEndian.PutUint32(block[last:], e.node.ino)
+		binary.LittleEndian.PutUint16(block[last+4:], uint16(recLen))
+		block[last+6] = uint8(len(e.name))
+		block[last+7] = fileType(e.node.mode)
+		copy(block[last+8:], e.name)
+	}
+	binary.LittleEndian.PutUint16(block[last+4:], uint16(blockSize-last))
+	data = append(data, block[:blockSize]...)
+
+	// Empty blocks, as in lost+found, hold a single unused entry.
+	for i := 0; i < extraBlocks; i++ {
+		empty := make([]byte, blockSize)
+		binary.LittleEndian.PutUint16(empty[4:], blockSize)
+		data = append(data, empty...)
+	}
+	return data
+}
+
+func fileType(mode uint16) uint8 {
+	switch mode & ModeTypeMask {
+	case ModeRegular:
+		return 1
+	case ModeDir:
+		return 2
+	case ModeChar:
+		return 3
+	case ModeBlock:
+		return 4
+	case ModeFIFO:
+		return 5
+	case ModeSocket:
+		return 6
+	case ModeSymlink:
+		return 7
+	}
+	return 0
+}
@@ -0,0 +1,415 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testImageSize = 32 << 20
+
+// writeImage writes the tree of w to an image file, checks it with
+// e2fsck when that is installed and opens it again.
+func writeImage(t *testing.T, w *Writer) *FS {
+	t.Helper()
+	img := filepath.Join(t.TempDir(), "rootfs.img")
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(testImageSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(f, testImageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if e2fsck, err := exec.LookPath("e2fsck"); err == nil {
+		if out, err := exec.Command(e2fsck, "-fn", img).CombinedOutput(); err != nil {
+			t.Errorf("e2fsck: %v\n%s", err, out)
+		}
+	} else {
+		t.Log("e2fsck not installed, image not checked")
+	}
+
+	fs, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// tree maps every path of fs to its inode.
+func tree(t *testing.T, fs *FS) map[string]*Inode {
+	t.Helper()
+	inodes := map[string]*Inode{}
+	err := fs.Walk(func(name string, inode *Inode) error {
+		inodes[name] = inode
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inodes
+}
+
+func lookup(t *testing.T, inodes map[string]*Inode, name string) *Inode {
+	t.Helper()
+	inode, ok := inodes[name]
+	if !ok {
+		t.Fatalf("%s is missing", name)
+	}
+	return inode
+}
+
+func readFile(t *testing.T, fs *FS, inode *Inode) []byte {
+	t.Helper()
+	f, err := fs.Open(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func content(data []byte) Source {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func newTestWriter(t *testing.T) *Writer {
+	t.Helper()
+	w, err := NewWriter("rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWriterSymlinks(t *testing.T) {
+	md := Metadata{Mode: 0777, Mtime: time.Unix(1700000000, 0)}
+	long := "../" + strings.Repeat("very-long-directory-name/", 6) + "target"
+	links := map[string]string{
+		"bin/sh":        "busybox",
+		"etc/localtime": "/usr/share/zoneinfo/UTC",
+		"usr/lib/long":  long,
+		"dangling":      "/does/not/exist",
+	}
+
+	w := newTestWriter(t)
+	for _, dir := range []string{"bin", "etc", "usr", "usr/lib"} {
+		if err := w.Mkdir(dir, Metadata{Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Create("bin/busybox", Metadata{Mode: 0755}, 4, content([]byte("bbox"))); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range links {
+		if err := w.Symlink(name, target, md); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := writeImage(t, w)
+	inodes := tree(t, fs)
+	for name, target := range links {
+		inode := lookup(t, inodes, name)
+		if !inode.IsSymlink() {
+			t.Errorf("%s: mode %#o is not a symlink", name, inode.Mode)
+			continue
+		}
+		got, err := fs.Readlink(inode)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != target {
+			t.Errorf("%s: target %q, want %q", name, got, target)
+		}
+	}
+}
+
+func TestWriterMetadata(t *testing.T) {
+	type entry struct {
+		name         string
+		mode         uint16
+		md           Metadata
+		major, minor uint32
+	}
+	mtime := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	// Past 2038, in the epoch bits of the extra timestamp field.
+	late := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []entry{
+		{name: "etc", mode: ModeDir, md: Metadata{Mode: 0755, Mtime: mtime}},
+		{name: "etc/shadow", mode: ModeRegular, md: Metadata{Mode: 0600, Mtime: mtime}},
+		{name: "usr", mode: ModeDir, md: Metadata{Mode: 0755, Mtime: late}},
+		{name: "usr/bin", mode: ModeDir, md: Metadata{Mode: 0755, Mtime: mtime}},
+		{name: "usr/bin/passwd", mode: ModeRegular, md: Metadata{Mode: 04755, Mtime: mtime}},
+		{name: "usr/bin/wall", mode: ModeRegular, md: Metadata{Mode: 02755, GID: 5, Mtime: mtime}},
+		{name: "tmp", mode: ModeDir, md: Metadata{Mode: 01777, Mtime: mtime}},
+		{name: "home", mode: ModeDir, md: Metadata{Mode: 0755, Mtime: mtime}},
+		{name: "home/user", mode: ModeDir, md: Metadata{Mode: 0700, UID: 1000, GID: 1000, Mtime: mtime}},
+		// Ids above 65535 need the high halves of the inode fields.
+		{name: "home/user/.profile", mode: ModeRegular, md: Metadata{Mode: 0644, UID: 100000, GID: 200000, Mtime: mtime}},
+		{name: "dev", mode: ModeDir, md: Metadata{Mode: 0755, Mtime: mtime}},
+		{name: "dev/console", mode: ModeChar, md: Metadata{Mode: 0600, Mtime: mtime}, major: 5, minor: 1},
+		{name: "dev/null", mode: ModeChar, md: Metadata{Mode: 0666, Mtime: mtime}, major: 1, minor: 3},
+		{name: "dev/mmcblk0p1", mode: ModeBlock, md: Metadata{Mode: 0660, GID: 6, Mtime: mtime}, major: 179, minor: 1},
+		// Minors above 255 need the new device encoding.
+		{name: "dev/nvme0n1", mode: ModeBlock, md: Metadata{Mode: 0660, GID: 6, Mtime: mtime}, major: 259, minor: 300},
+		{name: "dev/initctl", mode: ModeFIFO, md: Metadata{Mode: 0600, Mtime: mtime}},
+		{name: "dev/log", mode: ModeSocket, md: Metadata{Mode: 0666, Mtime: mtime}},
+	}
+
+	w := newTestWriter(t)
+	for _, e := range entries {
+		var err error
+		switch e.mode {
+		case ModeDir:
+			err = w.Mkdir(e.name, e.md)
+		case ModeRegular:
+			data := []byte("data of " + e.name)
+			err = w.Create(e.name, e.md, int64(len(data)), content(data))
+		default:
+			err = w.Mknod(e.name, e.mode, e.md, e.major, e.minor)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := writeImage(t, w)
+	if fs.Label != "rootfs" {
+		t.Errorf("label %q, want rootfs", fs.Label)
+	}
+	inodes := tree(t, fs)
+	for _, e := range entries {
+		inode := lookup(t, inodes, e.name)
+		if inode.Type() != e.mode || inode.Perm() != e.md.Mode {
+			t.Errorf("%s: mode %#o, want %#o", e.name, inode.Mode, e.mode|e.md.Mode)
+		}
+		if inode.UID != e.md.UID || inode.GID != e.md.GID {
+			t.Errorf("%s: owner %d:%d, want %d:%d", e.name, inode.UID, inode.GID, e.md.UID, e.md.GID)
+		}
+		if !inode.Mtime.Equal(e.md.Mtime) {
+			t.Errorf("%s: mtime %s, want %s", e.name, inode.Mtime.UTC(), e.md.Mtime)
+		}
+		if inode.IsDevice() && (inode.Major != e.major || inode.Minor != e.minor) {
+			t.Errorf("%s: device %d:%d, want %d:%d", e.name, inode.Major, inode.Minor, e.major, e.minor)
+		}
+		if inode.IsRegular() {
+			if got, want := string(readFile(t, fs, inode)), "data of "+e.name; got != want {
+				t.Errorf("%s: content %q, want %q", e.name, got, want)
+			}
+		}
+	}
+	if lf := lookup(t, inodes, "lost+found"); !lf.IsDir() || lf.Perm() != 0700 {
+		t.Errorf("lost+found: mode %#o, want a 0700 directory", lf.Mode)
+	}
+}
+
+func TestWriterHardlinks(t *testing.T) {
+	w := newTestWriter(t)
+	for _, dir := range []string{"bin", "sbin", "usr", "usr/bin"} {
+		if err := w.Mkdir(dir, Metadata{Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []byte("#!/bin/busybox\n")
+	if err := w.Create("usr/bin/busybox", Metadata{Mode: 0755}, int64(len(data)), content(data)); err != nil {
+		t.Fatal(err)
+	}
+	links := []string{"bin/busybox", "sbin/init", "usr/bin/env"}
+	for _, name := range links {
+		if err := w.Link(name, "usr/bin/busybox"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Link("bin/root", "usr"); err == nil {
+		t.Error("hard link to a directory was accepted")
+	}
+
+	fs := writeImage(t, w)
+	inodes := tree(t, fs)
+	target := lookup(t, inodes, "usr/bin/busybox")
+	if target.Links != uint16(len(links)+1) {
+		t.Errorf("link count %d, want %d", target.Links, len(links)+1)
+	}
+	for _, name := range links {
+		if inode := lookup(t, inodes, name); inode.Num != target.Num {
+			t.Errorf("%s is inode %d, want %d shared with usr/bin/busybox", name, inode.Num, target.Num)
+		}
+	}
+	if got := readFile(t, fs, target); !bytes.Equal(got, data) {
+		t.Errorf("content %q, want %q", got, data)
+	}
+}
+
+func TestWriterSparseFiles(t *testing.T) {
+	const size = 10 << 20
+	tests := []struct {
+		name string
+		data []Range
+		// want are the block aligned ranges the image stores.
+		want []Range
+	}{
+		{
+			name: "holes",
+			data: []Range{{0, 100}, {4 << 20, 5000}, {size - 10, 10}},
+			want: []Range{{0, BlockSize}, {4 << 20, 2 * BlockSize}, {size - BlockSize, BlockSize}},
+		},
+		{
+			name: "leading hole",
+			data: []Range{{size / 2, BlockSize}},
+			want: []Range{{size / 2, BlockSize}},
+		},
+		{
+			name: "empty",
+			data: []Range{},
+		},
+	}
+	// More runs than fit in the inode need an extent tree block.
+	many := tests[0]
+	many.name, many.data, many.want = "extent tree", nil, nil
+	for i := int64(0); i < 12; i++ {
+		r := Range{Offset: i * (size / 12) &^ (BlockSize - 1), Length: BlockSize}
+		many.data = append(many.data, r)
+		many.want = append(many.want, r)
+	}
+	tests = append(tests, many)
+
+	w := newTestWriter(t)
+	files := map[string][]byte{}
+	for _, tt := range tests {
+		data := make([]byte, size)
+		for i, r := range tt.data {
+			for j := r.Offset; j < r.Offset+r.Length; j++ {
+				data[j] = byte(i + 1)
+			}
+		}
+		files[tt.name] = data
+		if err := w.CreateSparse(tt.name, Metadata{Mode: 0644}, size, tt.data, content(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := writeImage(t, w)
+	inodes := tree(t, fs)
+	for _, tt := range tests {
+		inode := lookup(t, inodes, tt.name)
+		f, err := fs.Open(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Ranges(); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: data ranges %v, want %v", tt.name, got, tt.want)
+		}
+		if got := readFile(t, fs, inode); !bytes.Equal(got, files[tt.name]) {
+			t.Errorf("%s: content differs", tt.name)
+		}
+
+		var blocks int64
+		for _, r := range tt.want {
+			blocks += r.Length / BlockSize
+		}
+		if len(tt.want) > extentsInInode {
+			blocks++
+		}
+		if got := int64(inode.blocks) / (BlockSize / 512); got != blocks {
+			t.Errorf("%s: %d blocks allocated, want %d", tt.name, got, blocks)
+		}
+	}
+}
+
+func TestWriterXattrs(t *testing.T) {
+	le := binary.LittleEndian
+	// cap_net_admin,cap_net_raw+ep, as setcap writes it.
+	capability := le.AppendUint32(nil, 0x02000001)
+	capability = le.AppendUint32(capability, 1<<12|1<<13)
+	capability = le.AppendUint32(capability, 0)
+	capability = le.AppendUint32(capability, 0)
+	capability = le.AppendUint32(capability, 0)
+
+	// user::rwx user:1000:r-x group::r-x mask::r-x other::---
+	acl := le.AppendUint32(nil, aclVFSVersion)
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 7, aclUndefinedID},
+		{aclUser, 5, 1000},
+		{0x04, 5, aclUndefinedID},
+		{0x10, 5, aclUndefinedID},
+		{0x20, 0, aclUndefinedID},
+	} {
+		acl = le.AppendUint16(acl, e.tag)
+		acl = le.AppendUint16(acl, e.perm)
+		acl = le.AppendUint32(acl, e.id)
+	}
+
+	files := map[string]map[string][]byte{
+		"ping": {"security.capability": capability},
+		"label": {
+			"security.selinux": []byte("system_u:object_r:bin_t:s0\x00"),
+			"user.comment":     []byte("kept"),
+		},
+		// Too large for the inode, so stored in an xattr block.
+		"big":  {"user.blob": bytes.Repeat([]byte("x"), 2000), "trusted.overlay.opaque": []byte("y")},
+		"none": nil,
+	}
+	dirAttrs := map[string][]byte{
+		"system.posix_acl_access":  acl,
+		"system.posix_acl_default": acl,
+	}
+
+	w := newTestWriter(t)
+	if err := w.Mkdir("shared", Metadata{Mode: 0775, Xattrs: dirAttrs}); err != nil {
+		t.Fatal(err)
+	}
+	for name, attrs := range files {
+		if err := w.Create(name, Metadata{Mode: 0755, Xattrs: attrs}, 3, content([]byte("abc"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Create("bad", Metadata{Xattrs: map[string][]byte{"nonsense": nil}}, 0, nil); err == nil {
+		t.Error("xattr without a known namespace was accepted")
+	}
+	files["shared"] = dirAttrs
+	consoleAttrs := map[string][]byte{"security.selinux": []byte("system_u:object_r:console_device_t:s0\x00")}
+	if err := w.Mknod("console", ModeChar, Metadata{Mode: 0600, Xattrs: consoleAttrs}, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	files["console"] = consoleAttrs
+
+	fs := writeImage(t, w)
+	inodes := tree(t, fs)
+	for name, want := range files {
+		inode := lookup(t, inodes, name)
+		got, err := fs.Xattrs(inode)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !maps.EqualFunc(got, want, bytes.Equal) {
+			t.Errorf("%s: xattrs %q, want %q", name, got, want)
+		}
+		if inode.IsRegular() && string(readFile(t, fs, inode)) != "abc" {
+			t.Errorf("%s: content changed", name)
+		}
+	}
+	if inode := lookup(t, inodes, "big"); inode.fileACL == 0 {
+		t.Error("big: xattrs not in a block")
+	}
+}
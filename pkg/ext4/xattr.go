@@ -0,0 +1,284 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	xattrMagic       = 0xEA020000
+	xattrBlockHeader = 32
+	xattrEntryHeader = 16
+	xattrMaxName     = 255
+
+	// Extended attributes stored in the inode follow the extra fields.
+	inodeXattrSpace = inodeSize - 128 - extraIsize - 4
+
+	aclDiskVersion = 1
+	aclVFSVersion  = 2
+	aclUser        = 0x02
+	aclGroup       = 0x08
+	aclUndefinedID = 0xFFFFFFFF
+)
+
+// xattrPrefixes maps the name index stored on disk to the attribute name
+// prefix it stands for.
+var xattrPrefixes = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+	7: "system.",
+	8: "system.richacl",
+}
+
+// Xattrs returns the extended attributes of an inode by full name, such as
+// security.capability. POSIX ACLs are converted to the format getxattr
+// returns. An inode without attributes yields nil.
+func (fs *FS) Xattrs(inode *Inode) (map[string][]byte, error) {
+	var attrs map[string][]byte
+	if inode.xattrs != nil {
+		attrs = map[string][]byte{}
+		if err := parseXattrs(inode.xattrs, 0, attrs); err != nil {
+			return nil, fmt.Errorf("inode %d: %w", inode.Num, err)
+		}
+	}
+
+	if inode.fileACL != 0 {
+		block, err := fs.readBlock(inode.fileACL)
+		if err != nil {
+			return nil, fmt.Errorf("inode %d: failed to read xattr block: %w", inode.Num, err)
+		}
+		if binary.LittleEndian.Uint32(block[0:]) != xattrMagic {
+			return nil, fmt.Errorf("inode %d: bad xattr block magic", inode.Num)
+		}
+		if attrs == nil {
+			attrs = map[string][]byte{}
+		}
+		if err := parseXattrs(block, xattrBlockHeader, attrs); err != nil {
+			return nil, fmt.Errorf("inode %d: %w", inode.Num, err)
+		}
+	}
+
+	return attrs, nil
+}
+
+// parseXattrs reads the entries starting at buf[start:]. Value offsets are
+// relative to the start of buf.
+func parseXattrs(buf []byte, start int, attrs map[string][]byte) error {
+	le := binary.LittleEndian
+	for pos := start; pos+4 <= len(buf) && le.Uint32(buf[pos:]) != 0; {
+		if pos+xattrEntryHeader > len(buf) {
+			return fmt.Errorf("truncated xattr entry")
+		}
+		nameLen := int(buf[pos])
+		index := buf[pos+1]
+		offs := int(le.Uint16(buf[pos+2:]))
+		size := int(le.Uint32(buf[pos+8:]))
+		if le.Uint32(buf[pos+4:]) != 0 {
+			return fmt.Errorf("unsupported ext4 feature: ea_inode")
+		}
+		if pos+xattrEntryHeader+nameLen > len(buf) || offs+size > len(buf) {
+			return fmt.Errorf("corrupt xattr entry")
+		}
+
+		name := xattrPrefixes[index] + string(buf[pos+xattrEntryHeader:pos+xattrEntryHeader+nameLen])
+		value := append([]byte{}, buf[offs:offs+size]...)
+		if index == 2 || index == 3 {
+			var err error
+			if value, err = aclFromDisk(value); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		attrs[name] = value
+
+		pos += xattrEntrySize(nameLen)
+	}
+	return nil
+}
+
+type xattrEntry struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+func xattrEntrySize(nameLen int) int { return (xattrEntryHeader + nameLen + 3) &^ 3 }
+
+func xattrValueSize(size int) int { return (size + 3) &^ 3 }
+
+// encodeXattrs lays out attrs for the space after the inode's extra fields
+// or, when they do not fit there, for a separate xattr block. Both results
+// are nil when there are no attributes.
+func encodeXattrs(attrs map[string][]byte) (inline, block []byte, err error) {
+	if len(attrs) == 0 {
+		return nil, nil, nil
+	}
+
+	entries := make([]xattrEntry, 0, len(attrs))
+	for name, value := range attrs {
+		index, suffix := xattrIndex(name)
+		if index == 0 || suffix == "" && index != 2 && index != 3 && index != 8 {
+			return nil, nil, fmt.Errorf("invalid xattr name %q", name)
+		}
+		if len(suffix) > xattrMaxName {
+			return nil, nil, fmt.Errorf("xattr name %q too long", name)
+		}
+		if index == 2 || index == 3 {
+			if value, err = aclToDisk(value); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		entries = append(entries, xattrEntry{index: index, name: suffix, value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	inline = make([]byte, inodeXattrSpace)
+	if putXattrs(inline, 0, entries) {
+		return inline, nil, nil
+	}
+
+	block = make([]byte, blockSize)
+	if !putXattrs(block, xattrBlockHeader, entries) {
+		return nil, nil, fmt.Errorf("extended attributes larger than one block")
+	}
+	le := binary.LittleEndian
+	le.PutUint32(block[0x00:], xattrMagic)
+	le.PutUint32(block[0x04:], 1)
+	le.PutUint32(block[0x08:], 1)
+	le.PutUint32(block[0x0C:], xattrBlockHash(entries))
+	return nil, block, nil
+}
+
+// xattrIndex splits name into the longest known prefix and the rest.
+func xattrIndex(name string) (uint8, string) {
+	var index uint8
+	var prefix string
+	for i, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p) && len(p) > len(prefix) {
+			index, prefix = i, p
+		}
+	}
+	return index, name[len(prefix):]
+}
+
+// putXattrs writes entries from buf[start:] and their values down from the
+// end of buf, leaving a zero terminator after the last entry. It reports
+// false when they do not fit.
+func putXattrs(buf []byte, start int, entries []xattrEntry) bool {
+	need := start + 4
+	for _, e := range entries {
+		need += xattrEntrySize(len(e.name)) + xattrValueSize(len(e.value))
+	}
+	if need > len(buf) {
+		return false
+	}
+
+	le := binary.LittleEndian
+	pos, end := start, len(buf)
+	for _, e := range entries {
+		offs := 0
+		if len(e.value) > 0 {
+			end -= xattrValueSize(len(e.value))
+			offs = end
+			copy(buf[end:], e.value)
+		}
+
+		buf[pos] = uint8(len(e.name))
+		buf[pos+1] = e.index
+		le.PutUint16(buf[pos+2:], uint16(offs))
+		le.PutUint32(buf[pos+8:], uint32(len(e.value)))
+		le.PutUint32(buf[pos+12:], xattrHash(e))
+		copy(buf[pos+xattrEntryHeader:], e.name)
+		pos += xattrEntrySize(len(e.name))
+	}
+	return true
+}
+
+// xattrHash is the per-entry hash e2fsck verifies for block entries.
+func xattrHash(e xattrEntry) uint32 {
+	var hash uint32
+	for i := 0; i < len(e.name); i++ {
+		hash = hash<<5 ^ hash>>27 ^ uint32(e.name[i])
+	}
+	padded := make([]byte, xattrValueSize(len(e.value)))
+	copy(padded, e.value)
+	for i := 0; i < len(padded); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ binary.LittleEndian.Uint32(padded[i:])
+	}
+	return hash
+}
+
+// xattrBlockHash combines the entry hashes into the block header hash.
+func xattrBlockHash(entries []xattrEntry) uint32 {
+	var hash uint32
+	for _, e := range entries {
+		h := xattrHash(e)
+		if h == 0 {
+			return 0
+		}
+		hash = hash<<16 ^ hash>>16 ^ h
+	}
+	return hash
+}
+
+// aclFromDisk converts a POSIX ACL from the compact ext4 format, where only
+// named user and group entries carry an id, to the getxattr format.
+func aclFromDisk(b []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(b) < 4 || le.Uint32(b) != aclDiskVersion {
+		return nil, fmt.Errorf("bad ACL header")
+	}
+
+	out := le.AppendUint32(nil, aclVFSVersion)
+	for pos := 4; pos < len(b); {
+		if pos+4 > len(b) {
+			return nil, fmt.Errorf("truncated ACL")
+		}
+		tag, perm := le.Uint16(b[pos:]), le.Uint16(b[pos+2:])
+		id := uint32(aclUndefinedID)
+		pos += 4
+		if tag == aclUser || tag == aclGroup {
+			if pos+4 > len(b) {
+				return nil, fmt.Errorf("truncated ACL")
+			}
+			id = le.Uint32(b[pos:])
+			pos += 4
+		}
+		out = le.AppendUint16(out, tag)
+		out = le.AppendUint16(out, perm)
+		out = le.AppendUint32(out, id)
+	}
+	return out, nil
+}
+
+// aclToDisk is the inverse of aclFromDisk.
+func aclToDisk(b []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(b) < 4 || le.Uint32(b) != aclVFSVersion || (len(b)-4)%8 != 0 {
+		return nil, fmt.Errorf("bad ACL header")
+	}
+
+	out := le.AppendUint32(nil, aclDiskVersion)
+	for pos := 4; pos < len(b); pos += 8 {
+		tag := le.Uint16(b[pos:])
+		out = le.AppendUint16(out, tag)
+		out = le.AppendUint16(out, le.Uint16(b[pos+2:]))
+		if tag == aclUser || tag == aclGroup {
+			out = le.AppendUint32(out, le.Uint32(b[pos+4:]))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,105 @@
+package index
+
+import (
+	"strings"
+	"unicode"
+)
+
+// CompareVersions compares two versions, or two names containing
+// versions, comparing runs of digits as numbers: 6.1.9 sorts before
+// 6.1.123 and openwrt-23.05.5 before openwrt-24.10.0. As in semver, a
+// "-" suffix marks a pre-release, so 6.6.0-rc1 sorts before 6.6.0 and
+// 6.6.0.1. It returns -1, 0 or +1.
+func CompareVersions(a, b string) int {
+	for a != "" && b != "" {
+		ca, restA := versionChunk(a)
+		cb, restB := versionChunk(b)
+		if c := compareChunks(ca, cb); c != 0 {
+			return c
+		}
+		a, b = restA, restB
+	}
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return preRelease(b, 1)
+	default:
+		return preRelease(a, -1)
+	}
+}
+
+// preRelease orders a version against itself with rest appended: below
+// it when rest is a pre-release suffix, else above. sign is 1 when rest
+// belongs to the right-hand side.
+func preRelease(rest string, sign int) int {
+	if strings.HasPrefix(rest, "-") {
+		return sign
+	}
+	return -sign
+}
+
+// versionChunk splits off the leading run of digits or of other
+// characters.
+func versionChunk(s string) (string, string) {
+	digit := isDigit(rune(s[0]))
+	i := strings.IndexFunc(s, func(r rune) bool { return isDigit(r) != digit })
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func compareChunks(a, b string) int {
+	if preA, preB := strings.HasPrefix(a, "-"), strings.HasPrefix(b, "-"); preA != preB {
+		if preA {
+			return -1
+		}
+		return 1
+	}
+	if isDigit(rune(a[0])) && isDigit(rune(b[0])) {
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			if len(a) < len(b) {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(r rune) bool {
+	return r < unicode.MaxASCII && unicode.IsDigit(r)
+}
+
+// Series returns the major.minor series of a kernel version, such as 6.1
+// for 6.1.123.
+func Series(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// Family returns name with every version in it replaced by "*", so that
+// openwrt-23.05.5-rootfs.img.gz and openwrt-24.10.0-rootfs.img.gz are of
+// the same family.
+func Family(name string) string {
+	var b strings.Builder
+	for name != "" {
+		chunk, rest := versionChunk(name)
+		if isDigit(rune(chunk[0])) {
+			// Take the dots and digits that follow as part of the version.
+			for len(rest) > 1 && rest[0] == '.' && isDigit(rune(rest[1])) {
+				_, rest = versionChunk(rest[1:])
+			}
+			b.WriteString("*")
+		} else {
+			b.WriteString(chunk)
+		}
+		name = rest
+	}
+	return b.String()
+}
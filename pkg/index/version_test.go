@@ -0,0 +1,63 @@
+package index
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"6.1.123", "6.1.123", 0},
+		{"6.1.9", "6.1.123", -1},
+		{"6.1.123", "6.6.1", -1},
+		{"5.15.100", "6.1.1", -1},
+		{"6.1", "6.1.1", -1},
+		{"06.1", "6.2", -1},
+		{"6.6.0-rc1", "6.6.0", -1},
+		{"6.6.0-rc1", "6.6.0-rc2", -1},
+		{"6.6.0-rc9", "6.6.0-rc10", -1},
+		{"6.6.0-rc1", "6.6.0.1", -1},
+		{"6.5.13", "6.6.0-rc1", -1},
+		{"openwrt-23.05.5", "openwrt-24.10.0", -1},
+		{"openwrt-24.10.0-rc1-rootfs.img.gz", "openwrt-24.10.0-rootfs.img.gz", -1},
+		{"a.img.gz", "b.img.gz", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestSeries(t *testing.T) {
+	tests := map[string]string{
+		"6.1.123":   "6.1",
+		"6.12.1":    "6.12",
+		"6.6.0-rc1": "6.6",
+		"6.1":       "6.1",
+		"6":         "6",
+	}
+	for version, want := range tests {
+		if got := Series(version); got != want {
+			t.Errorf("Series(%q) = %q, want %q", version, got, want)
+		}
+	}
+}
+
+func TestFamily(t *testing.T) {
+	tests := map[string]string{
+		"openwrt-23.05.5-vanila-armsr-armv8-generic-ext4-rootfs.img.gz": "openwrt-*-vanila-armsr-armv*-generic-ext*-rootfs.img.gz",
+		"openwrt-24.10.0-vanila-armsr-armv8-generic-ext4-rootfs.img.gz": "openwrt-*-vanila-armsr-armv*-generic-ext*-rootfs.img.gz",
+		"startup.tar.xz":   "startup.tar.xz",
+		"startup-2.tar.xz": "startup-*.tar.xz",
+		"x.img.gz":         "x.img.gz",
+	}
+	for name, want := range tests {
+		if got := Family(name); got != want {
+			t.Errorf("Family(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
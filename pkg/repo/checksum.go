@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// lfsPointerMax is larger than any Git LFS pointer file.
+const lfsPointerMax = 1024
+
+// RawFile opens the file at path as stored in the repository. For a file
+// kept in Git LFS that is its pointer, not the content.
+func (c *GitHubClient) RawFile(path string) (io.ReadCloser, error) {
+	url := fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s",
+		c.Owner, c.Repo, c.Branch, path)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GitHub raw error: %d for %s", resp.StatusCode, path)
+	}
+	return resp.Body, nil
+}
+
+// Checksum returns the SHA-256 and size of the file at path. Files kept in
+// Git LFS are not downloaded, as their pointer already records both.
+func (c *GitHubClient) Checksum(path string) (string, int64, error) {
+	body, err := c.RawFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer body.Close()
+
+	head := make([]byte, lfsPointerMax)
+	n, err := io.ReadFull(body, head)
+	head = head[:n]
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		if oid, size, ok := parseLFSPointer(head); ok {
+			return oid, size, nil
+		}
+	} else if err != nil {
+		return "", 0, err
+	}
+
+	h := sha256.New()
+	h.Write(head)
+	rest, err := io.Copy(h, body)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), int64(n) + rest, nil
+}
+
+// parseLFSPointer reads the oid and size from a Git LFS pointer file.
+func parseLFSPointer(data []byte) (string, int64, bool) {
+	if !bytes.HasPrefix(data, []byte("version https://git-lfs.github.com/spec/")) {
+		return "", 0, false
+	}
+
+	var oid string
+	size := int64(-1)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			if sum, ok := strings.CutPrefix(value, "sha256:"); ok {
+				oid = sum
+			}
+		case "size":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				size = n
+			}
+		}
+	}
+	if len(oid) != sha256.Size*2 || size < 0 {
+		return "", 0, false
+	}
+	return oid, size, true
+}
@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -16,10 +17,12 @@ type RepoConfig struct {
 }
 
 type RepositoryConfig struct {
+	Priority    int               `yaml:"priority"`
 	Type        string            `yaml:"type"`
 	URL         string            `yaml:"url"`
 	Branch      string            `yaml:"branch"`
 	Path        string            `yaml:"path"`
+	Token       string            `yaml:"token"`
 	CacheTTL    int               `yaml:"cache_ttl"`
 	Description string            `yaml:"description"`
 	Components  map[string]string `yaml:"components"`
@@ -39,18 +42,34 @@ func LoadConfig(configPath string) (*RepoConfig, error) {
 	return &cfg, nil
 }
 
-func LoadDataRepo(configPath string) (*RepositoryConfig, error) {
+// NamedRepository is a repositories entry of config.yaml.
+type NamedRepository struct {
+	Name string
+	RepositoryConfig
+}
+
+// LoadRepositories returns the repositories in configPath, highest
+// priority first. Repositories with the same priority are in name order.
+func LoadRepositories(configPath string) ([]NamedRepository, error) {
 	cfg, err := LoadConfig(configPath)
 	if err != nil {
 		return nil, err
 	}
-
-	repoCfg, ok := cfg.Repositories["data"]
-	if !ok {
-		return nil, fmt.Errorf("missing repositories.data in %s", configPath)
+	if len(cfg.Repositories) == 0 {
+		return nil, fmt.Errorf("no repositories in %s", configPath)
 	}
 
-	return &repoCfg, nil
+	var repos []NamedRepository
+	for name, r := range cfg.Repositories {
+		repos = append(repos, NamedRepository{Name: name, RepositoryConfig: r})
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		if repos[i].Priority != repos[j].Priority {
+			return repos[i].Priority > repos[j].Priority
+		}
+		return repos[i].Name < repos[j].Name
+	})
+	return repos, nil
 }
 
 func ParseRepoURL(repoURL string) (string, string, error) {
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type GitHubClient struct {
@@ -12,13 +14,29 @@ type GitHubClient struct {
 	Repo   string
 	Branch string
 	Token  string
+
+	// Client makes the requests; http.DefaultClient when nil.
+	Client *http.Client
+
+	// RateLimitWait is the longest a request waits for a rate limit to
+	// reset; zero means DefaultRateLimitWait. OnRateLimit, when set, is
+	// called before each wait.
+	RateLimitWait time.Duration
+	OnRateLimit   func(wait time.Duration)
+
+	treeOnce sync.Once
+	dirs     map[string][]GitHubContent
+	treeErr  error
 }
 
+// GitHubContent is a file or directory of the repository. SHA is the Git
+// blob SHA of a file, where the source knows it.
 type GitHubContent struct {
 	Name string `json:"name"`
 	Path string `json:"path"`
 	Type string `json:"type"`
 	Size int64  `json:"size"`
+	SHA  string `json:"sha"`
 }
 
 func NewGitHubClient(owner, repo, branch string) *GitHubClient {
@@ -29,7 +47,14 @@ func NewGitHubClient(owner, repo, branch string) *GitHubClient {
 	}
 }
 
+// ListContents lists path from the recursive tree of the branch, which is
+// fetched once, and falls back to the contents API when GitHub truncated
+// the tree.
 func (c *GitHubClient) ListContents(path string) ([]GitHubContent, error) {
+	if contents, ok, err := c.listTree(path); ok || err != nil {
+		return contents, err
+	}
+
 	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s",
 		c.Owner, c.Repo, path, c.Branch)
 
@@ -39,17 +64,16 @@ func (c *GitHubClient) ListContents(path string) ([]GitHubContent, error) {
 	}
 
 	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	if c.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+c.Token)
-	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return nil, fmt.Errorf("GitHub API error: %d - %s", resp.StatusCode, string(body))
@@ -62,3 +86,10 @@ func (c *GitHubClient) ListContents(path string) ([]GitHubContent, error) {
 
 	return contents, nil
 }
+
+func (c *GitHubClient) httpClient() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
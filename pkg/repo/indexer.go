@@ -3,6 +3,7 @@ package repo
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -10,13 +11,26 @@ import (
 )
 
 type Indexer struct {
-	client     *GitHubClient
+	// Repo is the name of the repository in config.yaml. Index entries
+	// record it, so files are downloaded from where they were indexed.
+	Repo string
+
+	// Known are files indexed before, by Git blob SHA. Their checksums
+	// are reused instead of downloading them again.
+	Known map[string]IndexFile
+
+	client     Source
 	components map[string]string
 }
 
 func NewIndexer(owner, repo, branch string, components map[string]string) *Indexer {
+	return NewSourceIndexer(NewGitHubClient(owner, repo, branch), components)
+}
+
+// NewSourceIndexer indexes any kind of data repository source.
+func NewSourceIndexer(src Source, components map[string]string) *Indexer {
 	return &Indexer{
-		client:     NewGitHubClient(owner, repo, branch),
+		client:     src,
 		components: components,
 	}
 }
@@ -30,33 +44,49 @@ func (idx *Indexer) FetchKernelIndex() (*KernelsYAML, error) {
 	var kernels []KernelIndex
 	for _, item := range contents {
 		if item.Type == "dir" {
-			vendor := "unknown"
-
 			kernelContents, err := idx.client.ListContents(item.Path)
-			if err == nil {
-				for _, file := range kernelContents {
-					if strings.HasPrefix(file.Name, "dtb-") && strings.HasSuffix(file.Name, ".tar.gz") {
-						parts := strings.Split(file.Name, "-")
-						if len(parts) >= 2 {
-							vendor = parts[1]
-						}
-						break
-					}
-				}
+			if err != nil {
+				return nil, fmt.Errorf("failed to list kernel %s: %w", item.Name, err)
 			}
 
-			kernels = append(kernels, KernelIndex{
+			kernel := KernelIndex{
 				Version: item.Name,
-				Vendor:  vendor,
+				Vendor:  "unknown",
 				Path:    item.Path,
-			})
+				Repo:    idx.Repo,
+			}
+			for _, file := range kernelContents {
+				if file.Type != "file" {
+					continue
+				}
+
+				entry, err := idx.indexFile(file, file.Name)
+				if err != nil {
+					return nil, err
+				}
+				if err := idx.describeKernelFile(file.Path, &entry, item.Name); err != nil {
+					return nil, err
+				}
+				if vendor := dtbVendor(file.Name, item.Name); vendor != "" {
+					kernel.Vendors = append(kernel.Vendors, vendor)
+				}
+				if entry.Release != "" {
+					kernel.Release = entry.Release
+				}
+				kernel.Files = append(kernel.Files, entry)
+			}
+			if len(kernel.Vendors) > 0 {
+				kernel.Vendor = kernel.Vendors[0]
+			}
+
+			kernels = append(kernels, kernel)
 		}
 	}
 
 	return &KernelsYAML{
 		Metadata: IndexMetadata{
 			Generated: time.Now().Format(time.RFC3339),
-			Source:    fmt.Sprintf("%s/%s (branch: %s)", idx.client.Owner, idx.client.Repo, idx.client.Branch),
+			Source:    idx.client.String(),
 		},
 		Kernels: kernels,
 	}, nil
@@ -71,16 +101,24 @@ func (idx *Indexer) FetchRootfsIndex() (*RootfsYAML, error) {
 	var rootfs []RootfsIndex
 	for _, item := range contents {
 		if item.Type == "file" && (item.Name != ".gitkeep" && item.Name != ".keep") {
+			entry, err := idx.indexFile(item, item.Name)
+			if err != nil {
+				return nil, err
+			}
+
 			rootfsType := "base"
-			if item.Size > 50*1024*1024 {
+			if entry.Size > 50*1024*1024 {
 				rootfsType = "custom"
 			}
 
 			rootfs = append(rootfs, RootfsIndex{
-				Name: item.Name,
-				Type: rootfsType,
-				Size: item.Size,
-				Path: item.Path,
+				Name:   item.Name,
+				Type:   rootfsType,
+				Size:   entry.Size,
+				Path:   item.Path,
+				SHA256: entry.SHA256,
+				Blob:   entry.Blob,
+				Repo:   idx.Repo,
 			})
 		}
 	}
@@ -88,7 +126,7 @@ func (idx *Indexer) FetchRootfsIndex() (*RootfsYAML, error) {
 	return &RootfsYAML{
 		Metadata: IndexMetadata{
 			Generated: time.Now().Format(time.RFC3339),
-			Source:    fmt.Sprintf("%s/%s (branch: %s)", idx.client.Owner, idx.client.Repo, idx.client.Branch),
+			Source:    idx.client.String(),
 		},
 		Rootfs: rootfs,
 	}, nil
@@ -121,6 +159,7 @@ func (idx *Indexer) FetchDeviceIndex() (*DevicesYAML, error) {
 				Name:   item.Name,
 				Vendor: vendor,
 				Path:   item.Path,
+				Repo:   idx.Repo,
 			})
 		}
 	}
@@ -128,7 +167,7 @@ func (idx *Indexer) FetchDeviceIndex() (*DevicesYAML, error) {
 	return &DevicesYAML{
 		Metadata: IndexMetadata{
 			Generated: time.Now().Format(time.RFC3339),
-			Source:    fmt.Sprintf("%s/%s (branch: %s)", idx.client.Owner, idx.client.Repo, idx.client.Branch),
+			Source:    idx.client.String(),
 		},
 		Devices: devices,
 	}, nil
@@ -143,10 +182,18 @@ func (idx *Indexer) FetchPatchIndex() (*PatchesYAML, error) {
 	var patches []PatchIndex
 	for _, item := range contents {
 		if item.Type == "file" && (item.Name != ".gitkeep" && item.Name != ".keep") {
+			entry, err := idx.indexFile(item, item.Name)
+			if err != nil {
+				return nil, err
+			}
+
 			patches = append(patches, PatchIndex{
-				Name: item.Name,
-				Size: item.Size,
-				Path: item.Path,
+				Name:   item.Name,
+				Size:   entry.Size,
+				Path:   item.Path,
+				SHA256: entry.SHA256,
+				Blob:   entry.Blob,
+				Repo:   idx.Repo,
 			})
 		}
 	}
@@ -154,12 +201,109 @@ func (idx *Indexer) FetchPatchIndex() (*PatchesYAML, error) {
 	return &PatchesYAML{
 		Metadata: IndexMetadata{
 			Generated: time.Now().Format(time.RFC3339),
-			Source:    fmt.Sprintf("%s/%s (branch: %s)", idx.client.Owner, idx.client.Repo, idx.client.Branch),
+			Source:    idx.client.String(),
 		},
 		Patches: patches,
 	}, nil
 }
 
+func (idx *Indexer) FetchLoaderIndex() (*LoadersYAML, error) {
+	contents, err := idx.client.ListContents(idx.componentPath("loader"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch loader: %w", err)
+	}
+
+	var loaders []LoaderIndex
+	for _, item := range contents {
+		if item.Type == "dir" {
+			files, err := idx.indexDir(item.Path, "")
+			if err != nil {
+				return nil, err
+			}
+
+			loaders = append(loaders, LoaderIndex{
+				Vendor: item.Name,
+				Path:   item.Path,
+				Repo:   idx.Repo,
+				Files:  files,
+			})
+		}
+	}
+
+	return &LoadersYAML{
+		Metadata: IndexMetadata{
+			Generated: time.Now().Format(time.RFC3339),
+			Source:    idx.client.String(),
+		},
+		Loaders: loaders,
+	}, nil
+}
+
+func (idx *Indexer) FetchFirmwareIndex() (*FirmwareYAML, error) {
+	dir := idx.componentPath("firmware")
+	files, err := idx.indexDir(dir, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch firmware: %w", err)
+	}
+
+	return &FirmwareYAML{
+		Metadata: IndexMetadata{
+			Generated: time.Now().Format(time.RFC3339),
+			Source:    idx.client.String(),
+		},
+		Firmware: FirmwareIndex{
+			Path:  dir,
+			Repo:  idx.Repo,
+			Files: files,
+		},
+	}, nil
+}
+
+// indexDir records every file below dir, named by its path below the
+// directory the walk started from.
+func (idx *Indexer) indexDir(dir, prefix string) ([]IndexFile, error) {
+	contents, err := idx.client.ListContents(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	var files []IndexFile
+	for _, item := range contents {
+		switch item.Type {
+		case "file":
+			if item.Name == ".gitkeep" || item.Name == ".keep" {
+				continue
+			}
+			entry, err := idx.indexFile(item, prefix+item.Name)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, entry)
+		case "dir":
+			sub, err := idx.indexDir(item.Path, prefix+item.Name+"/")
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+		}
+	}
+	return files, nil
+}
+
+// indexFile records item under name. A blob already in idx.Known is not
+// hashed again.
+func (idx *Indexer) indexFile(item GitHubContent, name string) (IndexFile, error) {
+	if known, ok := idx.Known[item.SHA]; ok && item.SHA != "" {
+		known.Name = name
+		return known, nil
+	}
+	sum, size, err := idx.client.Checksum(item.Path)
+	if err != nil {
+		return IndexFile{}, fmt.Errorf("failed to hash %s: %w", item.Path, err)
+	}
+	return IndexFile{Name: name, Size: size, SHA256: sum, Blob: item.SHA}, nil
+}
+
 func (idx *Indexer) componentPath(name string) string {
 	if idx.components == nil {
 		return name
@@ -186,3 +330,46 @@ func SaveIndex(path string, data interface{}) error {
 
 	return nil
 }
+
+// KnownFiles collects the files with a Git blob SHA from the index files
+// in dir, for Indexer.Known. Missing or unreadable indexes are skipped.
+func KnownFiles(dir string) map[string]IndexFile {
+	known := map[string]IndexFile{}
+	add := func(files ...IndexFile) {
+		for _, f := range files {
+			if f.Blob != "" && f.SHA256 != "" {
+				known[f.Blob] = f
+			}
+		}
+	}
+
+	var kernels KernelsYAML
+	if LoadIndex(filepath.Join(dir, "kernels.yaml"), &kernels) == nil {
+		for _, k := range kernels.Kernels {
+			add(k.Files...)
+		}
+	}
+	var rootfs RootfsYAML
+	if LoadIndex(filepath.Join(dir, "rootfs.yaml"), &rootfs) == nil {
+		for _, r := range rootfs.Rootfs {
+			add(IndexFile{Name: r.Name, Size: r.Size, SHA256: r.SHA256, Blob: r.Blob})
+		}
+	}
+	var patches PatchesYAML
+	if LoadIndex(filepath.Join(dir, "patch.yaml"), &patches) == nil {
+		for _, p := range patches.Patches {
+			add(IndexFile{Name: p.Name, Size: p.Size, SHA256: p.SHA256, Blob: p.Blob})
+		}
+	}
+	var loaders LoadersYAML
+	if LoadIndex(filepath.Join(dir, "loader.yaml"), &loaders) == nil {
+		for _, l := range loaders.Loaders {
+			add(l.Files...)
+		}
+	}
+	var firmware FirmwareYAML
+	if LoadIndex(filepath.Join(dir, "firmware.yaml"), &firmware) == nil {
+		add(firmware.Firmware.Files...)
+	}
+	return known
+}
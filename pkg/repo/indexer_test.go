@@ -0,0 +1,426 @@
+package repo
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testOwner  = "bobbyunknown"
+	testRepo   = "Oh-my-builder"
+	testBranch = "data"
+)
+
+// fakeGitHub serves the recorded tree in testdata/tree.json from the
+// GitHub API, with made-up content for its files on the raw and media
+// hosts. Kernel archives and rootfs images are in Git LFS, so the raw host
+// serves their pointers.
+type fakeGitHub struct {
+	tree      treeResponse
+	truncated bool
+	content   map[string][]byte
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "tree.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeGitHub{content: map[string][]byte{}}
+	if err := json.Unmarshal(data, &g.tree); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range g.tree.Tree {
+		if e.Type == "blob" {
+			g.content[e.Path] = []byte("content of " + e.Path + "\n")
+		}
+	}
+	g.content["kernels/6.1.9/dtb-allwinner-6.1.9.tar.gz"] = tarGz(t,
+		"allwinner/sun50i-h616-orangepi-zero2.dtb", "allwinner/sun50i-h618-orangepi-zero3.dtb", "allwinner/overlay/README")
+	g.content["kernels/6.1.9/dtb-rockchip-6.1.9.tar.gz"] = tarGz(t, "rockchip/rk3588-rock-5b.dtb")
+	g.content["kernels/6.1.9/modules-6.1.9.tar.gz"] = tarGz(t,
+		"lib/modules/6.1.9-ophub/modules.dep", "lib/modules/6.1.9-ophub/kernel/fs/ntfs3/ntfs3.ko")
+	g.content["kernels/6.1.9/boot-6.1.9.tar.gz"] = tarGz(t, "vmlinuz-6.1.9-ophub", "config-6.1.9-ophub")
+	return g
+}
+
+func tarGz(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, name := range names {
+		body := []byte(name)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(body)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func inLFS(p string) bool {
+	return strings.HasPrefix(p, "kernels/") || strings.HasPrefix(p, "rootfs/")
+}
+
+func (g *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Header.Get("X-Test-Host")
+	g.mu.Lock()
+	g.requests = append(g.requests, host+r.URL.Path)
+	g.mu.Unlock()
+
+	repoPrefix := "/repos/" + testOwner + "/" + testRepo
+	filePrefix := "/" + testOwner + "/" + testRepo + "/" + testBranch + "/"
+	switch {
+	case host == "api.github.com" && r.URL.Path == repoPrefix+"/git/trees/"+testBranch:
+		tree := g.tree
+		tree.Truncated = g.truncated
+		json.NewEncoder(w).Encode(tree)
+	case host == "api.github.com" && strings.HasPrefix(r.URL.Path, repoPrefix+"/contents/"):
+		g.serveContents(w, strings.Trim(strings.TrimPrefix(r.URL.Path, repoPrefix+"/contents/"), "/"))
+	case host == "raw.githubusercontent.com" && strings.HasPrefix(r.URL.Path, filePrefix):
+		p := strings.TrimPrefix(r.URL.Path, filePrefix)
+		content, ok := g.content[p]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if inLFS(p) {
+			sum := sha256.Sum256(content)
+			fmt.Fprintf(w, "version https://git-lfs.github.com/spec/v1\noid sha256:%x\nsize %d\n", sum, len(content))
+			return
+		}
+		w.Write(content)
+	case host == "media.githubusercontent.com" && strings.HasPrefix(r.URL.Path, "/media"+filePrefix):
+		content, ok := g.content[strings.TrimPrefix(r.URL.Path, "/media"+filePrefix)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveContents answers the contents API from the tree, as GitHub would
+// for a directory.
+func (g *fakeGitHub) serveContents(w http.ResponseWriter, dir string) {
+	contents := []GitHubContent{}
+	found := dir == ""
+	for _, e := range g.tree.Tree {
+		if e.Path == dir {
+			found = true
+		}
+		parent := path.Dir(e.Path)
+		if parent == "." {
+			parent = ""
+		}
+		if parent != dir {
+			continue
+		}
+		item := GitHubContent{Name: path.Base(e.Path), Path: e.Path, SHA: e.SHA, Size: e.Size, Type: "file"}
+		switch e.Type {
+		case "tree":
+			item.Type = "dir"
+		case "commit":
+			item.Type = "submodule"
+		}
+		contents = append(contents, item)
+	}
+	if !found {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+	sort.Slice(contents, func(i, j int) bool { return contents[i].Name < contents[j].Name })
+	json.NewEncoder(w).Encode(contents)
+}
+
+// take returns the requests made since the last call.
+func (g *fakeGitHub) take() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	requests := g.requests
+	g.requests = nil
+	return requests
+}
+
+// redirect sends every request to the test server, telling it which host
+// the request was for.
+type redirect struct {
+	target *url.URL
+}
+
+func (rt redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Test-Host", req.URL.Host)
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (g *fakeGitHub) client(t *testing.T) *GitHubClient {
+	t.Helper()
+	ts := httptest.NewServer(g)
+	t.Cleanup(ts.Close)
+	target, _ := url.Parse(ts.URL)
+
+	c := NewGitHubClient(testOwner, testRepo, testBranch)
+	c.Client = &http.Client{Transport: redirect{target}}
+	return c
+}
+
+// indexes holds every index fetched from one source.
+type indexes struct {
+	kernels  *KernelsYAML
+	rootfs   *RootfsYAML
+	devices  *DevicesYAML
+	patches  *PatchesYAML
+	loaders  *LoadersYAML
+	firmware *FirmwareYAML
+}
+
+func fetchAll(t *testing.T, idx *Indexer) indexes {
+	t.Helper()
+	var all indexes
+	var err error
+	if all.kernels, err = idx.FetchKernelIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if all.rootfs, err = idx.FetchRootfsIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if all.devices, err = idx.FetchDeviceIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if all.patches, err = idx.FetchPatchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if all.loaders, err = idx.FetchLoaderIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if all.firmware, err = idx.FetchFirmwareIndex(); err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+// save writes the indexes the way 'omb repo update' does, for
+// KnownFiles.
+func (all indexes) save(t *testing.T, dir string) {
+	t.Helper()
+	for name, data := range map[string]interface{}{
+		"kernels.yaml":  all.kernels,
+		"rootfs.yaml":   all.rootfs,
+		"devices.yaml":  all.devices,
+		"patch.yaml":    all.patches,
+		"loader.yaml":   all.loaders,
+		"firmware.yaml": all.firmware,
+	} {
+		if err := SaveIndex(filepath.Join(dir, name), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (g *fakeGitHub) file(t *testing.T, p, name string) IndexFile {
+	t.Helper()
+	for _, e := range g.tree.Tree {
+		if e.Path == p {
+			sum := sha256.Sum256(g.content[p])
+			return IndexFile{Name: name, Size: int64(len(g.content[p])), SHA256: hex.EncodeToString(sum[:]), Blob: e.SHA}
+		}
+	}
+	t.Fatalf("%s is not in the recorded tree", p)
+	return IndexFile{}
+}
+
+func (g *fakeGitHub) checkIndexes(t *testing.T, all indexes) {
+	t.Helper()
+
+	dtbAllwinner := g.file(t, "kernels/6.1.9/dtb-allwinner-6.1.9.tar.gz", "dtb-allwinner-6.1.9.tar.gz")
+	dtbAllwinner.DTBs = []string{"allwinner/sun50i-h616-orangepi-zero2.dtb", "allwinner/sun50i-h618-orangepi-zero3.dtb"}
+	dtbAllwinner.Described = true
+	dtbRockchip := g.file(t, "kernels/6.1.9/dtb-rockchip-6.1.9.tar.gz", "dtb-rockchip-6.1.9.tar.gz")
+	dtbRockchip.DTBs = []string{"rockchip/rk3588-rock-5b.dtb"}
+	dtbRockchip.Described = true
+	modules := g.file(t, "kernels/6.1.9/modules-6.1.9.tar.gz", "modules-6.1.9.tar.gz")
+	modules.Release = "6.1.9-ophub"
+	modules.Described = true
+	wantKernels := []KernelIndex{{
+		Version: "6.1.9",
+		Release: "6.1.9-ophub",
+		Vendor:  "allwinner",
+		Vendors: []string{"allwinner", "rockchip"},
+		Path:    "kernels/6.1.9",
+		Files: []IndexFile{
+			g.file(t, "kernels/6.1.9/boot-6.1.9.tar.gz", "boot-6.1.9.tar.gz"),
+			dtbAllwinner,
+			dtbRockchip,
+			modules,
+		},
+	}}
+	if !reflect.DeepEqual(all.kernels.Kernels, wantKernels) {
+		t.Errorf("kernels:\n got %+v\nwant %+v", all.kernels.Kernels, wantKernels)
+	}
+
+	image := g.file(t, "rootfs/openwrt-24.10.0-rootfs.img.gz", "")
+	wantRootfs := []RootfsIndex{{
+		Name:   "openwrt-24.10.0-rootfs.img.gz",
+		Type:   "base",
+		Size:   image.Size,
+		Path:   "rootfs/openwrt-24.10.0-rootfs.img.gz",
+		SHA256: image.SHA256,
+		Blob:   image.Blob,
+	}}
+	if !reflect.DeepEqual(all.rootfs.Rootfs, wantRootfs) {
+		t.Errorf("rootfs:\n got %+v\nwant %+v", all.rootfs.Rootfs, wantRootfs)
+	}
+
+	wantDevices := []DeviceIndex{
+		{Name: "h616-orangepi-zero2", Vendor: "allwinner", Path: "devices/h616-orangepi-zero2"},
+		{Name: "rk3588-rock-5b", Vendor: "rockchip", Path: "devices/rk3588-rock-5b"},
+		{Name: "s905x3-x96max", Vendor: "amlogic", Path: "devices/s905x3-x96max"},
+	}
+	if !reflect.DeepEqual(all.devices.Devices, wantDevices) {
+		t.Errorf("devices:\n got %+v\nwant %+v", all.devices.Devices, wantDevices)
+	}
+
+	patch := g.file(t, "patch/fix-wifi.patch", "")
+	wantPatches := []PatchIndex{{
+		Name:   "fix-wifi.patch",
+		Size:   patch.Size,
+		Path:   "patch/fix-wifi.patch",
+		SHA256: patch.SHA256,
+		Blob:   patch.Blob,
+	}}
+	if !reflect.DeepEqual(all.patches.Patches, wantPatches) {
+		t.Errorf("patches:\n got %+v\nwant %+v", all.patches.Patches, wantPatches)
+	}
+
+	wantLoaders := []LoaderIndex{{
+		Vendor: "rockchip",
+		Path:   "loader/rockchip",
+		Files: []IndexFile{
+			g.file(t, "loader/rockchip/rk3588/idbloader.img", "rk3588/idbloader.img"),
+			g.file(t, "loader/rockchip/rk3588/u-boot.itb", "rk3588/u-boot.itb"),
+		},
+	}}
+	if !reflect.DeepEqual(all.loaders.Loaders, wantLoaders) {
+		t.Errorf("loaders:\n got %+v\nwant %+v", all.loaders.Loaders, wantLoaders)
+	}
+
+	wantFirmware := FirmwareIndex{
+		Path: "firmware",
+		Files: []IndexFile{
+			g.file(t, "firmware/brcm/brcmfmac43455-sdio.bin", "brcm/brcmfmac43455-sdio.bin"),
+			g.file(t, "firmware/regulatory.db", "regulatory.db"),
+		},
+	}
+	if !reflect.DeepEqual(all.firmware.Firmware, wantFirmware) {
+		t.Errorf("firmware:\n got %+v\nwant %+v", all.firmware.Firmware, wantFirmware)
+	}
+}
+
+func TestIndexerRecordedTree(t *testing.T) {
+	g := newFakeGitHub(t)
+	all := fetchAll(t, NewSourceIndexer(g.client(t), nil))
+	g.checkIndexes(t, all)
+
+	var trees int
+	for _, r := range g.take() {
+		if strings.Contains(r, "/contents/") {
+			t.Errorf("listed %s although the tree was complete", r)
+		}
+		if strings.Contains(r, "/git/trees/") {
+			trees++
+		}
+	}
+	if trees != 1 {
+		t.Errorf("fetched the tree %d times, want once", trees)
+	}
+}
+
+func TestIndexerTruncatedTree(t *testing.T) {
+	g := newFakeGitHub(t)
+	g.truncated = true
+	all := fetchAll(t, NewSourceIndexer(g.client(t), nil))
+	g.checkIndexes(t, all)
+
+	var listed bool
+	for _, r := range g.take() {
+		if strings.Contains(r, "/contents/") {
+			listed = true
+		}
+	}
+	if !listed {
+		t.Error("truncated tree was used instead of the contents API")
+	}
+}
+
+func TestIndexerSkipsKnownBlobs(t *testing.T) {
+	g := newFakeGitHub(t)
+	dir := t.TempDir()
+	fetchAll(t, NewSourceIndexer(g.client(t), nil)).save(t, dir)
+	g.take()
+
+	idx := NewSourceIndexer(g.client(t), nil)
+	idx.Known = KnownFiles(dir)
+	all := fetchAll(t, idx)
+	g.checkIndexes(t, all)
+	for _, r := range g.take() {
+		if !strings.HasPrefix(r, "api.github.com") {
+			t.Errorf("downloaded %s although its blob is known", r)
+		}
+	}
+
+	// Known kernel archives from an index without the marker are read
+	// once more, but not hashed.
+	idx = NewSourceIndexer(g.client(t), nil)
+	idx.Known = KnownFiles(dir)
+	for blob, f := range idx.Known {
+		f.Described = false
+		idx.Known[blob] = f
+	}
+	g.checkIndexes(t, fetchAll(t, idx))
+	var media []string
+	for _, r := range g.take() {
+		if strings.HasPrefix(r, "raw.githubusercontent.com") {
+			t.Errorf("hashed %s although its blob is known", r)
+		}
+		if strings.HasPrefix(r, "media.githubusercontent.com") {
+			media = append(media, path.Base(r))
+		}
+	}
+	sort.Strings(media)
+	want := []string{"dtb-allwinner-6.1.9.tar.gz", "dtb-rockchip-6.1.9.tar.gz", "modules-6.1.9.tar.gz"}
+	if !reflect.DeepEqual(media, want) {
+		t.Errorf("read %v, want %v", media, want)
+	}
+}
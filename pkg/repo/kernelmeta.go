@@ -0,0 +1,121 @@
+package repo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// dtbVendor returns the vendor of a dtb-<vendor>-<version>.tar.gz file of
+// kernel version, or "" for any other file.
+func dtbVendor(name, version string) string {
+	if !strings.HasPrefix(name, "dtb-") || !strings.HasSuffix(name, ".tar.gz") {
+		return ""
+	}
+	vendor := strings.TrimPrefix(name, "dtb-")
+	if v, ok := strings.CutSuffix(vendor, "-"+version+".tar.gz"); ok {
+		return v
+	}
+	vendor, _, _ = strings.Cut(vendor, "-")
+	return vendor
+}
+
+// readTarGz calls fn with every entry of a .tar.gz stream until fn
+// returns false.
+func readTarGz(r io.Reader, fn func(name string) bool) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if !fn(name) {
+			return nil
+		}
+	}
+}
+
+// dtbNames lists the device trees in a dtb archive, by their path inside
+// it.
+func dtbNames(r io.Reader) ([]string, error) {
+	var names []string
+	err := readTarGz(r, func(name string) bool {
+		if strings.HasSuffix(name, ".dtb") {
+			names = append(names, name)
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// moduleRelease returns the kernel release a modules archive is for: the
+// directory the modules are in, at the top of the archive or below
+// lib/modules, or "" when there is none. Only the entries up to the first
+// module directory are read.
+func moduleRelease(r io.Reader) (string, error) {
+	var release string
+	err := readTarGz(r, func(name string) bool {
+		name = strings.TrimPrefix(name, "lib/modules/")
+		first, _, _ := strings.Cut(name, "/")
+		if first != "." && first != "lib" && strings.ContainsAny(first, "0123456789") {
+			release = first
+			return false
+		}
+		return true
+	})
+	return release, err
+}
+
+// describeKernelFile adds what the index records about the content of a
+// kernel bundle file: the device trees of a dtb archive and the release
+// of a modules archive. Files already described, such as Known blobs, are
+// left alone, so each archive is downloaded once.
+func (idx *Indexer) describeKernelFile(p string, f *IndexFile, version string) error {
+	if f.Described {
+		return nil
+	}
+	var read func(io.Reader) error
+	switch {
+	case dtbVendor(f.Name, version) != "":
+		read = func(r io.Reader) error {
+			names, err := dtbNames(r)
+			f.DTBs = names
+			return err
+		}
+	case strings.HasPrefix(f.Name, "modules-") && strings.HasSuffix(f.Name, ".tar.gz"):
+		read = func(r io.Reader) error {
+			release, err := moduleRelease(r)
+			f.Release = release
+			return err
+		}
+	default:
+		return nil
+	}
+
+	body, err := idx.client.Open(p)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", p, err)
+	}
+	defer body.Close()
+	if err := read(body); err != nil {
+		return fmt.Errorf("failed to read %s: %w", p, err)
+	}
+	f.Described = true
+	return nil
+}
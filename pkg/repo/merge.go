@@ -0,0 +1,118 @@
+package repo
+
+import "strings"
+
+// MergeKernels combines the kernel indexes of several repositories, given
+// highest priority first. A version is taken from the first repository
+// that has it, so a higher priority repository overrides a lower one. The
+// other Merge functions do the same by file name, device and vendor.
+func MergeKernels(indexes []*KernelsYAML) *KernelsYAML {
+	merged := &KernelsYAML{}
+	var lists [][]KernelIndex
+	var metas []IndexMetadata
+	for _, index := range indexes {
+		lists = append(lists, index.Kernels)
+		metas = append(metas, index.Metadata)
+	}
+	merged.Metadata = mergeMetadata(metas)
+	merged.Kernels = mergeEntries(lists, func(k KernelIndex) string { return k.Version })
+	return merged
+}
+
+func MergeRootfs(indexes []*RootfsYAML) *RootfsYAML {
+	merged := &RootfsYAML{}
+	var lists [][]RootfsIndex
+	var metas []IndexMetadata
+	for _, index := range indexes {
+		lists = append(lists, index.Rootfs)
+		metas = append(metas, index.Metadata)
+	}
+	merged.Metadata = mergeMetadata(metas)
+	merged.Rootfs = mergeEntries(lists, func(r RootfsIndex) string { return r.Name })
+	return merged
+}
+
+func MergeDevices(indexes []*DevicesYAML) *DevicesYAML {
+	merged := &DevicesYAML{}
+	var lists [][]DeviceIndex
+	var metas []IndexMetadata
+	for _, index := range indexes {
+		lists = append(lists, index.Devices)
+		metas = append(metas, index.Metadata)
+	}
+	merged.Metadata = mergeMetadata(metas)
+	merged.Devices = mergeEntries(lists, func(d DeviceIndex) string { return d.Name })
+	return merged
+}
+
+func MergePatches(indexes []*PatchesYAML) *PatchesYAML {
+	merged := &PatchesYAML{}
+	var lists [][]PatchIndex
+	var metas []IndexMetadata
+	for _, index := range indexes {
+		lists = append(lists, index.Patches)
+		metas = append(metas, index.Metadata)
+	}
+	merged.Metadata = mergeMetadata(metas)
+	merged.Patches = mergeEntries(lists, func(p PatchIndex) string { return p.Name })
+	return merged
+}
+
+func MergeLoaders(indexes []*LoadersYAML) *LoadersYAML {
+	merged := &LoadersYAML{}
+	var lists [][]LoaderIndex
+	var metas []IndexMetadata
+	for _, index := range indexes {
+		lists = append(lists, index.Loaders)
+		metas = append(metas, index.Metadata)
+	}
+	merged.Metadata = mergeMetadata(metas)
+	merged.Loaders = mergeEntries(lists, func(l LoaderIndex) string { return l.Vendor })
+	return merged
+}
+
+// MergeFirmware takes the whole firmware folder from the first repository
+// that has one.
+func MergeFirmware(indexes []*FirmwareYAML) *FirmwareYAML {
+	merged := &FirmwareYAML{}
+	var metas []IndexMetadata
+	for _, index := range indexes {
+		metas = append(metas, index.Metadata)
+	}
+	merged.Metadata = mergeMetadata(metas)
+	for _, index := range indexes {
+		if len(index.Firmware.Files) > 0 {
+			merged.Firmware = index.Firmware
+			break
+		}
+	}
+	return merged
+}
+
+func mergeEntries[T any](lists [][]T, key func(T) string) []T {
+	seen := map[string]bool{}
+	var merged []T
+	for _, list := range lists {
+		for _, entry := range list {
+			if k := key(entry); !seen[k] {
+				seen[k] = true
+				merged = append(merged, entry)
+			}
+		}
+	}
+	return merged
+}
+
+func mergeMetadata(metas []IndexMetadata) IndexMetadata {
+	if len(metas) == 0 {
+		return IndexMetadata{}
+	}
+	var sources []string
+	for _, meta := range metas {
+		sources = append(sources, meta.Source)
+	}
+	return IndexMetadata{
+		Generated: metas[0].Generated,
+		Source:    strings.Join(sources, ", "),
+	}
+}
@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRateLimitWait is how long a request refused by a rate limit
+// waits for it to reset before giving up.
+const DefaultRateLimitWait = 2 * time.Minute
+
+// rateLimitRetries bounds the waits for one request.
+const rateLimitRetries = 3
+
+// GitHubToken returns the token for a repository: the one in config.yaml
+// when set, else OMB_GITHUB_TOKEN, else GITHUB_TOKEN.
+func GitHubToken(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if token := os.Getenv("OMB_GITHUB_TOKEN"); token != "" {
+		return token
+	}
+	return os.Getenv("GITHUB_TOKEN")
+}
+
+// RateLimitError is returned when a server, usually GitHub, refuses
+// requests until a rate limit resets and that is too far away to wait for.
+type RateLimitError struct {
+	Host          string
+	Reset         time.Time
+	Authenticated bool
+}
+
+func (e *RateLimitError) Error() string {
+	msg := fmt.Sprintf("rate limit of %s exceeded, try again after %s", e.Host, e.Reset.Local().Format("15:04:05"))
+	if !e.Authenticated && strings.Contains(e.Host, "github") {
+		msg += " or set GITHUB_TOKEN (or OMB_GITHUB_TOKEN) for a higher limit"
+	}
+	return msg
+}
+
+// RateLimitWait reports whether resp was refused by a rate limit, going by
+// its Retry-After and X-RateLimit headers, and how long to wait before
+// trying again.
+func RateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if after := resp.Header.Get("Retry-After"); after != "" {
+		if secs, err := strconv.Atoi(after); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+		if at, err := http.ParseTime(after); err == nil {
+			return max(time.Until(at), 0), true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Minute, true
+	}
+	// A second more, for clocks that are slightly off.
+	return max(time.Until(time.Unix(reset, 0)), 0) + time.Second, true
+}
+
+// do sends req with the token, if any. A rate limit that resets within
+// c.RateLimitWait is waited out; a later one is a RateLimitError.
+func (c *GitHubClient) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	limit := c.RateLimitWait
+	if limit <= 0 {
+		limit = DefaultRateLimitWait
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		wait, limited := RateLimitWait(resp)
+		if !limited {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if wait > limit || attempt > rateLimitRetries {
+			return nil, &RateLimitError{Host: req.URL.Host, Reset: time.Now().Add(wait), Authenticated: c.Token != ""}
+		}
+
+		if c.OnRateLimit != nil {
+			c.OnRateLimit(wait)
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
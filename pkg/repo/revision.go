@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Revisioner is a Source that can tell which revision of the repository
+// it serves, so indexes built from that revision need not be fetched
+// again.
+type Revisioner interface {
+	Revision() (string, error)
+}
+
+// Revision returns the SHA of the head commit of the branch.
+func (c *GitHubClient) Revision() (string, error) {
+	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/commits/%s", c.Owner, c.Repo, c.Branch)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github.sha")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("GitHub API error: %d - %s", resp.StatusCode, string(body))
+	}
+	sha, err := io.ReadAll(io.LimitReader(resp.Body, 128))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(sha)), nil
+}
+
+// Revision returns the ETag of the mirror index, or its SHA-256 when the
+// server sends none.
+func (s *MirrorSource) Revision() (string, error) {
+	if _, err := s.index(); err != nil {
+		return "", err
+	}
+	if s.etag != "" {
+		return s.etag, nil
+	}
+	return "sha256:" + s.sum, nil
+}
+
+// Revision returns the revision of the source, or "" when the source
+// cannot tell.
+func (idx *Indexer) Revision() (string, error) {
+	if r, ok := idx.client.(Revisioner); ok {
+		return r.Revision()
+	}
+	return "", nil
+}
+
+// Index is implemented by the index file types.
+type Index interface {
+	Meta() *IndexMetadata
+	Len() int
+}
+
+func (y *KernelsYAML) Meta() *IndexMetadata  { return &y.Metadata }
+func (y *KernelsYAML) Len() int              { return len(y.Kernels) }
+func (y *RootfsYAML) Meta() *IndexMetadata   { return &y.Metadata }
+func (y *RootfsYAML) Len() int               { return len(y.Rootfs) }
+func (y *DevicesYAML) Meta() *IndexMetadata  { return &y.Metadata }
+func (y *DevicesYAML) Len() int              { return len(y.Devices) }
+func (y *PatchesYAML) Meta() *IndexMetadata  { return &y.Metadata }
+func (y *PatchesYAML) Len() int              { return len(y.Patches) }
+func (y *LoadersYAML) Meta() *IndexMetadata  { return &y.Metadata }
+func (y *LoadersYAML) Len() int              { return len(y.Loaders) }
+func (y *FirmwareYAML) Meta() *IndexMetadata { return &y.Metadata }
+func (y *FirmwareYAML) Len() int             { return len(y.Firmware.Files) }
+
+// LoadIndex reads an index file written by SaveIndex.
+func LoadIndex(path string, v Index) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, v)
+}
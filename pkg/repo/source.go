@@ -0,0 +1,364 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Source is a copy of the data repository: the GitHub branch, a local
+// directory laid out like it, or a static HTTP mirror.
+type Source interface {
+	// ListContents lists the files and directories directly below dir.
+	ListContents(dir string) ([]GitHubContent, error)
+	// Checksum returns the SHA-256 and size of a file.
+	Checksum(path string) (string, int64, error)
+	// FileURL is where a file is downloaded from. Local sources use
+	// file:// URLs, which NewFileTransport serves.
+	FileURL(path string) string
+	// Open reads the content of a file, also of one kept in Git LFS.
+	Open(path string) (io.ReadCloser, error)
+	String() string
+}
+
+// ErrNotFound is returned by a Source for a directory it does not have.
+var ErrNotFound = errors.New("not found in repository")
+
+// Archiver is a Source that can hand out the whole repository as one zip
+// archive, with everything below a single top-level directory.
+type Archiver interface {
+	ArchiveURL() string
+}
+
+// NewSource returns the source for a repositories entry of config.yaml.
+// type github (the default) and http read url; type local reads path, or
+// url when path is empty. GitHub sources use token, or the one from the
+// environment (see GitHubToken).
+func NewSource(typ, repoURL, branch, dir, token string) (Source, error) {
+	switch typ {
+	case "", "github":
+		owner, name, err := ParseRepoURL(repoURL)
+		if err != nil {
+			return nil, err
+		}
+		client := NewGitHubClient(owner, name, branch)
+		client.Token = GitHubToken(token)
+		return client, nil
+	case "local":
+		if dir == "" {
+			dir = repoURL
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("local repository needs a path")
+		}
+		return &LocalSource{Dir: dir}, nil
+	case "http":
+		if repoURL == "" {
+			return nil, fmt.Errorf("http repository needs a url")
+		}
+		return &MirrorSource{URL: strings.TrimSuffix(repoURL, "/")}, nil
+	}
+	return nil, fmt.Errorf("unknown repository type %q (want github, local or http)", typ)
+}
+
+func (c *GitHubClient) FileURL(p string) string {
+	// Kernels, rootfs images and device files are stored in Git LFS.
+	if strings.HasPrefix(p, "kernels/") || strings.HasPrefix(p, "rootfs/") || strings.HasPrefix(p, "devices/") {
+		return fmt.Sprintf("https://media.githubusercontent.com/media/%s/%s/%s/%s", c.Owner, c.Repo, c.Branch, p)
+	}
+	return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s", c.Owner, c.Repo, c.Branch, p)
+}
+
+func (c *GitHubClient) Open(p string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.FileURL(p), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GitHub download error: %d for %s", resp.StatusCode, p)
+	}
+	return resp.Body, nil
+}
+
+func (c *GitHubClient) ArchiveURL() string {
+	return fmt.Sprintf("https://api.github.com/repos/%s/%s/zipball/%s", c.Owner, c.Repo, c.Branch)
+}
+
+func (c *GitHubClient) String() string {
+	return fmt.Sprintf("%s/%s (branch: %s)", c.Owner, c.Repo, c.Branch)
+}
+
+// LocalSource is a directory laid out like the data branch, such as a
+// checkout of it with the LFS files pulled.
+type LocalSource struct {
+	Dir string
+}
+
+func (s *LocalSource) ListContents(dir string) ([]GitHubContent, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Dir, filepath.FromSlash(dir)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", dir, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contents []GitHubContent
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		item := GitHubContent{Name: e.Name(), Path: path.Join(dir, e.Name()), Type: "file", Size: info.Size()}
+		if e.IsDir() {
+			item.Type = "dir"
+			item.Size = 0
+		}
+		contents = append(contents, item)
+	}
+	return contents, nil
+}
+
+func (s *LocalSource) Checksum(p string) (string, int64, error) {
+	f, err := os.Open(filepath.Join(s.Dir, filepath.FromSlash(p)))
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func (s *LocalSource) Open(p string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Dir, filepath.FromSlash(p)))
+}
+
+func (s *LocalSource) FileURL(p string) string {
+	abs, err := filepath.Abs(filepath.Join(s.Dir, filepath.FromSlash(p)))
+	if err != nil {
+		abs = filepath.Join(s.Dir, filepath.FromSlash(p))
+	}
+	slashed := filepath.ToSlash(abs)
+	if !strings.HasPrefix(slashed, "/") {
+		// A Windows drive letter.
+		slashed = "/" + slashed
+	}
+	return (&url.URL{Scheme: "file", Path: slashed}).String()
+}
+
+func (s *LocalSource) String() string {
+	return s.Dir
+}
+
+// NewFileTransport serves the file:// URLs of local sources, so they can
+// be fetched like any other. Register it with
+// http.Transport.RegisterProtocol.
+func NewFileTransport() http.RoundTripper {
+	return http.NewFileTransport(localFS{})
+}
+
+type localFS struct{}
+
+func (localFS) Open(name string) (http.File, error) {
+	if len(name) > 2 && name[0] == '/' && name[2] == ':' {
+		name = name[1:]
+	}
+	return os.Open(filepath.FromSlash(name))
+}
+
+// MirrorIndexFile is the name of the file list a MirrorSource reads from
+// the root of the mirror.
+const MirrorIndexFile = "index.yaml"
+
+// MirrorIndex lists every file of a mirror.
+type MirrorIndex struct {
+	Files []MirrorFile `yaml:"files"`
+}
+
+type MirrorFile struct {
+	Path   string `yaml:"path"`
+	Size   int64  `yaml:"size"`
+	SHA256 string `yaml:"sha256"`
+}
+
+// MirrorSource is a static HTTP server with a copy of the data branch
+// below URL and a MirrorIndexFile listing its files.
+type MirrorSource struct {
+	URL    string
+	Client *http.Client
+
+	once  sync.Once
+	files map[string]MirrorFile
+	etag  string
+	sum   string
+	err   error
+}
+
+func (s *MirrorSource) index() (map[string]MirrorFile, error) {
+	s.once.Do(func() {
+		client := s.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Get(s.URL + "/" + MirrorIndexFile)
+		if err != nil {
+			s.err = fmt.Errorf("failed to fetch mirror index: %w", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			s.err = fmt.Errorf("failed to fetch mirror index: HTTP %d", resp.StatusCode)
+			return
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			s.err = fmt.Errorf("failed to fetch mirror index: %w", err)
+			return
+		}
+		var index MirrorIndex
+		if err := yaml.Unmarshal(data, &index); err != nil {
+			s.err = fmt.Errorf("failed to parse mirror index: %w", err)
+			return
+		}
+		sum := sha256.Sum256(data)
+		s.sum = hex.EncodeToString(sum[:])
+		s.etag = resp.Header.Get("ETag")
+		s.files = map[string]MirrorFile{}
+		for _, f := range index.Files {
+			s.files[path.Clean(f.Path)] = f
+		}
+	})
+	return s.files, s.err
+}
+
+func (s *MirrorSource) ListContents(dir string) ([]GitHubContent, error) {
+	files, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		prefix = dir + "/"
+	}
+	seen := map[string]bool{}
+	var contents []GitHubContent
+	for p, f := range files {
+		rest, ok := strings.CutPrefix(p, prefix)
+		if !ok {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if isDir {
+			contents = append(contents, GitHubContent{Name: name, Path: prefix + name, Type: "dir"})
+		} else {
+			contents = append(contents, GitHubContent{Name: name, Path: p, Type: "file", Size: f.Size})
+		}
+	}
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("%s: %w", dir, ErrNotFound)
+	}
+	sort.Slice(contents, func(i, j int) bool { return contents[i].Name < contents[j].Name })
+	return contents, nil
+}
+
+func (s *MirrorSource) Checksum(p string) (string, int64, error) {
+	files, err := s.index()
+	if err != nil {
+		return "", 0, err
+	}
+	f, ok := files[path.Clean(p)]
+	if !ok || f.SHA256 == "" {
+		return "", 0, fmt.Errorf("%s: no checksum in mirror index", p)
+	}
+	return f.SHA256, f.Size, nil
+}
+
+func (s *MirrorSource) FileURL(p string) string {
+	return s.URL + "/" + strings.TrimPrefix(p, "/")
+}
+
+func (s *MirrorSource) Open(p string) (io.ReadCloser, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(s.FileURL(p))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("mirror download error: %d for %s", resp.StatusCode, p)
+	}
+	return resp.Body, nil
+}
+
+func (s *MirrorSource) String() string {
+	return s.URL
+}
+
+// BuildMirrorIndex lists every file below dir with its size and SHA-256,
+// for serving dir as a mirror.
+func BuildMirrorIndex(dir string) (*MirrorIndex, error) {
+	src := &LocalSource{Dir: dir}
+	var index MirrorIndex
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || rel == MirrorIndexFile {
+			return nil
+		}
+
+		sum, size, err := src.Checksum(rel)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", rel, err)
+		}
+		index.Files = append(index.Files, MirrorFile{Path: rel, Size: size, SHA256: sum})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
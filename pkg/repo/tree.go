@@ -0,0 +1,111 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// treeEntry is one entry of a Git Trees API response. Type is "blob" for
+// files and "tree" for directories.
+type treeEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	SHA  string `json:"sha"`
+	Size int64  `json:"size"`
+}
+
+type treeResponse struct {
+	SHA       string      `json:"sha"`
+	Tree      []treeEntry `json:"tree"`
+	Truncated bool        `json:"truncated"`
+}
+
+// tree fetches the whole branch with one recursive Git Trees API request,
+// on first use. It returns nil when GitHub truncated the listing, in which
+// case the branch is listed directory by directory instead.
+func (c *GitHubClient) tree() (map[string][]GitHubContent, error) {
+	c.treeOnce.Do(func() {
+		url := fmt.Sprintf("https://api.github.com/repos/%s/%s/git/trees/%s?recursive=1",
+			c.Owner, c.Repo, c.Branch)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			c.treeErr = err
+			return
+		}
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+		resp, err := c.do(req)
+		if err != nil {
+			c.treeErr = err
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			c.treeErr = fmt.Errorf("GitHub API error: %d - %s", resp.StatusCode, string(body))
+			return
+		}
+
+		var tree treeResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+			c.treeErr = fmt.Errorf("failed to parse tree: %w", err)
+			return
+		}
+		if tree.Truncated {
+			return
+		}
+		c.dirs = dirsFromTree(tree.Tree)
+	})
+	return c.dirs, c.treeErr
+}
+
+// dirsFromTree groups the entries of a recursive tree by the directory
+// they are in, "" being the top of the branch.
+func dirsFromTree(entries []treeEntry) map[string][]GitHubContent {
+	dirs := map[string][]GitHubContent{"": nil}
+	for _, e := range entries {
+		item := GitHubContent{Name: path.Base(e.Path), Path: e.Path, SHA: e.SHA, Size: e.Size}
+		switch e.Type {
+		case "blob":
+			item.Type = "file"
+		case "tree":
+			item.Type = "dir"
+			if _, ok := dirs[e.Path]; !ok {
+				dirs[e.Path] = nil
+			}
+		default:
+			// Submodules.
+			continue
+		}
+		dir := path.Dir(e.Path)
+		if dir == "." {
+			dir = ""
+		}
+		dirs[dir] = append(dirs[dir], item)
+	}
+	for _, items := range dirs {
+		sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	}
+	return dirs
+}
+
+// listTree lists dir from the recursive tree. ok is false when there is no
+// tree to list from.
+func (c *GitHubClient) listTree(dir string) (contents []GitHubContent, ok bool, err error) {
+	dirs, err := c.tree()
+	if err != nil || dirs == nil {
+		return nil, false, err
+	}
+	items, found := dirs[strings.Trim(dir, "/")]
+	if !found {
+		return nil, true, fmt.Errorf("%s: %w", dir, ErrNotFound)
+	}
+	return items, true, nil
+}
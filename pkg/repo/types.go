@@ -1,33 +1,87 @@
 package repo
 
+// IndexFile is one file of an index entry. Size and SHA256 describe the
+// real content, also for files kept in Git LFS. Blob is the Git blob SHA,
+// when the source has one. DTBs lists the device trees in a kernel's dtb
+// archive and Release is the kernel release of its modules archive.
+type IndexFile struct {
+	Name    string   `yaml:"name"`
+	Size    int64    `yaml:"size"`
+	SHA256  string   `yaml:"sha256"`
+	Blob    string   `yaml:"blob,omitempty"`
+	DTBs    []string `yaml:"dtbs,omitempty"`
+	Release string   `yaml:"release,omitempty"`
+	// Described is set once the content of a dtb or modules archive has
+	// been read, even if it had no device trees or release, so the same
+	// blob is not downloaded again on the next update.
+	Described bool `yaml:"described,omitempty"`
+}
+
+// KernelIndex is a kernel bundle. Vendors are those it has a dtb archive
+// for; Vendor is the first of them. Release is the kernel release
+// (uname -r) of its modules.
 type KernelIndex struct {
-	Version string `yaml:"version"`
-	Vendor  string `yaml:"vendor"`
-	Path    string `yaml:"path"`
+	Version string      `yaml:"version"`
+	Release string      `yaml:"release,omitempty"`
+	Vendor  string      `yaml:"vendor"`
+	Vendors []string    `yaml:"vendors,omitempty"`
+	Path    string      `yaml:"path"`
+	Repo    string      `yaml:"repo,omitempty"`
+	Files   []IndexFile `yaml:"files"`
 }
 
 type RootfsIndex struct {
-	Name string `yaml:"name"`
-	Type string `yaml:"type"`
-	Size int64  `yaml:"size"`
-	Path string `yaml:"path"`
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"`
+	Size   int64  `yaml:"size"`
+	Path   string `yaml:"path"`
+	SHA256 string `yaml:"sha256"`
+	Blob   string `yaml:"blob,omitempty"`
+	Repo   string `yaml:"repo,omitempty"`
 }
 
 type DeviceIndex struct {
 	Name   string `yaml:"name"`
 	Vendor string `yaml:"vendor"`
 	Path   string `yaml:"path"`
+	Repo   string `yaml:"repo,omitempty"`
 }
 
 type PatchIndex struct {
-	Name string `yaml:"name"`
-	Size int64  `yaml:"size"`
-	Path string `yaml:"path"`
+	Name   string `yaml:"name"`
+	Size   int64  `yaml:"size"`
+	Path   string `yaml:"path"`
+	SHA256 string `yaml:"sha256"`
+	Blob   string `yaml:"blob,omitempty"`
+	Repo   string `yaml:"repo,omitempty"`
+}
+
+// LoaderIndex lists the bootloader files of a vendor. File names are
+// relative to Path.
+type LoaderIndex struct {
+	Vendor string      `yaml:"vendor"`
+	Path   string      `yaml:"path"`
+	Repo   string      `yaml:"repo,omitempty"`
+	Files  []IndexFile `yaml:"files"`
 }
 
+// FirmwareIndex lists the firmware files. File names are relative to
+// Path.
+type FirmwareIndex struct {
+	Path  string      `yaml:"path"`
+	Repo  string      `yaml:"repo,omitempty"`
+	Files []IndexFile `yaml:"files"`
+}
+
+// IndexMetadata describes where an index came from. Generated is when it
+// was fetched and Checked, when set, the last time 'omb repo update' found
+// it current. Revisions maps each repository to the commit SHA (or mirror
+// ETag) the index was built from.
 type IndexMetadata struct {
-	Generated string `yaml:"generated"`
-	Source    string `yaml:"source"`
+	Generated string            `yaml:"generated"`
+	Checked   string            `yaml:"checked,omitempty"`
+	Source    string            `yaml:"source"`
+	Revisions map[string]string `yaml:"revisions,omitempty"`
 }
 
 type KernelsYAML struct {
@@ -49,3 +103,13 @@ type PatchesYAML struct {
 	Metadata IndexMetadata `yaml:"metadata"`
 	Patches  []PatchIndex  `yaml:"patches"`
 }
+
+type LoadersYAML struct {
+	Metadata IndexMetadata `yaml:"metadata"`
+	Loaders  []LoaderIndex `yaml:"loaders"`
+}
+
+type FirmwareYAML struct {
+	Metadata IndexMetadata `yaml:"metadata"`
+	Firmware FirmwareIndex `yaml:"firmware"`
+}
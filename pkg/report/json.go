@@ -0,0 +1,43 @@
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval limits download_progress events per file.
+const progressInterval = time.Second
+
+// JSON writes each event as one line of JSON.
+type JSON struct {
+	mu           sync.Mutex
+	enc          *json.Encoder
+	lastProgress map[string]time.Time
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{enc: json.NewEncoder(w), lastProgress: map[string]time.Time{}}
+}
+
+func (j *JSON) Report(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	switch e.Kind {
+	case DownloadProgress:
+		if e.Time.Sub(j.lastProgress[e.File]) < progressInterval {
+			return
+		}
+		j.lastProgress[e.File] = e.Time
+	case DownloadFinished:
+		delete(j.lastProgress, e.File)
+	}
+
+	j.enc.Encode(e)
+}
@@ -0,0 +1,79 @@
+// Package report carries build progress from the builder and download
+// manager to whatever renders it: the familiar console output, or newline
+// delimited JSON for CI.
+package report
+
+import "time"
+
+type Kind string
+
+const (
+	BuildStarted     Kind = "build_started"
+	BuildFinished    Kind = "build_finished"
+	BuildFailed      Kind = "build_failed"
+	StageStarted     Kind = "stage_started"
+	StageFinished    Kind = "stage_finished"
+	Step             Kind = "step"
+	Info             Kind = "info"
+	Warning          Kind = "warning"
+	FilesStaged      Kind = "files_staged"
+	DownloadStarted  Kind = "download_started"
+	DownloadProgress Kind = "download_progress"
+	DownloadFinished Kind = "download_finished"
+
+	CacheCheckStarted  Kind = "cache_check_started"
+	CacheChecked       Kind = "cache_checked"
+	CacheCheckFinished Kind = "cache_check_finished"
+)
+
+// Results of a CacheChecked event, in its Status.
+const (
+	CacheValid      = "valid"
+	CacheInvalid    = "invalid"
+	CacheUnverified = "unverified"
+)
+
+// Build stages, in the order they run.
+const (
+	StageValidate   = "validate"
+	StageImage      = "image"
+	StageKernel     = "kernel"
+	StageRootfs     = "rootfs"
+	StageBootloader = "bootloader"
+)
+
+// Event is one progress report. Only the fields that make sense for the
+// kind are set.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    Kind      `json:"kind"`
+	Target  string    `json:"target,omitempty"`
+	Stage   string    `json:"stage,omitempty"`
+	Message string    `json:"message,omitempty"`
+
+	// File is the download name, the output image for build events or
+	// the artifact for cache events.
+	File  string `json:"file,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+	Total int64  `json:"total,omitempty"`
+	Count int    `json:"count,omitempty"`
+
+	// Status is the result of a CacheChecked event.
+	Status string `json:"status,omitempty"`
+
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Reporter receives events. Implementations must be safe for concurrent
+// use.
+type Reporter interface {
+	Report(Event)
+}
+
+// Discard drops every event.
+var Discard Reporter = discard{}
+
+type discard struct{}
+
+func (discard) Report(Event) {}
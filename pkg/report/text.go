@@ -0,0 +1,113 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+var stageIcons = map[string]string{
+	StageImage:      "💾 ",
+	StageKernel:     "🔧 ",
+	StageRootfs:     "📦 ",
+	StageBootloader: "🚀 ",
+}
+
+// Text renders events as console output, with progress bars for
+// downloads.
+type Text struct {
+	mu   sync.Mutex
+	w    io.Writer
+	bars map[string]*progressbar.ProgressBar
+}
+
+func NewText(w io.Writer) *Text {
+	return &Text{w: w, bars: map[string]*progressbar.ProgressBar{}}
+}
+
+func (t *Text) Report(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch e.Kind {
+	case BuildStarted:
+		t.printf(e, "🔨 %s\n", e.Message)
+	case BuildFinished:
+		t.printf(e, "\n✅ %s\n   Output: %s\n", e.Message, e.File)
+	case BuildFailed:
+		if e.Target != "" {
+			t.printf(e, "❌ Build failed: %s\n", e.Error)
+		}
+	case StageStarted:
+		if e.Stage == StageValidate {
+			t.printf(e, "\n")
+		}
+		t.printf(e, "%s%s\n", stageIcons[e.Stage], e.Message)
+	case Step, FilesStaged:
+		t.printf(e, "   ✓ %s\n", e.Message)
+	case Info:
+		t.printf(e, "   %s\n", e.Message)
+	case Warning:
+		t.printf(e, "   Warning: %s\n", e.Message)
+	case CacheCheckStarted:
+		t.printf(e, "\n🔍 %s\n", e.Message)
+	case CacheChecked:
+		name := e.File
+		if name != "" {
+			name = strings.ToUpper(name[:1]) + name[1:]
+		}
+		switch e.Status {
+		case CacheValid:
+			t.printf(e, "   ✓ %s: valid\n", name)
+		case CacheInvalid:
+			t.printf(e, "   ✗ %s: %s\n", name, e.Error)
+		default:
+			t.printf(e, "   ? %s: %s\n", name, e.Error)
+		}
+	case CacheCheckFinished:
+		t.printf(e, "\n📊 %s\n", e.Message)
+	case DownloadStarted:
+		bar := progressbar.DefaultBytes(e.Total, e.File)
+		if e.Bytes > 0 {
+			bar.Set64(e.Bytes)
+		}
+		t.bars[e.File] = bar
+	case DownloadProgress:
+		if bar, ok := t.bars[e.File]; ok {
+			// The total of a bundle grows as its files start.
+			if e.Total > 0 && e.Total != bar.GetMax64() {
+				bar.ChangeMax64(e.Total)
+			}
+			bar.Set64(e.Bytes)
+		}
+	case DownloadFinished:
+		if bar, ok := t.bars[e.File]; ok {
+			if e.Error != "" {
+				bar.Exit()
+			} else {
+				bar.Finish()
+			}
+			delete(t.bars, e.File)
+			fmt.Fprintln(t.w)
+		}
+	}
+}
+
+// printf writes the formatted lines, each prefixed with the target when
+// several builds share the output. Blank lines are dropped then, as they
+// no longer separate anything.
+func (t *Text) printf(e Event, format string, args ...any) {
+	text := fmt.Sprintf(format, args...)
+	if e.Target == "" {
+		io.WriteString(t.w, text)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if line != "" {
+			fmt.Fprintf(t.w, "[%s] %s\n", e.Target, line)
+		}
+	}
+}